@@ -180,6 +180,18 @@ set_var_to_option_value() {
     declare -g $3="${!__retval:-"$4"}"
 }
 
+# Reports the concrete value an option resolved to (e.g. "latest" => "v16.14.0") so it can be recorded in devcontainer-lock.json
+# report_resolved_option_value <feature id> <option name> <value>
+report_resolved_option_value() {
+    get_buld_arg_env_var_name "$1" "resolved_env_file_path"
+    local resolved_env_file_path="${!__retval}"
+    if [ -z "${resolved_env_file_path}" ]; then
+        return 0
+    fi
+    get_buld_arg_env_var_name "$1" "$2"
+    echo "${__retval}=\"$3\"" >> "${resolved_env_file_path}"
+}
+
 # run_if_exists <command> <command arguments>...
 run_if_exists() {
     if [ -e "$1" ]; then
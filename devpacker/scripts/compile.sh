@@ -29,6 +29,7 @@ else
     arch="amd64 arm64"
 fi
 arch=("${arch}")
+version="${DEVPACKER_VERSION:-"$(git -C "${root_path}" describe --tags --always --dirty 2>/dev/null || echo dev)"}"
 
 build_api_binary()
 {
@@ -44,7 +45,7 @@ build_api_binary()
             if [ "${target_os}" = "windows" ]; then
                 extn=".exe"
             fi
-            GOARCH="${target_arch}" GOOS="${target_os}" go build -a -o "${root_path}/dist/${binary_name}-${target_os}-${target_arch}${extn}"
+            GOARCH="${target_arch}" GOOS="${target_os}" go build -a -ldflags "-X main.Version=${version}" -o "${root_path}/dist/${binary_name}-${target_os}-${target_arch}${extn}"
         done
     done
 }
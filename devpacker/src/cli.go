@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Exit codes shared by all commands
+const (
+	ExitSuccess = 0 // Command completed
+	ExitFailure = 1 // Command failed, details are logged
+	ExitUsage   = 2 // Invalid command, flags, or arguments
+)
+
+var defaultExitCodes = []exitCode{
+	{ExitSuccess, "Success"},
+	{ExitFailure, "Command failed, see the log for details"},
+	{ExitUsage, "Invalid command, flags, or arguments"},
+}
+
+type exitCode struct {
+	Code        int
+	Description string
+}
+
+// A devpacker subcommand. Flags can appear before or after the subcommand name and its arguments.
+type command struct {
+	Name        string
+	Arguments   string // Usage text for positional arguments, e.g. "<image> [application folder]"
+	Description string
+	ExitCodes   []exitCode // Defaults to defaultExitCodes
+	// Defines the command's own flags and returns a new value for them to set, which is passed to Run
+	Flags       func(flags *flag.FlagSet) interface{}
+	Run         func(options interface{}, args []string, passThroughArgs []string) int
+	Hidden      bool // Not listed in help, used internally
+	RawArgs     bool // Arguments are passed to Run as-is without parsing flags
+	PassThrough bool // Unknown flags are returned in passThroughArgs rather than being an error
+}
+
+// Flags that apply to every command
+type globalOptions struct {
+	BuildMode string
+}
+
+var globals globalOptions
+
+func addGlobalFlags(flags *flag.FlagSet) {
+	flags.StringVar(&globals.BuildMode, "mode", "", "Override container image build mode: production | devcontainer")
+}
+
+// Returns the command's flag set, including global flags, and the options its flags set. Each call returns new
+// options, so flag sets for other commands never change them.
+func (cmd *command) flagSet() (*flag.FlagSet, interface{}) {
+	flags := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	addGlobalFlags(flags)
+	var options interface{}
+	if cmd.Flags != nil {
+		options = cmd.Flags(flags)
+	}
+	return flags, options
+}
+
+func (cmd *command) printUsage(writer io.Writer) {
+	fmt.Fprintf(writer, "Usage: devpacker %s [flags]", cmd.Name)
+	if cmd.Arguments != "" {
+		fmt.Fprintf(writer, " %s", cmd.Arguments)
+	}
+	fmt.Fprintf(writer, "\n\n%s\n\nFlags:\n", cmd.Description)
+	flags, _ := cmd.flagSet()
+	flags.SetOutput(writer)
+	flags.PrintDefaults()
+	fmt.Fprintln(writer, "\nExit codes:")
+	exitCodes := cmd.ExitCodes
+	if exitCodes == nil {
+		exitCodes = defaultExitCodes
+	}
+	for _, exitCode := range exitCodes {
+		fmt.Fprintf(writer, "  %d\t%s\n", exitCode.Code, exitCode.Description)
+	}
+}
+
+// Parses flags anywhere in args. Returns the positional arguments and, for commands that pass unknown flags
+// through, the unknown flags with their values. Unknown flags cannot be told apart from boolean flags, so they only
+// take the next argument as their value after the first positional argument (e.g. the image name for pack).
+func (cmd *command) parseArgs(flags *flag.FlagSet, args []string) ([]string, []string, error) {
+	var positional []string
+	var passThrough []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, arg)
+			continue
+		}
+		name, value, hasValue := splitFlag(arg)
+		if name == "h" || name == "help" {
+			return nil, nil, flag.ErrHelp
+		}
+		definedFlag := flags.Lookup(name)
+		if definedFlag == nil {
+			if !cmd.PassThrough {
+				return nil, nil, errors.New("Unknown flag: " + arg)
+			}
+			// Treat the next argument as the flag's value unless it is another flag or could be the first positional
+			passThrough = append(passThrough, arg)
+			if !hasValue && len(positional) > 0 && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				passThrough = append(passThrough, args[i+1])
+				i++
+			}
+			continue
+		}
+		if !hasValue {
+			if isBoolFlag(definedFlag) {
+				value = "true"
+			} else if i+1 < len(args) {
+				value = args[i+1]
+				i++
+			} else {
+				return nil, nil, errors.New("Flag needs a value: " + arg)
+			}
+		}
+		if err := flags.Set(name, value); err != nil {
+			return nil, nil, errors.New("Invalid value for " + arg + ": " + err.Error())
+		}
+	}
+	return positional, passThrough, nil
+}
+
+// Splits "--name=value" into its parts
+func splitFlag(arg string) (string, string, bool) {
+	name := strings.TrimLeft(arg, "-")
+	if index := strings.Index(name, "="); index > -1 {
+		return name[:index], name[index+1:], true
+	}
+	return name, "", false
+}
+
+func isBoolFlag(definedFlag *flag.Flag) bool {
+	boolFlag, isBool := definedFlag.Value.(interface{ IsBoolFlag() bool })
+	return isBool && boolFlag.IsBoolFlag()
+}
+
+// Runs the command in args, which can have flags before the command name. Returns the exit code.
+func runCli(commands []*command, defaultCommand string, args []string) int {
+	commandIndex := findCommand(commands, args)
+	if commandIndex < 0 {
+		if len(args) > 0 && (args[0] == "-h" || args[0] == "--help" || args[0] == "help") {
+			printCliUsage(os.Stdout, commands)
+			return ExitSuccess
+		}
+		for _, arg := range args {
+			if !strings.HasPrefix(arg, "-") {
+				fmt.Fprintln(os.Stderr, "Invalid devpacker command:", arg)
+				printCliUsage(os.Stderr, commands)
+				return ExitUsage
+			}
+		}
+		args = append([]string{defaultCommand}, args...)
+		commandIndex = 0
+	}
+	commandName := args[commandIndex]
+	commandArgs := append(append([]string{}, args[:commandIndex]...), args[commandIndex+1:]...)
+	if commandName == "help" {
+		if len(commandArgs) == 0 {
+			printCliUsage(os.Stdout, commands)
+			return ExitSuccess
+		}
+		if cmd := lookupCommand(commands, commandArgs[0]); cmd != nil {
+			cmd.printUsage(os.Stdout)
+			return ExitSuccess
+		}
+		fmt.Fprintln(os.Stderr, "Invalid devpacker command:", commandArgs[0])
+		return ExitUsage
+	}
+
+	cmd := lookupCommand(commands, commandName)
+	if cmd.RawArgs {
+		return cmd.Run(nil, args[commandIndex+1:], nil)
+	}
+	flags, options := cmd.flagSet()
+	positional, passThrough, err := cmd.parseArgs(flags, commandArgs)
+	if err == flag.ErrHelp {
+		cmd.printUsage(os.Stdout)
+		return ExitSuccess
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		cmd.printUsage(os.Stderr)
+		return ExitUsage
+	}
+	return cmd.Run(options, positional, passThrough)
+}
+
+// Returns the index of the command name in args, skipping flags and their values, or -1 if there is none
+func findCommand(commands []*command, args []string) int {
+	// Collect every flag so values of flags before the command name are skipped
+	allFlags := flag.NewFlagSet("all", flag.ContinueOnError)
+	addGlobalFlags(allFlags)
+	for _, cmd := range commands {
+		flags, _ := cmd.flagSet()
+		flags.VisitAll(func(definedFlag *flag.Flag) {
+			if allFlags.Lookup(definedFlag.Name) == nil {
+				allFlags.Var(definedFlag.Value, definedFlag.Name, definedFlag.Usage)
+			}
+		})
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return -1
+		}
+		if strings.HasPrefix(arg, "-") {
+			name, _, hasValue := splitFlag(arg)
+			if definedFlag := allFlags.Lookup(name); definedFlag != nil && !hasValue && !isBoolFlag(definedFlag) {
+				i++
+			}
+			continue
+		}
+		if arg == "help" || lookupCommand(commands, arg) != nil {
+			return i
+		}
+		return -1
+	}
+	return -1
+}
+
+func lookupCommand(commands []*command, name string) *command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func printCliUsage(writer io.Writer, commands []*command) {
+	fmt.Fprintln(writer, "Usage: devpacker [flags] <command> [flags] [arguments]\n\nCommands:")
+	var visible []*command
+	for _, cmd := range commands {
+		if !cmd.Hidden {
+			visible = append(visible, cmd)
+		}
+	}
+	sort.Slice(visible, func(i, j int) bool { return visible[i].Name < visible[j].Name })
+	for _, cmd := range visible {
+		fmt.Fprintf(writer, "  %-10s %s\n", cmd.Name, strings.SplitN(cmd.Description, "\n", 2)[0])
+	}
+	fmt.Fprintln(writer, "\nRun \"devpacker help <command>\" or \"devpacker <command> --help\" for a command's flags and exit codes.")
+}
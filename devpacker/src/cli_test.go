@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+
+	"github.com/chuxel/devpacker-features/devpacker/finalize"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name                string
+		command             string
+		args                []string
+		expectedPositional  []string
+		expectedPassThrough []string
+		expectedOptions     interface{}
+		expectError         bool
+	}{
+		{
+			name:               "flags before and after arguments",
+			command:            "finalize",
+			args:               []string{"--engine", "podman", "app:latest", "--publish", "--output=feature", "./app"},
+			expectedPositional: []string{"app:latest", "./app"},
+			expectedOptions: finalizeOptionsWith(func(options *finalize.FinalizeOptions) {
+				options.EngineName = "podman"
+				options.Publish = true
+				options.OutputMode = "feature"
+			}),
+		},
+		{
+			name:               "arguments after -- are positional",
+			command:            "finalize",
+			args:               []string{"--update-lock", "--", "--not-a-flag"},
+			expectedPositional: []string{"--not-a-flag"},
+			expectedOptions:    finalizeOptionsWith(func(options *finalize.FinalizeOptions) { options.UpdateLock = true }),
+		},
+		{
+			name:                "unknown flags and their values pass through",
+			command:             "build",
+			args:                []string{"app:latest", "--builder", "my-builder", "-e", "A=b", "--publish", "--clear-cache", "--env=C=d"},
+			expectedPositional:  []string{"app:latest"},
+			expectedPassThrough: []string{"--builder", "my-builder", "-e", "A=b", "--clear-cache", "--env=C=d"},
+			expectedOptions:     finalizeOptionsWith(func(options *finalize.FinalizeOptions) { options.Publish = true }),
+		},
+		{
+			name:                "unknown flags before the first argument do not take a value",
+			command:             "build",
+			args:                []string{"--trust-builder", "myimage", "--builder", "my-builder", "--clear-cache"},
+			expectedPositional:  []string{"myimage"},
+			expectedPassThrough: []string{"--trust-builder", "--builder", "my-builder", "--clear-cache"},
+			expectedOptions:     finalizeOptionsWith(func(options *finalize.FinalizeOptions) {}),
+		},
+		{
+			name:                "unknown flag values before the first argument are positional",
+			command:             "build",
+			args:                []string{"--builder", "my-builder", "myimage"},
+			expectedPositional:  []string{"my-builder", "myimage"},
+			expectedPassThrough: []string{"--builder"},
+			expectedOptions:     finalizeOptionsWith(func(options *finalize.FinalizeOptions) {}),
+		},
+		{
+			name:            "command options",
+			command:         "inspect",
+			args:            []string{"--json", "--from-file", "inspect.json", "--docker-host=tcp://localhost:2375"},
+			expectedOptions: &inspectOptions{Json: true, FromFile: "inspect.json", Finalize: finalize.FinalizeOptions{DockerHost: "tcp://localhost:2375"}},
+		},
+		{
+			name:        "unknown flag",
+			command:     "finalize",
+			args:        []string{"app:latest", "--builder", "my-builder"},
+			expectError: true,
+		},
+		{
+			name:        "missing value",
+			command:     "test",
+			args:        []string{"app:latest", "--junit"},
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := lookupCommand(commands, test.command)
+			flags, options := cmd.flagSet()
+			positional, passThrough, err := cmd.parseArgs(flags, test.args)
+			if test.expectError {
+				if err == nil {
+					t.Errorf("Expected an error, got %v %v", positional, passThrough)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(positional, test.expectedPositional) {
+				t.Errorf("Got positional %v, expected %v", positional, test.expectedPositional)
+			}
+			if !reflect.DeepEqual(passThrough, test.expectedPassThrough) {
+				t.Errorf("Got pass through %v, expected %v", passThrough, test.expectedPassThrough)
+			}
+			if !reflect.DeepEqual(options, test.expectedOptions) {
+				t.Errorf("Got options %+v, expected %+v", options, test.expectedOptions)
+			}
+		})
+	}
+}
+
+// Returns finalize options with flag defaults and the changes made by update
+func finalizeOptionsWith(update func(options *finalize.FinalizeOptions)) *finalize.FinalizeOptions {
+	options := addFinalizeFlags(flag.NewFlagSet("defaults", flag.ContinueOnError)).(*finalize.FinalizeOptions)
+	update(options)
+	return options
+}
+
+func TestFindCommand(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected int
+	}{
+		{args: []string{"finalize", "app:latest"}, expected: 0},
+		{args: []string{"--mode", "devcontainer", "finalize", "app:latest"}, expected: 2},
+		{args: []string{"--engine", "podman", "--publish", "test", "app:latest"}, expected: 3},
+		{args: []string{"--engine=podman", "inspect"}, expected: 1},
+		{args: []string{"help", "build"}, expected: 0},
+		// The value of a flag is never mistaken for a command
+		{args: []string{"--output", "list", "finalize"}, expected: 2},
+		{args: []string{"--", "finalize"}, expected: -1},
+		{args: []string{"./features", "out"}, expected: -1},
+		{args: []string{"--publish"}, expected: -1},
+	}
+	for _, test := range tests {
+		if index := findCommand(commands, test.args); index != test.expected {
+			t.Errorf("Got %d for %v, expected %d", index, test.args, test.expected)
+		}
+	}
+}
+
+func TestRunCliOptionsPerCommand(t *testing.T) {
+	type engineOptions struct{ Engine string }
+	var ranWith []interface{}
+	run := func(options interface{}, args []string, passThroughArgs []string) int {
+		ranWith = append(ranWith, options)
+		return ExitSuccess
+	}
+	engineFlags := func(flags *flag.FlagSet) interface{} {
+		options := &engineOptions{}
+		flags.StringVar(&options.Engine, "engine", "docker", "")
+		return options
+	}
+	testCommands := []*command{
+		{Name: "first", Flags: engineFlags, Run: run},
+		{Name: "second", Flags: engineFlags, Run: run},
+	}
+
+	if exitCode := runCli(testCommands, "first", []string{"--engine", "podman", "first"}); exitCode != ExitSuccess {
+		t.Fatalf("Got exit code %d", exitCode)
+	}
+	// Building the other command's flag set must not reset or share the options
+	testCommands[1].flagSet()
+	if exitCode := runCli(testCommands, "first", []string{"second"}); exitCode != ExitSuccess {
+		t.Fatalf("Got exit code %d", exitCode)
+	}
+	expected := []interface{}{&engineOptions{Engine: "podman"}, &engineOptions{Engine: "docker"}}
+	if !reflect.DeepEqual(ranWith, expected) {
+		t.Errorf("Got options %+v, expected %+v", ranWith, expected)
+	}
+	if ranWith[0] == ranWith[1] {
+		t.Errorf("Expected each run to get its own options")
+	}
+}
+
+func TestBuildCommandNeedsImageFirst(t *testing.T) {
+	cmd := lookupCommand(commands, "build")
+	flags, options := cmd.flagSet()
+	positional, passThrough, err := cmd.parseArgs(flags, []string{"--builder", "my-builder", "myimage"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exitCode := cmd.Run(options, positional, passThrough); exitCode != ExitUsage {
+		t.Errorf("Got exit code %d, expected a usage error rather than building my-builder", exitCode)
+	}
+}
@@ -8,26 +8,36 @@ const DefaultContainerImageBuildMode = "production"
 const MetadataIdPrefix = "com.microsoft.devcontainer"
 const FeaturesetMetadataId = MetadataIdPrefix + ".featureset"
 const FeaturesMetadataId = MetadataIdPrefix + ".features"
+const FeatureConfigsMetadataId = FeaturesMetadataId + ".configs" // Full feature config in buildpack.toml
+const FeatureScriptsMetadataId = FeaturesMetadataId + ".scripts" // Feature id to the scripts it implements in buildpack.toml
 const FeatureLayerMetadataId = MetadataIdPrefix + ".feature"
 const BuildModeMetadataId = MetadataIdPrefix + ".buildmode"
-const PostProcessingDoneMetadataId = FeaturesMetadataId + ".done"
+const PostProcessingDoneMetadataId = FeaturesMetadataId + ".done" // Legacy space separated list of post processed feature ids
+const PostProcessingStateMetadataId = FeaturesMetadataId + ".state"
 
 // ENV variables
 const BuildpackDirEnvVar = "CNB_BUILDPACK_DIR"
 const ContainerImageBuildModeEnvVarName = "BP_DCNB_BUILD_MODE"
 const RemoveApplicationFolderOverrideEnvVarName = "BP_DCNB_OMIT_APP_DIR"
+const ApplicationFolderIncludeEnvVarName = "BP_DCNB_APP_DIR_INCLUDE"
+const ApplicationFolderExcludeEnvVarName = "BP_DCNB_APP_DIR_EXCLUDE"
 const OptionSelectionEnvVarPrefix = "_BUILD_ARG_"
 const ProjectTomlOptionSelectionEnvVarPrefix = "BP_CONTAINER_FEATURE_"
+const SecretPatternsEnvVarName = "BP_DCNB_SECRET_PATTERNS"
+const LogLevelEnvVarName = "BP_LOG_LEVEL"
+const UpdateLockEnvVarName = "BP_DCNB_UPDATE_LOCK"
 
 // Property names
 const BuildModeDevContainerJsonSetting = "buildMode"
 const TargetPathDevContainerJsonSetting = "targetPath"
+const ResolvedEnvFilePathVariableName = "RESOLVED_ENV_FILE_PATH"
 
 // TOML keys
 const OptionMetadataKeyPrefix = "option_"
 
 // Paths and filenames
 const DevpackSettingsFilename = "devpack-settings.json"
+const DevContainerLockFilename = "devcontainer-lock.json"
 const DevContainerConfigRelativeRoot = "/etc/dev-container-features"
 const DevContainerFeatureConfigSubfolder = DevContainerConfigRelativeRoot + "/feature-config"
 const ContainerImageBuildMarkerPath = "/usr/local" + DevContainerConfigRelativeRoot + "/dcnb-build-mode"
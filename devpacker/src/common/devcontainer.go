@@ -6,13 +6,34 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 
 	"github.com/tailscale/hujson"
 )
 
 // Pull in json as a simple map of maps given the structure
 type DevContainerJson struct {
-	Features map[string]interface{}
+	Features       map[string]interface{}
+	Customizations DevContainerJsonCustomizations
+	Build          *DevContainerJsonBuild `json:"build,omitempty"`
+}
+
+// The build property in devcontainer.json. Paths are relative to the folder devcontainer.json is in.
+type DevContainerJsonBuild struct {
+	Dockerfile string            `json:"dockerfile,omitempty"`
+	Context    string            `json:"context,omitempty"`
+	Args       map[string]string `json:"args,omitempty"`
+	Target     string            `json:"target,omitempty"`
+}
+
+type DevContainerJsonCustomizations struct {
+	Devpack DevpackCustomizations `json:"devpack"`
+}
+
+// Devpack specific settings that can be set under customizations.devpack in devcontainer.json
+type DevpackCustomizations struct {
+	AppFolderInclude []string `json:"appFolderInclude,omitempty"` // Glob patterns for application folder contents to keep in devcontainer mode
+	AppFolderExclude []string `json:"appFolderExclude,omitempty"` // Glob patterns for application folder contents to remove even if included
 }
 
 func loadDevContainerJsonConent(applicationFolder string) ([]byte, string) {
@@ -86,3 +107,16 @@ func FindDevContainerJson(applicationFolder string) string {
 	}
 	return expectedPath
 }
+
+var localEnvPattern = regexp.MustCompile(`\$\{localEnv:([^}:]+)(?::([^}]*))?\}`)
+
+// Replaces ${localEnv:NAME} and ${localEnv:NAME:default} references with values from this process's environment
+func ResolveLocalEnv(value string) string {
+	return localEnvPattern.ReplaceAllStringFunc(value, func(reference string) string {
+		match := localEnvPattern.FindStringSubmatch(reference)
+		if envValue, exists := os.LookupEnv(match[1]); exists {
+			return envValue
+		}
+		return match[2]
+	})
+}
@@ -0,0 +1,67 @@
+package common
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A rule from a .dockerignore file
+type dockerignoreRule struct {
+	Pattern   string
+	Exception bool // Pattern started with "!", so matching files are included again
+}
+
+// Exclusion rules from the .dockerignore file in a build context, if there is one
+type dockerignore struct {
+	Rules         []dockerignoreRule
+	HasExceptions bool
+}
+
+// Loads the .dockerignore file in the context folder. An empty set of rules is returned if there is none.
+func loadDockerignore(contextDir string) (dockerignore, error) {
+	var ignore dockerignore
+	file, err := os.Open(filepath.Join(contextDir, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return ignore, nil
+	} else if err != nil {
+		return ignore, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := dockerignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.Exception = true
+			ignore.HasExceptions = true
+			line = strings.TrimSpace(line[1:])
+		}
+		// Patterns are relative to the context, even with a leading "/"
+		rule.Pattern = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(line)), "/")
+		if rule.Pattern != "" {
+			ignore.Rules = append(ignore.Rules, rule)
+		}
+	}
+	return ignore, scanner.Err()
+}
+
+// True if the "/" separated path relative to the context is excluded. Like docker, a pattern also matches
+// everything in a folder it matches, and the last matching rule wins.
+func (ignore dockerignore) Excludes(relativePath string) bool {
+	excluded := false
+	for _, rule := range ignore.Rules {
+		for matchPath := relativePath; matchPath != "." && matchPath != "/"; matchPath = path.Dir(matchPath) {
+			if MatchesGlob(rule.Pattern, matchPath) {
+				excluded = !rule.Exception
+				break
+			}
+		}
+	}
+	return excluded
+}
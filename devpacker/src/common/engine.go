@@ -0,0 +1,139 @@
+package common
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Supported container engines
+const (
+	EngineDocker  = "docker"
+	EnginePodman  = "podman"
+	EngineNerdctl = "nerdctl"
+	EngineBuildah = "buildah"
+)
+
+// Abstraction over the container engine used to inspect, build, and tag images and run containers
+type ContainerEngine interface {
+	Name() string
+	ImageInspect(image string) (ImageInspect, error)
+	ImageBuild(options ImageBuildOptions) error
+	ImageTag(sourceImage string, targetImage string) error
+	// Removes an image tag, and the image if nothing else refers to it
+	ImageRemove(image string) error
+	// Loads images from a tarball in the "docker save" format
+	ImageLoad(tarballPath string) error
+	// Writes an image to a tarball in the "docker save" format
+	ImageSave(image string, tarballPath string) error
+	// Runs a command in a new container and removes the container afterwards. A command that fails is
+	// reported in the result's ExitCode, errors are only returned if the container could not be run.
+	ContainerRun(options ContainerRunOptions) (ContainerRunResult, error)
+	// Whether Dockerfiles built by the engine can use RUN --mount=type=bind
+	SupportsBuildMounts() bool
+	// Docker compatible API host (e.g. for pack's --docker-host), or "" if the engine does not have one
+	DockerApiHost() string
+}
+
+// Creates the named container engine. If engineName is empty, the engine is detected. The dockerHost is
+// used for the Docker Engine API and passed along to pack, DOCKER_HOST or the engine default is used if empty.
+// CLI based engines run commands using runner, or ExecRunner if runner is nil.
+func NewContainerEngine(engineName string, dockerHost string, runner CommandRunner) (ContainerEngine, error) {
+	if engineName == "" {
+		engineName = DetectContainerEngine(dockerHost)
+	}
+	switch engineName {
+	case EngineDocker:
+		return NewDockerEngine(dockerHost)
+	case EnginePodman, EngineNerdctl, EngineBuildah:
+		return NewCliEngine(engineName, dockerHost, runner), nil
+	default:
+		return nil, errors.New("Unsupported container engine: " + engineName)
+	}
+}
+
+// Subset of the image inspect response devpacker uses. Matches the "docker image inspect" JSON format.
+type ImageInspect struct {
+	Id       string      `json:"Id"`
+	RepoTags []string    `json:"RepoTags,omitempty"`
+	Config   ImageConfig `json:"Config"`
+	RootFS   ImageRootFS `json:"RootFS"`
+}
+
+type ImageConfig struct {
+	User         string              `json:"User,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+}
+
+type ImageRootFS struct {
+	Type   string   `json:"Type,omitempty"`
+	Layers []string `json:"Layers,omitempty"`
+}
+
+type ImageBuildOptions struct {
+	ContextDir string            // Folder to use as the build context
+	Dockerfile string            // Path to the Dockerfile relative to the context folder
+	BuildArgs  map[string]string // Build arguments
+	Tag        string            // Tag for the resulting image
+	Target     string            // Build stage to stop at, the last stage if empty
+	NoCache    bool              // Do not use the build cache
+}
+
+type ContainerRunOptions struct {
+	Image   string            // Image to run
+	User    string            // User to run as, defaults to the image's user
+	Command []string          // Replaces the image's CMD. The image's entrypoint is kept, except with buildah.
+	Files   map[string][]byte // Container path to the contents of an executable file copied in before the command starts. The folder must exist.
+}
+
+type ContainerRunResult struct {
+	ExitCode int
+	Output   string // Stdout and stderr. CLI engines only capture stdout, so redirect stderr in the command to include it.
+}
+
+// Returned when an image does not exist
+type ImageNotFoundError struct {
+	Image string
+}
+
+func (err ImageNotFoundError) Error() string {
+	return "Image not found: " + err.Image
+}
+
+// Returned when the container engine reports an error
+type EngineError struct {
+	Engine     string
+	StatusCode int
+	Message    string
+}
+
+func (err EngineError) Error() string {
+	message := err.Engine + " error"
+	if err.StatusCode != 0 {
+		message += " (status " + strconv.Itoa(err.StatusCode) + ")"
+	}
+	return message + ": " + strings.TrimSpace(err.Message)
+}
+
+// Splits an image reference into a repository and tag, defaulting the tag to "latest". Digest references are returned as-is.
+func SplitImageTag(image string) (string, string) {
+	if strings.Contains(image, "@") {
+		return image, ""
+	}
+	lastSlash := strings.LastIndex(image, "/")
+	if lastColon := strings.LastIndex(image, ":"); lastColon > lastSlash {
+		return image[:lastColon], image[lastColon+1:]
+	}
+	return image, "latest"
+}
+
+// Returns true if the error is an ImageNotFoundError
+func IsImageNotFound(err error) bool {
+	var notFoundErr ImageNotFoundError
+	return errors.As(err, &notFoundErr)
+}
@@ -0,0 +1,283 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Exit code the CLIs use when they fail rather than the command in the container
+const cliEngineErrorExitCode = 125
+
+// ContainerEngine that uses the CLI for Podman, nerdctl, or buildah
+type CliEngine struct {
+	Kind       string // One of EnginePodman, EngineNerdctl, EngineBuildah
+	Command    string // CLI to execute, defaults to Kind
+	DockerHost string // Docker compatible API host to use with pack, if any
+	Runner     CommandRunner
+}
+
+// Subset of "buildah inspect --type image" output
+type buildahInspect struct {
+	FromImageID string `json:"FromImageID"`
+	OCIv1       struct {
+		Config struct {
+			User         string              `json:"User"`
+			Env          []string            `json:"Env"`
+			Entrypoint   []string            `json:"Entrypoint"`
+			Cmd          []string            `json:"Cmd"`
+			WorkingDir   string              `json:"WorkingDir"`
+			Labels       map[string]string   `json:"Labels"`
+			ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+		} `json:"config"`
+		RootFS struct {
+			Type    string   `json:"type"`
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	} `json:"OCIv1"`
+}
+
+// Creates an engine that runs the given CLI using runner, or ExecRunner if runner is nil
+func NewCliEngine(kind string, dockerHost string, runner CommandRunner) *CliEngine {
+	if runner == nil {
+		runner = ExecRunner{}
+	}
+	return &CliEngine{Kind: kind, Command: kind, DockerHost: dockerHost, Runner: runner}
+}
+
+func (engine *CliEngine) Name() string {
+	return engine.Kind
+}
+
+func (engine *CliEngine) ImageInspect(image string) (ImageInspect, error) {
+	var inspect ImageInspect
+	var output []byte
+	var err error
+	if engine.Kind == EngineBuildah {
+		output, err = engine.Runner.Output("", engine.Command, "inspect", "--type", "image", image)
+	} else {
+		output, err = engine.Runner.Output("", engine.Command, "image", "inspect", image)
+	}
+	if err != nil {
+		return inspect, engine.toEngineError(image, err)
+	}
+	switch engine.Kind {
+	case EngineBuildah:
+		// Labels and other config are under OCIv1.config
+		var buildahImage buildahInspect
+		if err := json.Unmarshal(output, &buildahImage); err != nil {
+			return inspect, err
+		}
+		config := buildahImage.OCIv1.Config
+		inspect = ImageInspect{
+			Id:     buildahImage.FromImageID,
+			Config: ImageConfig(config),
+			RootFS: ImageRootFS{Type: buildahImage.OCIv1.RootFS.Type, Layers: buildahImage.OCIv1.RootFS.DiffIDs},
+		}
+	default:
+		// Podman and nerdctl return an array in the docker format
+		var images []ImageInspect
+		if err := json.Unmarshal(output, &images); err != nil {
+			return inspect, err
+		}
+		if len(images) == 0 {
+			return inspect, ImageNotFoundError{Image: image}
+		}
+		inspect = images[0]
+	}
+	return inspect, nil
+}
+
+func (engine *CliEngine) ImageBuild(options ImageBuildOptions) error {
+	args := []string{"build"}
+	if engine.Kind == EngineBuildah {
+		// Older versions of buildah only support "bud"
+		args = []string{"bud", "--layers"}
+	}
+	args = append(args, "-f", filepath.Join(options.ContextDir, options.Dockerfile))
+	if options.Tag != "" {
+		args = append(args, "-t", options.Tag)
+	}
+	if options.Target != "" {
+		args = append(args, "--target", options.Target)
+	}
+	if options.NoCache {
+		args = append(args, "--no-cache")
+	}
+	for name, value := range options.BuildArgs {
+		args = append(args, "--build-arg", name+"="+value)
+	}
+	args = append(args, options.ContextDir)
+	if err := engine.Runner.Run(options.ContextDir, engine.Command, args...); err != nil {
+		return engine.toEngineError("", err)
+	}
+	return nil
+}
+
+func (engine *CliEngine) ImageTag(sourceImage string, targetImage string) error {
+	if _, err := engine.Runner.Output("", engine.Command, "tag", sourceImage, targetImage); err != nil {
+		return engine.toEngineError(sourceImage, err)
+	}
+	return nil
+}
+
+func (engine *CliEngine) ImageRemove(image string) error {
+	if _, err := engine.Runner.Output("", engine.Command, "rmi", image); err != nil {
+		return engine.toEngineError(image, err)
+	}
+	return nil
+}
+
+func (engine *CliEngine) ImageLoad(tarballPath string) error {
+	args := []string{"load", "-i", tarballPath}
+	if engine.Kind == EngineBuildah {
+		args = []string{"pull", "docker-archive:" + tarballPath}
+	}
+	if _, err := engine.Runner.Output("", engine.Command, args...); err != nil {
+		return engine.toEngineError("", err)
+	}
+	return nil
+}
+
+func (engine *CliEngine) ImageSave(image string, tarballPath string) error {
+	args := []string{"save", "-o", tarballPath, image}
+	if engine.Kind == EngineBuildah {
+		args = []string{"push", image, "docker-archive:" + tarballPath}
+	}
+	if _, err := engine.Runner.Output("", engine.Command, args...); err != nil {
+		return engine.toEngineError(image, err)
+	}
+	return nil
+}
+
+// Creates a container, copies in files, and runs it attached. buildah runs the command without the image's entrypoint.
+func (engine *CliEngine) ContainerRun(options ContainerRunOptions) (ContainerRunResult, error) {
+	var result ContainerRunResult
+	createArgs := []string{"create"}
+	if engine.Kind == EngineBuildah {
+		createArgs = []string{"from"}
+	} else if options.User != "" {
+		createArgs = append(createArgs, "--user", options.User)
+	}
+	createArgs = append(createArgs, options.Image)
+	if engine.Kind != EngineBuildah {
+		createArgs = append(createArgs, options.Command...)
+	}
+	output, err := engine.Runner.Output("", engine.Command, createArgs...)
+	if err != nil {
+		return result, engine.toEngineError(options.Image, err)
+	}
+	// Container ID or name is the last line of output
+	outputLines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	container := strings.TrimSpace(outputLines[len(outputLines)-1])
+	defer func() {
+		if engine.Kind == EngineBuildah {
+			engine.Runner.Output("", engine.Command, "rm", container)
+		} else {
+			engine.Runner.Output("", engine.Command, "rm", "-f", container)
+		}
+	}()
+
+	if len(options.Files) > 0 {
+		tempDir, err := ioutil.TempDir("", "devpacker-run-")
+		if err != nil {
+			return result, err
+		}
+		defer os.RemoveAll(tempDir)
+		fileIndex := 0
+		for filePath, content := range options.Files {
+			fileIndex++
+			localPath := filepath.Join(tempDir, strconv.Itoa(fileIndex))
+			if err := ioutil.WriteFile(localPath, content, 0755); err != nil {
+				return result, err
+			}
+			copyArgs := []string{"cp", localPath, container + ":" + filePath}
+			if engine.Kind == EngineBuildah {
+				copyArgs = []string{"copy", container, localPath, filePath}
+			}
+			if _, err := engine.Runner.Output("", engine.Command, copyArgs...); err != nil {
+				return result, engine.toEngineError("", err)
+			}
+		}
+	}
+
+	runArgs := []string{"start", "--attach", container}
+	if engine.Kind == EngineBuildah {
+		runArgs = []string{"run"}
+		if options.User != "" {
+			runArgs = append(runArgs, "--user", options.User)
+		}
+		runArgs = append(append(runArgs, container, "--"), options.Command...)
+	}
+	output, err = engine.Runner.Output("", engine.Command, runArgs...)
+	result.Output = string(output)
+	if nonZeroExitErr, isNonZeroExitErr := err.(NonZeroExitError); isNonZeroExitErr && nonZeroExitErr.ExitCode != cliEngineErrorExitCode {
+		result.ExitCode = nonZeroExitErr.ExitCode
+		result.Output += nonZeroExitErr.Stderr
+		return result, nil
+	} else if err != nil {
+		return result, engine.toEngineError(options.Image, err)
+	}
+	return result, nil
+}
+
+// All supported CLIs can use RUN --mount=type=bind in a Dockerfile
+func (engine *CliEngine) SupportsBuildMounts() bool {
+	return true
+}
+
+// Returns the Docker compatible API host for the engine. For Podman, the API socket is used if one is not specified.
+func (engine *CliEngine) DockerApiHost() string {
+	if engine.DockerHost != "" || engine.Kind != EnginePodman {
+		return engine.DockerHost
+	}
+	output, err := engine.Runner.Output("", engine.Command, "info", "--format", "{{.Host.RemoteSocket.Path}}")
+	if socketPath := strings.TrimSpace(string(output)); err == nil && socketPath != "" {
+		if !strings.Contains(socketPath, "://") {
+			socketPath = "unix://" + socketPath
+		}
+		return socketPath
+	}
+	return ""
+}
+
+// Converts command failures into typed errors
+func (engine *CliEngine) toEngineError(image string, err error) error {
+	nonZeroExitErr, isNonZeroExitErr := err.(NonZeroExitError)
+	if !isNonZeroExitErr {
+		return err
+	}
+	if image != "" && isImageNotFoundMessage(nonZeroExitErr.Stderr) {
+		return ImageNotFoundError{Image: image}
+	}
+	return EngineError{Engine: engine.Kind, StatusCode: nonZeroExitErr.ExitCode, Message: nonZeroExitErr.Stderr}
+}
+
+// Matches the engines' messages for a missing image, such as podman's "image not known", nerdctl's "no such image",
+// and containerd's `image "name": not found`, but not other things that are not found like executables or networks
+var imageNotFoundPattern = regexp.MustCompile(`(?i)no such image|image not known|image "[^"]*":? not found`)
+
+func isImageNotFoundMessage(stderr string) bool {
+	return imageNotFoundPattern.MatchString(stderr)
+}
+
+// Returns the first supported engine that appears to be available. Docker is used if DOCKER_HOST or
+// its socket is present, then the first of podman, nerdctl, or buildah found in the PATH.
+func DetectContainerEngine(dockerHost string) string {
+	if dockerHost != "" || os.Getenv(DockerHostEnvVarName) != "" {
+		return EngineDocker
+	}
+	if _, err := os.Stat(strings.TrimPrefix(DefaultDockerHost, "unix://")); err == nil {
+		return EngineDocker
+	}
+	for _, engineName := range []string{EnginePodman, EngineNerdctl, EngineBuildah} {
+		if IsInPath(engineName) {
+			return engineName
+		}
+	}
+	return EngineDocker
+}
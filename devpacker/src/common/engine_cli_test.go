@@ -0,0 +1,134 @@
+package common
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// CommandRunner that records commands and returns canned stdout
+type stubRunner struct {
+	commands [][]string
+	output   string
+}
+
+func (runner *stubRunner) Run(workingDir string, name string, args ...string) error {
+	runner.commands = append(runner.commands, append([]string{name}, args...))
+	return nil
+}
+
+func (runner *stubRunner) Output(workingDir string, name string, args ...string) ([]byte, error) {
+	runner.commands = append(runner.commands, append([]string{name}, args...))
+	return []byte(runner.output), nil
+}
+
+func TestNewContainerEngineUsesRunner(t *testing.T) {
+	tests := []struct {
+		engineName      string
+		output          string
+		expectedCommand []string
+	}{
+		{
+			engineName:      EnginePodman,
+			output:          `[{"Id": "sha256:abc", "Config": {"User": "cnb"}}]`,
+			expectedCommand: []string{"podman", "image", "inspect", "test_image"},
+		},
+		{
+			engineName:      EngineBuildah,
+			output:          `{"FromImageID": "sha256:abc", "OCIv1": {"config": {"User": "cnb"}}}`,
+			expectedCommand: []string{"buildah", "inspect", "--type", "image", "test_image"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.engineName, func(t *testing.T) {
+			runner := &stubRunner{output: test.output}
+			engine, err := NewContainerEngine(test.engineName, "", runner)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inspect, err := engine.ImageInspect("test_image")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inspect.Id != "sha256:abc" || inspect.Config.User != "cnb" {
+				t.Errorf("Unexpected inspect result %+v", inspect)
+			}
+			if !reflect.DeepEqual(runner.commands, [][]string{test.expectedCommand}) {
+				t.Errorf("Got commands %v, expected %v", runner.commands, test.expectedCommand)
+			}
+		})
+	}
+}
+
+func TestNewCliEngineDefaultRunner(t *testing.T) {
+	engine := NewCliEngine(EngineNerdctl, "", nil)
+	if _, isExecRunner := engine.Runner.(ExecRunner); !isExecRunner {
+		t.Errorf("Got runner %T, expected ExecRunner", engine.Runner)
+	}
+	if _, err := NewContainerEngine("unknown", "", nil); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("Expected an unsupported engine error, got %v", err)
+	}
+}
+
+func TestCliEngineErrors(t *testing.T) {
+	tests := []struct {
+		stderr           string
+		expectedNotFound bool
+	}{
+		{stderr: "Error: test_image: image not known", expectedNotFound: true},
+		{stderr: "Error: no such image: test_image", expectedNotFound: true},
+		{stderr: `time="2022-05-01T00:00:00Z" level=fatal msg="1 errors:\nno such image: test_image"`, expectedNotFound: true},
+		{stderr: `FATA[0000] image "docker.io/library/test_image:latest": not found`, expectedNotFound: true},
+		{stderr: `Error: image "test_image" not found`, expectedNotFound: true},
+		{stderr: `Error: runc: exec: "bash": executable file not found in $PATH`},
+		{stderr: "Error: network not found: devpacker"},
+		{stderr: "Error: open /tmp/Dockerfile: file not found"},
+	}
+	engine := NewCliEngine(EnginePodman, "", &stubRunner{})
+	for _, test := range tests {
+		err := engine.toEngineError("test_image", NonZeroExitError{ExitCode: 125, Stderr: test.stderr})
+		if IsImageNotFound(err) != test.expectedNotFound {
+			t.Errorf("Got %v for %q, expected image not found to be %v", err, test.stderr, test.expectedNotFound)
+		}
+		var engineErr EngineError
+		if !test.expectedNotFound && !errors.As(err, &engineErr) {
+			t.Errorf("Expected an EngineError for %q, got %T", test.stderr, err)
+		}
+	}
+}
+
+func TestCliEngineImageLoadSave(t *testing.T) {
+	tests := []struct {
+		engineName       string
+		expectedCommands [][]string
+	}{
+		{
+			engineName:       EnginePodman,
+			expectedCommands: [][]string{{"podman", "load", "-i", "/tmp/in.tar"}, {"podman", "save", "-o", "/tmp/out.tar", "app:configured"}},
+		},
+		{
+			engineName:       EngineNerdctl,
+			expectedCommands: [][]string{{"nerdctl", "load", "-i", "/tmp/in.tar"}, {"nerdctl", "save", "-o", "/tmp/out.tar", "app:configured"}},
+		},
+		{
+			engineName:       EngineBuildah,
+			expectedCommands: [][]string{{"buildah", "pull", "docker-archive:/tmp/in.tar"}, {"buildah", "push", "app:configured", "docker-archive:/tmp/out.tar"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.engineName, func(t *testing.T) {
+			runner := &stubRunner{}
+			engine := NewCliEngine(test.engineName, "", runner)
+			if err := engine.ImageLoad("/tmp/in.tar"); err != nil {
+				t.Fatal(err)
+			}
+			if err := engine.ImageSave("app:configured", "/tmp/out.tar"); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(runner.commands, test.expectedCommands) {
+				t.Errorf("Got commands %v, expected %v", runner.commands, test.expectedCommands)
+			}
+		})
+	}
+}
@@ -0,0 +1,482 @@
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const DockerHostEnvVarName = "DOCKER_HOST"
+const DefaultDockerHost = "unix:///var/run/docker.sock"
+const dockerApiVersion = "v1.40"
+
+// ContainerEngine that talks to the Docker Engine API socket. Also works with engines that provide
+// a Docker compatible API like Podman.
+type DockerEngine struct {
+	Host       string
+	client     *http.Client
+	baseUrl    string
+	engineName string
+}
+
+// Streamed messages from the build API
+type dockerJsonMessage struct {
+	Stream      string `json:"stream"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+type dockerErrorResponse struct {
+	Message string `json:"message"`
+}
+
+type dockerContainerCreate struct {
+	Image string   `json:"Image"`
+	User  string   `json:"User,omitempty"`
+	Cmd   []string `json:"Cmd,omitempty"`
+}
+
+type dockerContainerCreateResponse struct {
+	Id string `json:"Id"`
+}
+
+type dockerContainerWaitResponse struct {
+	StatusCode int `json:"StatusCode"`
+}
+
+// Creates a DockerEngine for the specified host (e.g. unix:///var/run/docker.sock or tcp://host:2376).
+// If host is empty, DOCKER_HOST or the default socket is used.
+func NewDockerEngine(host string) (*DockerEngine, error) {
+	if host == "" {
+		host = os.Getenv(DockerHostEnvVarName)
+	}
+	if host == "" {
+		if runtime.GOOS == "windows" {
+			return nil, errors.New("Named pipes are not supported. Set DOCKER_HOST to a tcp:// address")
+		}
+		host = DefaultDockerHost
+	}
+	engine := &DockerEngine{Host: host, engineName: EngineDocker}
+	hostUrl, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{}
+	switch hostUrl.Scheme {
+	case "unix":
+		socketPath := hostUrl.Path
+		transport.DialContext = func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+		engine.baseUrl = "http://docker"
+	case "tcp", "http", "https":
+		scheme := "http"
+		if os.Getenv("DOCKER_TLS_VERIFY") != "" || hostUrl.Scheme == "https" {
+			if transport.TLSClientConfig, err = dockerTlsConfig(); err != nil {
+				return nil, err
+			}
+			scheme = "https"
+		}
+		engine.baseUrl = scheme + "://" + hostUrl.Host
+	default:
+		return nil, errors.New("Unsupported container engine host: " + host)
+	}
+	engine.client = &http.Client{Transport: transport}
+	return engine, nil
+}
+
+// Loads client certificates from DOCKER_CERT_PATH (or ~/.docker) like the docker CLI
+func dockerTlsConfig() (*tls.Config, error) {
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		certPath = filepath.Join(homeDir, ".docker")
+	}
+	certificate, err := tls.LoadX509KeyPair(filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	caBytes, err := ioutil.ReadFile(filepath.Join(certPath, "ca.pem"))
+	if err != nil {
+		return nil, err
+	}
+	caPool := x509.NewCertPool()
+	caPool.AppendCertsFromPEM(caBytes)
+	return &tls.Config{Certificates: []tls.Certificate{certificate}, RootCAs: caPool}, nil
+}
+
+func (engine *DockerEngine) Name() string {
+	return engine.engineName
+}
+
+// The Docker Engine API build endpoint uses the legacy builder, which does not support RUN --mount
+func (engine *DockerEngine) SupportsBuildMounts() bool {
+	return false
+}
+
+func (engine *DockerEngine) DockerApiHost() string {
+	return engine.Host
+}
+
+func (engine *DockerEngine) ImageInspect(image string) (ImageInspect, error) {
+	var inspect ImageInspect
+	response, err := engine.request(http.MethodGet, "/images/"+image+"/json", nil, nil, "")
+	if err != nil {
+		return inspect, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return inspect, ImageNotFoundError{Image: image}
+	}
+	if err := engine.checkResponse(response); err != nil {
+		return inspect, err
+	}
+	err = json.NewDecoder(response.Body).Decode(&inspect)
+	return inspect, err
+}
+
+func (engine *DockerEngine) ImageBuild(options ImageBuildOptions) error {
+	buildContext, err := tarBuildContext(options.ContextDir, options.Dockerfile)
+	if err != nil {
+		return err
+	}
+	defer buildContext.Close()
+	query := url.Values{}
+	query.Set("dockerfile", filepath.ToSlash(options.Dockerfile))
+	if options.Tag != "" {
+		query.Set("t", options.Tag)
+	}
+	if options.Target != "" {
+		query.Set("target", options.Target)
+	}
+	if options.NoCache {
+		query.Set("nocache", "1")
+	}
+	query.Set("rm", "1")
+	if len(options.BuildArgs) > 0 {
+		query.Set("buildargs", string(ToJsonRawMessage(options.BuildArgs)))
+	}
+	response, err := engine.request(http.MethodPost, "/build", query, buildContext, "application/x-tar")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := engine.checkResponse(response); err != nil {
+		return err
+	}
+	return engine.relayJsonMessages(response.Body)
+}
+
+func (engine *DockerEngine) ImageTag(sourceImage string, targetImage string) error {
+	repo, tag := SplitImageTag(targetImage)
+	query := url.Values{}
+	query.Set("repo", repo)
+	query.Set("tag", tag)
+	response, err := engine.request(http.MethodPost, "/images/"+sourceImage+"/tag", query, nil, "")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return ImageNotFoundError{Image: sourceImage}
+	}
+	return engine.checkResponse(response)
+}
+
+func (engine *DockerEngine) ImageRemove(image string) error {
+	response, err := engine.request(http.MethodDelete, "/images/"+image, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return ImageNotFoundError{Image: image}
+	}
+	return engine.checkResponse(response)
+}
+
+func (engine *DockerEngine) ImageLoad(tarballPath string) error {
+	file, err := os.Open(tarballPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	response, err := engine.request(http.MethodPost, "/images/load", nil, file, "application/x-tar")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := engine.checkResponse(response); err != nil {
+		return err
+	}
+	return engine.relayJsonMessages(response.Body)
+}
+
+func (engine *DockerEngine) ImageSave(image string, tarballPath string) error {
+	response, err := engine.request(http.MethodGet, "/images/"+image+"/get", nil, nil, "")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return ImageNotFoundError{Image: image}
+	}
+	if err := engine.checkResponse(response); err != nil {
+		return err
+	}
+	file, err := os.Create(tarballPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, response.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (engine *DockerEngine) ContainerRun(options ContainerRunOptions) (ContainerRunResult, error) {
+	var result ContainerRunResult
+	createBody := ToJsonRawMessage(dockerContainerCreate{Image: options.Image, User: options.User, Cmd: options.Command})
+	response, err := engine.request(http.MethodPost, "/containers/create", nil, bytes.NewReader(createBody), "application/json")
+	if err != nil {
+		return result, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return result, ImageNotFoundError{Image: options.Image}
+	}
+	if err := engine.checkResponse(response); err != nil {
+		return result, err
+	}
+	var created dockerContainerCreateResponse
+	if err := json.NewDecoder(response.Body).Decode(&created); err != nil {
+		return result, err
+	}
+	defer engine.containerRequest(http.MethodDelete, created.Id, "", url.Values{"force": {"1"}}, nil, "")
+
+	// Copy in files using an archive for each folder
+	filesByFolder := make(map[string]map[string][]byte)
+	for filePath, content := range options.Files {
+		folder, fileName := path.Split(filePath)
+		if filesByFolder[folder] == nil {
+			filesByFolder[folder] = make(map[string][]byte)
+		}
+		filesByFolder[folder][fileName] = content
+	}
+	for folder, files := range filesByFolder {
+		archive, err := tarFiles(files)
+		if err != nil {
+			return result, err
+		}
+		if _, err := engine.containerRequest(http.MethodPut, created.Id, "/archive", url.Values{"path": {folder}}, archive, "application/x-tar"); err != nil {
+			return result, err
+		}
+	}
+
+	if _, err := engine.containerRequest(http.MethodPost, created.Id, "/start", nil, nil, ""); err != nil {
+		return result, err
+	}
+	waitBody, err := engine.containerRequest(http.MethodPost, created.Id, "/wait", nil, nil, "")
+	if err != nil {
+		return result, err
+	}
+	var waitResponse dockerContainerWaitResponse
+	if err := json.Unmarshal(waitBody, &waitResponse); err != nil {
+		return result, err
+	}
+	result.ExitCode = waitResponse.StatusCode
+	logs, err := engine.containerRequest(http.MethodGet, created.Id, "/logs", url.Values{"stdout": {"1"}, "stderr": {"1"}}, nil, "")
+	if err != nil {
+		return result, err
+	}
+	result.Output = demuxDockerLogs(logs)
+	return result, nil
+}
+
+// Sends a request for a container and returns the response body
+func (engine *DockerEngine) containerRequest(method string, containerId string, action string, query url.Values, body io.Reader, contentType string) ([]byte, error) {
+	response, err := engine.request(method, "/containers/"+containerId+action, query, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if err := engine.checkResponse(response); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// Logs for containers without a TTY have an 8 byte header for each frame with the stream and frame size
+func demuxDockerLogs(logs []byte) string {
+	var output bytes.Buffer
+	for len(logs) >= 8 {
+		frameSize := int(binary.BigEndian.Uint32(logs[4:8]))
+		logs = logs[8:]
+		if frameSize > len(logs) {
+			frameSize = len(logs)
+		}
+		output.Write(logs[:frameSize])
+		logs = logs[frameSize:]
+	}
+	return output.String()
+}
+
+func (engine *DockerEngine) request(method string, path string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	requestUrl := engine.baseUrl + "/" + dockerApiVersion + path
+	if query != nil {
+		requestUrl += "?" + query.Encode()
+	}
+	request, err := http.NewRequest(method, requestUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	response, err := engine.client.Do(request)
+	if err != nil {
+		return nil, EngineError{Engine: engine.engineName, Message: "Unable to connect to " + engine.Host + ". " + err.Error()}
+	}
+	return response, nil
+}
+
+// Logs the output in a JSON message stream from a build or load. Failures are reported in the stream rather than
+// the status code.
+func (engine *DockerEngine) relayJsonMessages(body io.Reader) error {
+	decoder := json.NewDecoder(body)
+	for {
+		var message dockerJsonMessage
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if message.Error != "" {
+			return EngineError{Engine: engine.engineName, Message: message.Error}
+		}
+		if message.Stream != "" {
+			log.Print(message.Stream)
+		}
+	}
+}
+
+// Converts non-2xx responses into an EngineError
+func (engine *DockerEngine) checkResponse(response *http.Response) error {
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+	bodyBytes, _ := ioutil.ReadAll(response.Body)
+	var errorResponse dockerErrorResponse
+	message := string(bodyBytes)
+	if err := json.Unmarshal(bodyBytes, &errorResponse); err == nil && errorResponse.Message != "" {
+		message = errorResponse.Message
+	}
+	return EngineError{Engine: engine.engineName, StatusCode: response.StatusCode, Message: message}
+}
+
+// Creates an in-memory tar of executable files
+func tarFiles(files map[string][]byte) (io.Reader, error) {
+	var buffer bytes.Buffer
+	tarWriter := tar.NewWriter(&buffer)
+	for fileName, content := range files {
+		header := &tar.Header{Name: fileName, Mode: 0755, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tarWriter.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, err
+	}
+	return &buffer, nil
+}
+
+// Streams a tar of the build context folder, leaving out files excluded by its .dockerignore like the docker CLI.
+// The Dockerfile and .dockerignore are always sent. Errors reading the folder are returned when reading the tar.
+func tarBuildContext(contextDir string, dockerfile string) (io.ReadCloser, error) {
+	ignore, err := loadDockerignore(contextDir)
+	if err != nil {
+		return nil, err
+	}
+	alwaysInclude := []string{path.Clean(filepath.ToSlash(dockerfile)), ".dockerignore"}
+	reader, writer := io.Pipe()
+	go func() {
+		tarWriter := tar.NewWriter(writer)
+		err := filepath.Walk(contextDir, func(filePath string, fileInfo os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			relativePath, err := filepath.Rel(contextDir, filePath)
+			if err != nil || relativePath == "." {
+				return err
+			}
+			relativePath = filepath.ToSlash(relativePath)
+			if ignore.Excludes(relativePath) && !SliceContainsString(alwaysInclude, relativePath) {
+				// Files in an excluded folder can only be included again by an exception, or if they are always sent
+				if fileInfo.IsDir() && !ignore.HasExceptions && !strings.HasPrefix(alwaysInclude[0], relativePath+"/") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			return addToTar(tarWriter, filePath, relativePath, fileInfo)
+		})
+		if err == nil {
+			err = tarWriter.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader, nil
+}
+
+func addToTar(tarWriter *tar.Writer, filePath string, name string, fileInfo os.FileInfo) error {
+	linkTarget := ""
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if linkTarget, err = os.Readlink(filePath); err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(fileInfo, linkTarget)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return nil
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(tarWriter, file)
+	return err
+}
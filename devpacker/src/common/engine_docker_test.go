@@ -0,0 +1,178 @@
+package common
+
+import (
+	"archive/tar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Creates a build context with a .dockerignore and returns its folder
+func newTestBuildContext(t *testing.T, dockerignore string) string {
+	t.Helper()
+	contextDir := t.TempDir()
+	files := map[string]string{
+		".dockerignore":                  dockerignore,
+		".devcontainer/Dockerfile":       "FROM ubuntu\n",
+		".git/HEAD":                      "ref: refs/heads/main\n",
+		"node_modules/left-pad/index.js": "module.exports = {}\n",
+		"src/main.go":                    "package main\n",
+		"src/main_test.go":               "package main\n",
+		"docs/README.md":                 "# Docs\n",
+		"docs/keep.md":                   "# Keep\n",
+	}
+	for filePath, content := range files {
+		fullPath := filepath.Join(contextDir, filepath.FromSlash(filePath))
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return contextDir
+}
+
+// Returns the names of the files in a tar
+func readTarNames(t *testing.T, reader io.Reader) []string {
+	t.Helper()
+	var names []string
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			names = append(names, header.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestTarBuildContext(t *testing.T) {
+	tests := []struct {
+		name         string
+		dockerignore string
+		expected     []string
+	}{
+		{
+			name:     "empty .dockerignore",
+			expected: []string{".devcontainer/Dockerfile", ".dockerignore", ".git/HEAD", "docs/README.md", "docs/keep.md", "node_modules/left-pad/index.js", "src/main.go", "src/main_test.go"},
+		},
+		{
+			name:         "folders and globs",
+			dockerignore: "# Not needed in the image\n.git\n/node_modules\n\n**/*_test.go\n",
+			expected:     []string{".devcontainer/Dockerfile", ".dockerignore", "docs/README.md", "docs/keep.md", "src/main.go"},
+		},
+		{
+			name:         "exceptions",
+			dockerignore: "docs\n!docs/keep.md\n*\n!src\n",
+			expected:     []string{".devcontainer/Dockerfile", ".dockerignore", "src/main.go", "src/main_test.go"},
+		},
+		{
+			name:         "exception after a folder",
+			dockerignore: "docs\n!docs/keep.md\n",
+			expected:     []string{".devcontainer/Dockerfile", ".dockerignore", ".git/HEAD", "docs/keep.md", "node_modules/left-pad/index.js", "src/main.go", "src/main_test.go"},
+		},
+		{
+			name:         "Dockerfile and .dockerignore are always sent",
+			dockerignore: ".devcontainer\n.dockerignore\n.git\nnode_modules\nsrc\ndocs\n",
+			expected:     []string{".devcontainer/Dockerfile", ".dockerignore"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			contextDir := newTestBuildContext(t, test.dockerignore)
+			buildContext, err := tarBuildContext(contextDir, filepath.Join(".devcontainer", "Dockerfile"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer buildContext.Close()
+			if names := readTarNames(t, buildContext); !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("Got %v, expected %v", names, test.expected)
+			}
+		})
+	}
+}
+
+func TestDockerEngineImageBuild(t *testing.T) {
+	var query map[string][]string
+	var names []string
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if !strings.HasSuffix(request.URL.Path, "/build") {
+			http.NotFound(response, request)
+			return
+		}
+		query = request.URL.Query()
+		names = readTarNames(t, request.Body)
+		response.Write([]byte(`{"stream": "Step 1/1 : FROM ubuntu\n"}` + "\n" + `{"stream": "Successfully built\n"}`))
+	}))
+	defer server.Close()
+
+	engine, err := NewDockerEngine("tcp://" + strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contextDir := newTestBuildContext(t, "node_modules\n.git\n")
+	err = engine.ImageBuild(ImageBuildOptions{ContextDir: contextDir, Dockerfile: filepath.Join(".devcontainer", "Dockerfile"), Tag: "app:base", NoCache: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query["dockerfile"][0] != ".devcontainer/Dockerfile" || query["t"][0] != "app:base" || query["nocache"][0] != "1" {
+		t.Errorf("Unexpected build query %v", query)
+	}
+	expected := []string{".devcontainer/Dockerfile", ".dockerignore", "docs/README.md", "docs/keep.md", "src/main.go", "src/main_test.go"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Got build context %v, expected %v", names, expected)
+	}
+}
+
+func TestDockerEngineImageLoadSave(t *testing.T) {
+	var loaded []byte
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		switch {
+		case request.Method == http.MethodPost && strings.HasSuffix(request.URL.Path, "/images/load"):
+			loaded, _ = io.ReadAll(request.Body)
+			response.Write([]byte(`{"stream": "Loaded image: app:base\n"}`))
+		case request.Method == http.MethodGet && strings.HasSuffix(request.URL.Path, "/images/app:configured/get"):
+			response.Write([]byte("saved image"))
+		default:
+			http.NotFound(response, request)
+		}
+	}))
+	defer server.Close()
+
+	engine, err := NewDockerEngine("tcp://" + strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := t.TempDir()
+	if err := os.WriteFile(filepath.Join(folder, "in.tar"), []byte("image to load"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.ImageLoad(filepath.Join(folder, "in.tar")); err != nil {
+		t.Fatal(err)
+	}
+	if string(loaded) != "image to load" {
+		t.Errorf("Got %q, expected the tarball to be sent", loaded)
+	}
+	if err := engine.ImageSave("app:configured", filepath.Join(folder, "out.tar")); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := os.ReadFile(filepath.Join(folder, "out.tar")); string(saved) != "saved image" {
+		t.Errorf("Got %q, expected the saved image", saved)
+	}
+	if err := engine.ImageSave("missing", filepath.Join(folder, "missing.tar")); !IsImageNotFound(err) {
+		t.Errorf("Expected an image not found error, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// ContainerEngine that replays recorded "docker image inspect" output and records builds, tags, and container
+// runs rather than executing them. Used as a test double and to work with saved inspect output without a daemon.
+type ReplayEngine struct {
+	Images  map[string]ImageInspect
+	Builds  []ImageBuildOptions
+	Tags    map[string]string
+	Removed []string
+	Runs    []ContainerRunOptions
+	// Returns the image a build produces, which is added under the build's tag. Builds produce nothing if nil.
+	BuildResult func(options ImageBuildOptions) (ImageInspect, error)
+	// Returns the result of a container run, runs succeed with no output if nil
+	RunResult func(options ContainerRunOptions) (ContainerRunResult, error)
+	// Loads an image tarball. Nothing is loaded if nil.
+	LoadResult func(tarballPath string) error
+	// Writes an image tarball. Saving fails if nil since there are no images to write.
+	SaveResult func(image string, tarballPath string) error
+}
+
+func NewReplayEngine(images ...ImageInspect) *ReplayEngine {
+	engine := &ReplayEngine{Images: make(map[string]ImageInspect), Tags: make(map[string]string)}
+	for _, image := range images {
+		engine.AddImage(image)
+	}
+	return engine
+}
+
+// Creates a ReplayEngine from a file with the output of "docker image inspect" (a JSON array or single object)
+func NewReplayEngineFromFile(inspectJsonPath string) (*ReplayEngine, error) {
+	content, err := ioutil.ReadFile(inspectJsonPath)
+	if err != nil {
+		return nil, err
+	}
+	var images []ImageInspect
+	if strings.HasPrefix(strings.TrimSpace(string(content)), "[") {
+		err = json.Unmarshal(content, &images)
+	} else {
+		var image ImageInspect
+		err = json.Unmarshal(content, &image)
+		images = append(images, image)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayEngine(images...), nil
+}
+
+// Makes an image available by its ID, short ID, and any tags
+func (engine *ReplayEngine) AddImage(image ImageInspect) {
+	engine.Images[image.Id] = image
+	engine.Images[strings.TrimPrefix(image.Id, "sha256:")] = image
+	for _, tag := range image.RepoTags {
+		engine.Images[tag] = image
+	}
+}
+
+func (engine *ReplayEngine) Name() string {
+	return "Replay"
+}
+
+func (engine *ReplayEngine) SupportsBuildMounts() bool {
+	return true
+}
+
+func (engine *ReplayEngine) DockerApiHost() string {
+	return ""
+}
+
+func (engine *ReplayEngine) ImageInspect(image string) (ImageInspect, error) {
+	if inspect, hasKey := engine.Images[image]; hasKey {
+		return inspect, nil
+	}
+	if repo, tag := SplitImageTag(image); tag == "latest" {
+		if inspect, hasKey := engine.Images[repo+":latest"]; hasKey {
+			return inspect, nil
+		}
+	}
+	return ImageInspect{}, ImageNotFoundError{Image: image}
+}
+
+// Records the build. The tagged image is only changed if BuildResult is set since there is nothing to build it with.
+func (engine *ReplayEngine) ImageBuild(options ImageBuildOptions) error {
+	engine.Builds = append(engine.Builds, options)
+	if engine.BuildResult == nil {
+		return nil
+	}
+	inspect, err := engine.BuildResult(options)
+	if err != nil {
+		return err
+	}
+	if options.Tag != "" {
+		engine.Images[options.Tag] = inspect
+	}
+	return nil
+}
+
+func (engine *ReplayEngine) ImageTag(sourceImage string, targetImage string) error {
+	inspect, err := engine.ImageInspect(sourceImage)
+	if err != nil {
+		return err
+	}
+	engine.Tags[targetImage] = sourceImage
+	engine.Images[targetImage] = inspect
+	return nil
+}
+
+func (engine *ReplayEngine) ImageRemove(image string) error {
+	if _, err := engine.ImageInspect(image); err != nil {
+		return err
+	}
+	engine.Removed = append(engine.Removed, image)
+	delete(engine.Images, image)
+	delete(engine.Tags, image)
+	return nil
+}
+
+func (engine *ReplayEngine) ImageLoad(tarballPath string) error {
+	if engine.LoadResult == nil {
+		return nil
+	}
+	return engine.LoadResult(tarballPath)
+}
+
+func (engine *ReplayEngine) ImageSave(image string, tarballPath string) error {
+	if engine.SaveResult == nil {
+		return errors.New("Unable to save " + image + " since the replay engine only has image metadata")
+	}
+	return engine.SaveResult(image, tarballPath)
+}
+
+// Records the run and returns the result from RunResult
+func (engine *ReplayEngine) ContainerRun(options ContainerRunOptions) (ContainerRunResult, error) {
+	if _, err := engine.ImageInspect(options.Image); err != nil {
+		return ContainerRunResult{}, err
+	}
+	engine.Runs = append(engine.Runs, options)
+	if engine.RunResult == nil {
+		return ContainerRunResult{}, nil
+	}
+	return engine.RunResult(options)
+}
@@ -7,94 +7,135 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 )
 
-type FeatureMount struct {
-	Source string `json:"source,omitempty"`
-	Target string `json:"target,omitempty"`
-	Type   string `json:"type,omitempty"`
-}
+// Option types from the features spec
+const (
+	FeatureOptionTypeString  = "string"
+	FeatureOptionTypeBoolean = "boolean"
+)
+
+// Scripts a feature can implement in its bin folder
+var FeatureScripts = []string{"acquire", "configure", "detect", "test"}
 
 type FeatureOption struct {
-	Type        string      `json:"type,omitempty"`
-	Enum        []string    `json:"enum,omitempty"`
-	Proposals   []string    `json:"proposals,omitempty"`
-	Default     interface{} `json:"default,omitempty"`
-	Description string      `json:"description"`
+	Type        string      `json:"type,omitempty" toml:"type,omitempty"` // FeatureOptionTypeString or FeatureOptionTypeBoolean
+	Enum        []string    `json:"enum,omitempty" toml:"enum,omitempty"`
+	Proposals   []string    `json:"proposals,omitempty" toml:"proposals,omitempty"`
+	Default     interface{} `json:"default,omitempty" toml:"default,omitempty"`
+	Description string      `json:"description" toml:"description"`
+	Secret      bool        `json:"secret,omitempty" toml:"secret,omitempty"`
+}
+
+type VSCodeCustomizations struct {
+	Extensions []string               `json:"extensions,omitempty" toml:"extensions,omitempty"`
+	Settings   map[string]interface{} `json:"settings,omitempty" toml:"settings,omitempty"`
+}
+
+type FeatureCustomizations struct {
+	VSCode *VSCodeCustomizations `json:"vscode,omitempty" toml:"vscode,omitempty"`
 }
 
 type FeatureConfig struct {
-	Id           string                   `json:"id,omitempty"`
-	Name         string                   `json:"name,omitempty"`
-	Options      map[string]FeatureOption `json:"options,omitempty"`
-	Extensions   []string                 `json:"extensions,omitempty"`
-	Settings     map[string]interface{}   `json:"settings,omitempty"`
-	Entrypoint   string                   `json:"entrypoint,omitempty"`
-	Privileged   bool                     `json:"privileged,omitempty"`
-	Init         bool                     `json:"init,omitempty"`
-	ContainerEnv map[string]string        `json:"containerEnv,omitempty"`
-	Mounts       []FeatureMount           `json:"mounts,omitempty"`
-	CapAdd       []string                 `json:"capAdd,omitempty"`
-	SecurityOpt  []string                 `json:"securityOpt,omitempty"`
-	BuildArg     string                   `json:"buildArg,omitempty"`
-
-	// SetProperties(propertyMap map[string]interface{})
+	Id               string                   `json:"id,omitempty" toml:"id,omitempty"`
+	Name             string                   `json:"name,omitempty" toml:"name,omitempty"`
+	Version          string                   `json:"version,omitempty" toml:"version,omitempty"`
+	Description      string                   `json:"description,omitempty" toml:"description,omitempty"`
+	DocumentationURL string                   `json:"documentationURL,omitempty" toml:"documentationURL,omitempty"`
+	LicenseURL       string                   `json:"licenseURL,omitempty" toml:"licenseURL,omitempty"`
+	Keywords         []string                 `json:"keywords,omitempty" toml:"keywords,omitempty"`
+	LegacyIds        []string                 `json:"legacyIds,omitempty" toml:"legacyIds,omitempty"`
+	Deprecated       bool                     `json:"deprecated,omitempty" toml:"deprecated,omitempty"`
+	DependsOn        map[string]interface{}   `json:"dependsOn,omitempty" toml:"dependsOn,omitempty"`         // Feature id to option selections
+	InstallsAfter    []string                 `json:"installsAfter,omitempty" toml:"installsAfter,omitempty"` // Feature ids to install before this one if present
+	Options          map[string]FeatureOption `json:"options,omitempty" toml:"options,omitempty"`
+	Customizations   *FeatureCustomizations   `json:"customizations,omitempty" toml:"customizations,omitempty"`
+	Extensions       []string                 `json:"extensions,omitempty" toml:"extensions,omitempty"` // Legacy alias for customizations.vscode.extensions
+	Settings         map[string]interface{}   `json:"settings,omitempty" toml:"settings,omitempty"`     // Legacy alias for customizations.vscode.settings
+	Entrypoint       string                   `json:"entrypoint,omitempty" toml:"entrypoint,omitempty"` // Added to the devcontainer.metadata label
+	Privileged       bool                     `json:"privileged,omitempty" toml:"privileged,omitempty"`
+	Init             bool                     `json:"init,omitempty" toml:"init,omitempty"`
+	ContainerEnv     map[string]string        `json:"containerEnv,omitempty" toml:"containerEnv,omitempty"`
+	Mounts           []FeatureMount           `json:"mounts,omitempty" toml:"mounts,omitempty"`
+	CapAdd           []string                 `json:"capAdd,omitempty" toml:"capAdd,omitempty"`
+	SecurityOpt      []string                 `json:"securityOpt,omitempty" toml:"securityOpt,omitempty"`
+
+	// Lifecycle hooks in string, array, or object form, like devcontainer.json
+	OnCreateCommand   interface{} `json:"onCreateCommand,omitempty" toml:"onCreateCommand,omitempty"`
+	PostCreateCommand interface{} `json:"postCreateCommand,omitempty" toml:"postCreateCommand,omitempty"`
+	PostStartCommand  interface{} `json:"postStartCommand,omitempty" toml:"postStartCommand,omitempty"`
+	PostAttachCommand interface{} `json:"postAttachCommand,omitempty" toml:"postAttachCommand,omitempty"`
+
 	// FullFeatureId(devpackSettings DevpackSettings, separator string) string
+	// VSCodeExtensions() []string
+	// VSCodeSettings() map[string]interface{}
+	// SetVSCodeCustomizations(extensions []string, settings map[string]interface{}, legacy bool)
+	// LifecycleCommand(hook string) interface{}
+	// SetLifecycleCommand(hook string, command interface{})
 	// BuildEnvironment(optionSelections map[string]string, additionalVariables map[string]string) []string
 	// OptionEnvVarName(prefix string, optionId string) string
 	// ScriptPath(buidpackPath string, script string) string
+	// Scripts(buildpackPath string) []string
 }
 
 type FeaturesJson struct {
-	Features []FeatureConfig `json:"features"`
+	Features []FeatureConfig `json:"features" toml:"features"`
 
 	// Load(featuresPath string)
 }
 
-type LayerFeatureMetadata struct {
-	Id               string
-	Version          string
-	Config           FeatureConfig
-	OptionSelections map[string]string
+// e.g. chuxel/devcontainer/features/packcli
+func (feature *FeatureConfig) FullFeatureId(devpackSettings DevpackSettings, separator string) string {
+	if separator == "" {
+		separator = "/"
+	}
+	return devpackSettings.Publisher + separator + devpackSettings.FeatureSet + separator + feature.Id
 }
 
-func (feature *FeatureConfig) SetProperties(propertyMap map[string]interface{}) {
-	for property, value := range propertyMap {
-		if value != nil {
-			switch property {
-			case "Mounts":
-				out := []FeatureMount{}
-				inputInterfaceArray := value.([]map[string]interface{})
-				for _, value := range inputInterfaceArray {
-					obj := PropertyMapToInterface(value, reflect.TypeOf(FeatureMount{})).(*FeatureMount)
-					out = append(out, *obj)
-				}
-				feature.Mounts = out
-			case "Options":
-				// Convert map[string]interface{} to map[string]FeatureOption
-				out := make(map[string]FeatureOption)
-				inputInterfaceMap := value.(map[string]interface{})
-				for key, value := range inputInterfaceMap {
-					valuePropertyMap := value.(map[string]interface{})
-					obj := PropertyMapToInterface(valuePropertyMap, reflect.TypeOf(FeatureOption{})).(*FeatureOption)
-					out[key] = *obj
-				}
-				feature.Options = out
-			default:
-				field := reflect.ValueOf(feature).Elem().FieldByName(property)
-				SetFieldValue(field, value)
-			}
+// Returns VS Code extensions from both customizations.vscode and the legacy extensions property
+func (feature *FeatureConfig) VSCodeExtensions() []string {
+	extensions := SliceUnion(nil, feature.Extensions)
+	if feature.Customizations != nil && feature.Customizations.VSCode != nil {
+		extensions = SliceUnion(extensions, feature.Customizations.VSCode.Extensions)
+	}
+	return extensions
+}
+
+// Returns VS Code settings from both customizations.vscode and the legacy settings property. Values in
+// customizations.vscode win if both set the same setting.
+func (feature *FeatureConfig) VSCodeSettings() map[string]interface{} {
+	settings := make(map[string]interface{})
+	for key, value := range feature.Settings {
+		settings[key] = value
+	}
+	if feature.Customizations != nil && feature.Customizations.VSCode != nil {
+		for key, value := range feature.Customizations.VSCode.Settings {
+			settings[key] = value
 		}
 	}
+	return settings
 }
 
-// e.g. chuxel/devcontainer/features/packcli
-func (feature *FeatureConfig) FullFeatureId(devpackSettings DevpackSettings, separator string) string {
-	if separator == "" {
-		separator = "/"
+// Sets VS Code extensions and settings in customizations.vscode, or the legacy top level properties if legacy is true
+func (feature *FeatureConfig) SetVSCodeCustomizations(extensions []string, settings map[string]interface{}, legacy bool) {
+	if len(settings) == 0 {
+		settings = nil
+	}
+	if legacy {
+		feature.Extensions = extensions
+		feature.Settings = settings
+		feature.Customizations = nil
+		return
+	}
+	feature.Extensions = nil
+	feature.Settings = nil
+	feature.Customizations = nil
+	if len(extensions) > 0 || len(settings) > 0 {
+		feature.Customizations = &FeatureCustomizations{VSCode: &VSCodeCustomizations{Extensions: extensions, Settings: settings}}
 	}
-	return devpackSettings.Publisher + separator + devpackSettings.FeatureSet + separator + feature.Id
 }
 
 func (feature *FeatureConfig) BuildEnvironment(optionSelections map[string]string, additionalVariables map[string]string) []string {
@@ -102,6 +143,9 @@ func (feature *FeatureConfig) BuildEnvironment(optionSelections map[string]strin
 	env := append(os.Environ(),
 		feature.OptionEnvVarName(OptionSelectionEnvVarPrefix, "")+"=true")
 	for optionId, selection := range optionSelections {
+		if feature.Options[optionId].Secret {
+			AddSecretValue(selection)
+		}
 		if selection != "" {
 			env = append(env, feature.OptionEnvVarName(OptionSelectionEnvVarPrefix, optionId)+"="+selection)
 		}
@@ -129,6 +173,29 @@ func (feature *FeatureConfig) ScriptPath(buidpackPath string, script string) str
 	return filepath.Join(buidpackPath, "features", feature.Id, "bin", script)
 }
 
+// Returns which of FeatureScripts the feature implements
+func (feature *FeatureConfig) Scripts(buildpackPath string) []string {
+	scripts := []string{}
+	for _, script := range FeatureScripts {
+		if _, err := os.Stat(feature.ScriptPath(buildpackPath, script)); err == nil {
+			scripts = append(scripts, script)
+		}
+	}
+	return scripts
+}
+
+// Returns a copy of the option selections with the values of any secret options masked
+func (feature *FeatureConfig) RedactOptionSelections(optionSelections map[string]string) map[string]string {
+	redacted := make(map[string]string)
+	for optionId, selection := range optionSelections {
+		if feature.Options[optionId].Secret {
+			selection = RedactedValue
+		}
+		redacted[optionId] = selection
+	}
+	return redacted
+}
+
 func (featuresJson *FeaturesJson) Load(featuresPath string) {
 	// Load devcontainer-features.json or features.json
 	if featuresPath == "" {
@@ -142,24 +209,103 @@ func (featuresJson *FeaturesJson) Load(featuresPath string) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	warnUnknownFeatureProperties(content)
 }
 
-func (lfm *LayerFeatureMetadata) SetProperties(propertyMap map[string]interface{}) {
-	for property, value := range propertyMap {
-		if value != nil {
-			if property == "Config" {
-				out := FeatureConfig{}
-				inputInterfaceMap := value.(map[string]interface{})
-				out.SetProperties(inputInterfaceMap)
-				lfm.Config = out
-			} else {
-				field := reflect.ValueOf(lfm).Elem().FieldByName(property)
-				SetFieldValue(field, value)
+// Logs a warning for any properties in devcontainer-features.json that are not in FeatureConfig or FeatureOption
+func warnUnknownFeatureProperties(content []byte) {
+	var rawFeaturesJson struct {
+		Features []map[string]json.RawMessage `json:"features"`
+	}
+	if err := json.Unmarshal(content, &rawFeaturesJson); err != nil {
+		log.Fatal(err)
+	}
+	featureProperties := jsonPropertyNames(reflect.TypeOf(FeatureConfig{}))
+	optionProperties := jsonPropertyNames(reflect.TypeOf(FeatureOption{}))
+	for _, rawFeature := range rawFeaturesJson.Features {
+		var featureId string
+		json.Unmarshal(rawFeature["id"], &featureId)
+		for _, property := range sortedRawMessageKeys(rawFeature) {
+			if !SliceContainsString(featureProperties, property) {
+				log.Printf("Warning: Ignoring unknown property \"%s\" in feature %s.", property, featureId)
+			}
+		}
+		var rawOptions map[string]map[string]json.RawMessage
+		if err := json.Unmarshal(rawFeature["options"], &rawOptions); err != nil || rawOptions == nil {
+			continue
+		}
+		for _, optionId := range sortedRawMessageMapKeys(rawOptions) {
+			for _, property := range sortedRawMessageKeys(rawOptions[optionId]) {
+				if !SliceContainsString(optionProperties, property) {
+					log.Printf("Warning: Ignoring unknown property \"%s\" in option %s of feature %s.", property, optionId, featureId)
+				}
+			}
+			var option FeatureOption
+			json.Unmarshal(ToJsonRawMessage(rawOptions[optionId]), &option)
+			if option.Type != "" && option.Type != FeatureOptionTypeString && option.Type != FeatureOptionTypeBoolean {
+				log.Printf("Warning: Unknown type \"%s\" for option %s of feature %s.", option.Type, optionId, featureId)
 			}
 		}
 	}
 }
 
+// Returns the json property names of a struct's fields
+func jsonPropertyNames(structType reflect.Type) []string {
+	var names []string
+	for i := 0; i < structType.NumField(); i++ {
+		if name := jsonFieldName(structType.Field(i)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Returns the json property name for a struct field, or an empty string if it is not serialized
+func jsonFieldName(field reflect.StructField) string {
+	name := field.Tag.Get("json")
+	if index := strings.Index(name, ","); index > -1 {
+		name = name[:index]
+	}
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+func sortedRawMessageKeys(rawMap map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(rawMap))
+	for key := range rawMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedRawMessageMapKeys(rawMap map[string]map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(rawMap))
+	for key := range rawMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns an option value from devcontainer.json or a default as the string passed to feature scripts. Boolean
+// options are "true" or "false".
+func OptionValueString(value interface{}) string {
+	switch typedValue := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return typedValue
+	case bool:
+		return strconv.FormatBool(typedValue)
+	case float64:
+		return strconv.FormatFloat(typedValue, 'f', -1, 64)
+	}
+	return string(ToJsonRawMessage(value))
+}
+
 func GetOptionMetadataKey(optionId string) string {
 	return OptionMetadataKeyPrefix + strings.ToLower(strings.ReplaceAll(optionId, "-", "_"))
 }
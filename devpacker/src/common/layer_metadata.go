@@ -0,0 +1,160 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version of the feature layer metadata format. Bump this and add a migration when the format changes.
+const LayerFeatureMetadataSchemaVersion = 2
+
+// Metadata about a feature stored with its layer. Stored as TOML by the lifecycle and found in the
+// io.buildpacks.lifecycle.metadata image label as JSON, so property names are the same in both.
+type LayerFeatureMetadata struct {
+	SchemaVersion    int               `json:"schemaVersion" toml:"schemaVersion"`
+	Id               string            `json:"id" toml:"id"`
+	Version          string            `json:"version,omitempty" toml:"version,omitempty"`
+	Config           FeatureConfig     `json:"config" toml:"config"`
+	OptionSelections map[string]string `json:"optionSelections,omitempty" toml:"optionSelections,omitempty"`
+	ResolvedOptions  map[string]string `json:"resolvedOptions,omitempty" toml:"resolvedOptions,omitempty"`
+	// Salted digest of the real option values, including secrets, so changes can be detected without storing them
+	OptionsDigest string `json:"optionsDigest,omitempty" toml:"optionsDigest,omitempty"`
+}
+
+// Returns a digest of option selections and resolved values with a random salt, in the form sha256:<salt>:<digest>.
+// The salt keeps secret values that are easy to guess from being found by hashing candidates.
+func SaltedOptionsDigest(optionSelections map[string]string, resolvedOptions map[string]string) string {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	saltHex := hex.EncodeToString(salt)
+	return "sha256:" + saltHex + ":" + optionsDigestHex(saltHex, optionSelections, resolvedOptions)
+}
+
+// Returns a digest of option selections and resolved values in the form sha256:<digest>
+func OptionsDigest(optionSelections map[string]string, resolvedOptions map[string]string) string {
+	return "sha256:" + optionsDigestHex("", optionSelections, resolvedOptions)
+}
+
+func optionsDigestHex(salt string, optionSelections map[string]string, resolvedOptions map[string]string) string {
+	var lines []string
+	for optionId, selection := range optionSelections {
+		lines = append(lines, "option:"+optionId+"="+selection)
+	}
+	for optionId, resolved := range resolvedOptions {
+		lines = append(lines, "resolved:"+optionId+"="+resolved)
+	}
+	sort.Strings(lines)
+	digest := sha256.Sum256([]byte(salt + strings.Join(lines, "\n")))
+	return hex.EncodeToString(digest[:])
+}
+
+// Functions that update metadata from a schema version to the next one, by the version they update from
+var layerFeatureMetadataMigrations = map[int]func(map[string]interface{}) map[string]interface{}{
+	1: migrateLayerFeatureMetadataV1,
+}
+
+// Decodes feature layer metadata from an image label, migrating metadata from older versions of devpacker
+func DecodeLayerFeatureMetadata(data interface{}) (LayerFeatureMetadata, error) {
+	var metadata LayerFeatureMetadata
+	propertyMap, isMap := data.(map[string]interface{})
+	if !isMap {
+		return metadata, errors.New("Feature layer metadata is not an object")
+	}
+	schemaVersion, err := layerFeatureMetadataSchemaVersion(propertyMap)
+	if err != nil {
+		return metadata, err
+	}
+	if schemaVersion > LayerFeatureMetadataSchemaVersion {
+		return metadata, errors.New("Feature layer metadata schema version " + strconv.Itoa(schemaVersion) + " is newer than this version of devpacker supports. Upgrade devpacker to use this image.")
+	}
+	for version := schemaVersion; version < LayerFeatureMetadataSchemaVersion; version++ {
+		propertyMap = layerFeatureMetadataMigrations[version](propertyMap)
+	}
+	content, err := json.Marshal(propertyMap)
+	if err != nil {
+		return metadata, err
+	}
+	err = json.Unmarshal(content, &metadata)
+	return metadata, err
+}
+
+// Metadata from before schemaVersion was added is version 1
+func layerFeatureMetadataSchemaVersion(propertyMap map[string]interface{}) (int, error) {
+	switch version := propertyMap["schemaVersion"].(type) {
+	case nil:
+		return 1, nil
+	case float64:
+		return int(version), nil
+	case int64:
+		return int(version), nil
+	case int:
+		return version, nil
+	}
+	return 0, errors.New("Invalid feature layer metadata schema version: " + string(ToJsonRawMessage(propertyMap["schemaVersion"])))
+}
+
+// Version 1 used Go field names (Id, Config, Options, ...) for every property rather than the names in
+// devcontainer-features.json
+func migrateLayerFeatureMetadataV1(propertyMap map[string]interface{}) map[string]interface{} {
+	migrated := renameGoFieldNames(propertyMap, reflect.TypeOf(LayerFeatureMetadata{})).(map[string]interface{})
+	migrated["schemaVersion"] = 2
+	return migrated
+}
+
+// Renames properties that use the Go field names of a type to their json names, including in nested structs.
+// Values for interface{} fields like lifecycle commands are left as-is.
+func renameGoFieldNames(value interface{}, valueType reflect.Type) interface{} {
+	for valueType.Kind() == reflect.Ptr {
+		valueType = valueType.Elem()
+	}
+	switch valueType.Kind() {
+	case reflect.Struct:
+		propertyMap, isMap := value.(map[string]interface{})
+		if !isMap {
+			return value
+		}
+		renamed := make(map[string]interface{})
+		for property, propertyValue := range propertyMap {
+			renamed[property] = propertyValue
+		}
+		for i := 0; i < valueType.NumField(); i++ {
+			field := valueType.Field(i)
+			jsonName := jsonFieldName(field)
+			if propertyValue, exists := propertyMap[field.Name]; exists && jsonName != "" {
+				delete(renamed, field.Name)
+				renamed[jsonName] = renameGoFieldNames(propertyValue, field.Type)
+			}
+		}
+		return renamed
+	case reflect.Map:
+		propertyMap, isMap := value.(map[string]interface{})
+		if !isMap {
+			return value
+		}
+		renamed := make(map[string]interface{})
+		for key, propertyValue := range propertyMap {
+			renamed[key] = renameGoFieldNames(propertyValue, valueType.Elem())
+		}
+		return renamed
+	case reflect.Slice:
+		items, isSlice := value.([]interface{})
+		if !isSlice {
+			return value
+		}
+		renamed := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			renamed = append(renamed, renameGoFieldNames(item, valueType.Elem()))
+		}
+		return renamed
+	}
+	return value
+}
@@ -0,0 +1,156 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Metadata for the python layer in testdata/lifecycle-metadata-v1.json after migrating it
+var expectedMigratedMetadata = LayerFeatureMetadata{
+	SchemaVersion: LayerFeatureMetadataSchemaVersion,
+	Id:            "chuxel/devcontainer-features/python",
+	Version:       "0.1.8",
+	Config: FeatureConfig{
+		Id:          "python",
+		Name:        "Python",
+		Description: "Installs Python",
+		Options: map[string]FeatureOption{
+			"version":      {Type: FeatureOptionTypeString, Enum: []string{"3.10", "3.9"}, Proposals: []string{"latest"}, Default: "latest", Description: "Select a Python version"},
+			"installTools": {Type: FeatureOptionTypeBoolean, Default: true, Description: "Install common Python tools"},
+		},
+		Customizations: &FeatureCustomizations{VSCode: &VSCodeCustomizations{
+			Extensions: []string{"ms-python.python"},
+			Settings:   map[string]interface{}{"python.defaultInterpreterPath": "/usr/local/bin/python", "python.linting.enabled": true},
+		}},
+		Init:              true,
+		ContainerEnv:      map[string]string{"PYTHONPATH": "/usr/local/lib/python"},
+		Mounts:            []FeatureMount{{Source: "pip-cache", Target: "/home/cnb/.cache/pip", Type: "volume"}},
+		CapAdd:            []string{"SYS_PTRACE"},
+		PostCreateCommand: []interface{}{"pip", "install", "-r", "requirements.txt"},
+	},
+	OptionSelections: map[string]string{"version": "3.10", "installTools": "true"},
+	ResolvedOptions:  map[string]string{"version": "3.10.4"},
+}
+
+// Returns the feature metadata for a layer in a recorded io.buildpacks.lifecycle.metadata label
+func loadLabelLayerMetadata(t *testing.T, labelPath string, layer string) interface{} {
+	t.Helper()
+	content, err := os.ReadFile(labelPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var label struct {
+		Buildpacks []struct {
+			Layers map[string]struct {
+				Data map[string]interface{} `json:"data"`
+			} `json:"layers"`
+		} `json:"buildpacks"`
+	}
+	if err := json.Unmarshal(content, &label); err != nil {
+		t.Fatal(err)
+	}
+	return label.Buildpacks[0].Layers[layer].Data[FeatureLayerMetadataId]
+}
+
+func TestDecodeLayerFeatureMetadataV1(t *testing.T) {
+	metadata, err := DecodeLayerFeatureMetadata(loadLabelLayerMetadata(t, filepath.Join("testdata", "lifecycle-metadata-v1.json"), "python"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata, expectedMigratedMetadata) {
+		t.Errorf("Got:\n%+v\nExpected:\n%+v", metadata, expectedMigratedMetadata)
+	}
+}
+
+// Layer metadata is written as TOML by libcnb, read by the lifecycle, and ends up as JSON in the image label
+func TestLayerFeatureMetadataRoundTrip(t *testing.T) {
+	metadata := expectedMigratedMetadata
+	metadata.OptionsDigest = SaltedOptionsDigest(metadata.OptionSelections, metadata.ResolvedOptions)
+	metadata.Config.Mounts = append(metadata.Config.Mounts, FeatureMount{Target: "/tmp/cache", Type: "tmpfs", Extra: map[string]string{"tmpfs-size": "64m"}})
+
+	var tomlBuffer bytes.Buffer
+	if err := toml.NewEncoder(&tomlBuffer).Encode(map[string]interface{}{FeatureLayerMetadataId: metadata}); err != nil {
+		t.Fatal(err)
+	}
+	var layerToml map[string]interface{}
+	if _, err := toml.Decode(tomlBuffer.String(), &layerToml); err != nil {
+		t.Fatal(err)
+	}
+	labelJson, err := json.Marshal(layerToml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var label map[string]interface{}
+	if err := json.Unmarshal(labelJson, &label); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string]interface{}{"TOML": layerToml[FeatureLayerMetadataId], "JSON label": label[FeatureLayerMetadataId]} {
+		decoded, err := DecodeLayerFeatureMetadata(data)
+		if err != nil {
+			t.Fatal(name, ": ", err)
+		}
+		// TOML integers decode as int64 and JSON numbers as float64, neither is used here, so values should match exactly
+		if !reflect.DeepEqual(decoded, metadata) {
+			t.Errorf("%s round trip got:\n%+v\nExpected:\n%+v", name, decoded, metadata)
+		}
+	}
+}
+
+func TestDecodeLayerFeatureMetadataErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          interface{}
+		errorContains string
+	}{
+		{name: "newer schema version", data: map[string]interface{}{"schemaVersion": float64(LayerFeatureMetadataSchemaVersion + 1), "id": "a/b/c"}, errorContains: "Upgrade devpacker"},
+		{name: "invalid schema version", data: map[string]interface{}{"schemaVersion": "2"}, errorContains: "Invalid feature layer metadata schema version"},
+		{name: "not an object", data: "chuxel/devcontainer-features/python", errorContains: "not an object"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := DecodeLayerFeatureMetadata(test.data); err == nil || !strings.Contains(err.Error(), test.errorContains) {
+				t.Errorf("Expected an error containing %q, got %v", test.errorContains, err)
+			}
+		})
+	}
+}
+
+func TestSaltedOptionsDigest(t *testing.T) {
+	selections := map[string]string{"version": "3.10", "token": "hunter2"}
+	resolved := map[string]string{"version": "3.10.4"}
+	digest := SaltedOptionsDigest(selections, resolved)
+	parts := strings.Split(digest, ":")
+	if len(parts) != 3 || parts[0] != "sha256" || len(parts[1]) != 32 || len(parts[2]) != 64 {
+		t.Fatalf("Unexpected digest format %q", digest)
+	}
+	if strings.Contains(digest, "hunter2") || parts[2] == strings.TrimPrefix(OptionsDigest(selections, resolved), "sha256:") {
+		t.Errorf("Expected the digest to be salted, got %q", digest)
+	}
+	if SaltedOptionsDigest(selections, resolved) == digest {
+		t.Errorf("Expected a new salt for each digest")
+	}
+	if optionsDigestHex(parts[1], selections, resolved) != parts[2] {
+		t.Errorf("Expected the same values and salt to give the same digest")
+	}
+	if optionsDigestHex(parts[1], map[string]string{"version": "3.10", "token": "hunter3"}, resolved) == parts[2] {
+		t.Errorf("Expected a changed secret to change the digest")
+	}
+}
+
+func TestOptionsDigest(t *testing.T) {
+	digest := OptionsDigest(map[string]string{"a": "1", "b": "2"}, nil)
+	if digest != OptionsDigest(map[string]string{"b": "2", "a": "1"}, map[string]string{}) {
+		t.Errorf("Expected the digest to not depend on order")
+	}
+	if digest == OptionsDigest(nil, map[string]string{"a": "1", "b": "2"}) {
+		t.Errorf("Expected selections and resolved values to be distinguished")
+	}
+}
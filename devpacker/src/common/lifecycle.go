@@ -0,0 +1,147 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Lifecycle hook properties features can set, in the order tools run them
+var LifecycleHooks = []string{"onCreateCommand", "postCreateCommand", "postStartCommand", "postAttachCommand"}
+
+// Returns the command for a lifecycle hook in string, array, or object form, or nil if it is not set
+func (feature *FeatureConfig) LifecycleCommand(hook string) interface{} {
+	switch hook {
+	case "onCreateCommand":
+		return feature.OnCreateCommand
+	case "postCreateCommand":
+		return feature.PostCreateCommand
+	case "postStartCommand":
+		return feature.PostStartCommand
+	case "postAttachCommand":
+		return feature.PostAttachCommand
+	}
+	log.Fatal("Unknown lifecycle hook: ", hook)
+	return nil
+}
+
+func (feature *FeatureConfig) SetLifecycleCommand(hook string, command interface{}) {
+	switch hook {
+	case "onCreateCommand":
+		feature.OnCreateCommand = command
+	case "postCreateCommand":
+		feature.PostCreateCommand = command
+	case "postStartCommand":
+		feature.PostStartCommand = command
+	case "postAttachCommand":
+		feature.PostAttachCommand = command
+	default:
+		log.Fatal("Unknown lifecycle hook: ", hook)
+	}
+}
+
+// Named lifecycle commands that keep the order entries were added in. Written out as object form, where tools
+// run each entry in parallel, or as a single sequential command with Sequential.
+type LifecycleCommands struct {
+	Names    []string
+	Commands map[string]interface{}
+}
+
+func NewLifecycleCommands() *LifecycleCommands {
+	return &LifecycleCommands{Commands: make(map[string]interface{})}
+}
+
+// Adds a command in string, array, or object form. Entries from object form commands are added as name:entry.
+// Adding a name that already exists replaces the command but keeps its position.
+func (commands *LifecycleCommands) Add(name string, command interface{}) {
+	switch value := command.(type) {
+	case nil:
+		return
+	case map[string]interface{}:
+		for _, entryName := range sortedMapKeys(value) {
+			commands.Add(name+":"+entryName, value[entryName])
+		}
+		return
+	case *LifecycleCommands:
+		for _, entryName := range value.Names {
+			commands.Add(name+":"+entryName, value.Commands[entryName])
+		}
+		return
+	}
+	if _, exists := commands.Commands[name]; !exists {
+		commands.Names = append(commands.Names, name)
+	}
+	commands.Commands[name] = command
+}
+
+func (commands *LifecycleCommands) IsEmpty() bool {
+	return len(commands.Names) == 0
+}
+
+func (commands *LifecycleCommands) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString("{")
+	for index, name := range commands.Names {
+		if index > 0 {
+			buffer.WriteString(",")
+		}
+		nameBytes, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		commandBytes, err := json.Marshal(commands.Commands[name])
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(nameBytes)
+		buffer.WriteString(":")
+		buffer.Write(commandBytes)
+	}
+	buffer.WriteString("}")
+	return buffer.Bytes(), nil
+}
+
+// Returns a string form command that runs each entry in a subshell, in order, stopping at the first one that
+// fails. Array form entries are quoted for the shell.
+func (commands *LifecycleCommands) Sequential() string {
+	entries := make([]string, 0, len(commands.Names))
+	for _, name := range commands.Names {
+		var entry string
+		switch command := commands.Commands[name].(type) {
+		case string:
+			entry = command
+		case []string:
+			entry = shellQuoteArgs(command)
+		case []interface{}:
+			args := make([]string, 0, len(command))
+			for _, arg := range command {
+				args = append(args, fmt.Sprint(arg))
+			}
+			entry = shellQuoteArgs(args)
+		default:
+			log.Fatal("Unsupported lifecycle command for ", name, ": ", command)
+		}
+		entries = append(entries, "( "+entry+" )")
+	}
+	return strings.Join(entries, " && ")
+}
+
+func shellQuoteArgs(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, "'"+strings.ReplaceAll(arg, "'", `'\''`)+"'")
+	}
+	return strings.Join(quoted, " ")
+}
+
+func sortedMapKeys(value map[string]interface{}) []string {
+	keys := make([]string, 0, len(value))
+	for key := range value {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
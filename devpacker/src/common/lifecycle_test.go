@@ -0,0 +1,42 @@
+package common
+
+import (
+	"encoding/json"
+	"os/exec"
+	"testing"
+)
+
+func TestLifecycleCommandsSequential(t *testing.T) {
+	commands := NewLifecycleCommands()
+	commands.Add("python", "pip install -r requirements.txt")
+	commands.Add("nodejs", []interface{}{"npm", "install", "it's"})
+	commands.Add("object", map[string]interface{}{"b": "echo b", "a": []string{"echo", "a"}})
+	commands.Add("python", "pip install -e .")
+
+	expected := `( pip install -e . ) && ( 'npm' 'install' 'it'\''s' ) && ( 'echo' 'a' ) && ( echo b )`
+	if sequential := commands.Sequential(); sequential != expected {
+		t.Errorf("Got %q, expected %q", sequential, expected)
+	}
+	if commandJson, _ := json.Marshal(commands); string(commandJson) != `{"python":"pip install -e .","nodejs":["npm","install","it's"],"object:a":["echo","a"],"object:b":"echo b"}` {
+		t.Errorf("Got object form %s", commandJson)
+	}
+}
+
+func TestLifecycleCommandsSequentialRuns(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+	commands := NewLifecycleCommands()
+	commands.Add("first", "cd / && printf first")
+	commands.Add("second", []string{"printf", "%s", " second's"})
+	commands.Add("fails", "exit 3")
+	commands.Add("skipped", "printf skipped")
+
+	output, err := exec.Command("sh", "-c", commands.Sequential()).Output()
+	if exitError, isExitError := err.(*exec.ExitError); !isExitError || exitError.ExitCode() != 3 {
+		t.Errorf("Expected exit code 3 from the failing entry, got %v", err)
+	}
+	if string(output) != "first second's" {
+		t.Errorf("Got output %q, expected entries to run in order and stop at the failure", output)
+	}
+}
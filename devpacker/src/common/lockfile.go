@@ -0,0 +1,91 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Contents of devcontainer-lock.json
+type DevContainerLock struct {
+	Features map[string]FeatureLock `json:"features"`
+
+	// Load(applicationFolder string) string
+	// LoadFile(lockFilePath string) bool
+	// Save(lockFilePath string) error
+}
+
+type FeatureLock struct {
+	Version  string            `json:"version,omitempty"`  // Devpack version the feature came from
+	Options  map[string]string `json:"options,omitempty"`  // Option selections as requested
+	Resolved map[string]string `json:"resolved,omitempty"` // Concrete values the feature reported for its options
+}
+
+// Returns the lock file path that goes with a devcontainer.json path. Like the dev container CLI,
+// .devcontainer.json pairs with .devcontainer-lock.json and devcontainer.json with devcontainer-lock.json
+func LockFilePath(devContainerJsonPath string) string {
+	lockFilename := DevContainerLockFilename
+	if strings.HasPrefix(filepath.Base(devContainerJsonPath), ".") {
+		lockFilename = "." + lockFilename
+	}
+	return filepath.Join(filepath.Dir(devContainerJsonPath), lockFilename)
+}
+
+// Loads the lock file next to devcontainer.json if one exists and returns its path ("" if not found)
+func (lock *DevContainerLock) Load(applicationFolder string) string {
+	devContainerJsonPath := FindDevContainerJson(applicationFolder)
+	if devContainerJsonPath == "" {
+		lock.Features = make(map[string]FeatureLock)
+		return ""
+	}
+	lockFilePath := LockFilePath(devContainerJsonPath)
+	if !lock.LoadFile(lockFilePath) {
+		return ""
+	}
+	return lockFilePath
+}
+
+// Loads the specified lock file, returns false if it does not exist
+func (lock *DevContainerLock) LoadFile(lockFilePath string) bool {
+	lock.Features = make(map[string]FeatureLock)
+	content, err := ioutil.ReadFile(lockFilePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatal("Failed to read ", lockFilePath, ": ", err)
+		}
+		return false
+	}
+	if err := json.Unmarshal(content, lock); err != nil {
+		log.Fatal("Failed to parse ", lockFilePath, ": ", err)
+	}
+	if lock.Features == nil {
+		lock.Features = make(map[string]FeatureLock)
+	}
+	return true
+}
+
+func (lock *DevContainerLock) Save(lockFilePath string) error {
+	lockBytes, err := json.MarshalIndent(lock, "", "\t")
+	if err != nil {
+		return err
+	}
+	return WriteFile(lockFilePath, lockBytes)
+}
+
+// Returns option selections with any resolved values pinned from the lock file. Pins only apply
+// while the requested selection for the option is the same as when the lock file was written.
+func (featureLock FeatureLock) PinOptionSelections(optionSelections map[string]string) map[string]string {
+	for optionId, resolved := range featureLock.Resolved {
+		if optionSelections[optionId] == featureLock.Options[optionId] {
+			optionSelections[optionId] = resolved
+		}
+	}
+	return optionSelections
+}
+
+func ShouldUpdateLock() bool {
+	return os.Getenv(UpdateLockEnvVarName) == "true"
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLockFilePath(t *testing.T) {
+	tests := []struct {
+		devContainerJsonPath string
+		expected             string
+	}{
+		{filepath.Join("app", ".devcontainer", "devcontainer.json"), filepath.Join("app", ".devcontainer", "devcontainer-lock.json")},
+		{filepath.Join("app", ".devcontainer.json"), filepath.Join("app", ".devcontainer-lock.json")},
+		{filepath.Join("app", ".devcontainer", "python", "devcontainer.json"), filepath.Join("app", ".devcontainer", "python", "devcontainer-lock.json")},
+	}
+	for _, test := range tests {
+		if lockFilePath := LockFilePath(test.devContainerJsonPath); lockFilePath != test.expected {
+			t.Errorf("Got %s for %s, expected %s", lockFilePath, test.devContainerJsonPath, test.expected)
+		}
+	}
+}
+
+func TestPinOptionSelections(t *testing.T) {
+	featureLock := FeatureLock{
+		Options:  map[string]string{"version": "latest", "tools": "true", "channel": "stable"},
+		Resolved: map[string]string{"version": "3.10.4", "channel": "stable-2022"},
+	}
+	tests := []struct {
+		name       string
+		selections map[string]string
+		expected   map[string]string
+	}{
+		{
+			name:       "same selections are pinned",
+			selections: map[string]string{"version": "latest", "tools": "true", "channel": "stable"},
+			expected:   map[string]string{"version": "3.10.4", "tools": "true", "channel": "stable-2022"},
+		},
+		{
+			name:       "changed selection is not pinned",
+			selections: map[string]string{"version": "3.9", "tools": "true", "channel": "stable"},
+			expected:   map[string]string{"version": "3.9", "tools": "true", "channel": "stable-2022"},
+		},
+		{
+			// A missing selection matches a missing option in the lock, not a locked default
+			name:       "selection no longer made is not pinned",
+			selections: map[string]string{"tools": "false"},
+			expected:   map[string]string{"tools": "false"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if pinned := featureLock.PinOptionSelections(test.selections); !reflect.DeepEqual(pinned, test.expected) {
+				t.Errorf("Got %v, expected %v", pinned, test.expected)
+			}
+		})
+	}
+}
+
+func TestPinOptionSelectionsWithoutLock(t *testing.T) {
+	selections := map[string]string{"version": "latest"}
+	if pinned := (FeatureLock{}).PinOptionSelections(selections); !reflect.DeepEqual(pinned, map[string]string{"version": "latest"}) {
+		t.Errorf("Got %v, expected selections to be unchanged", pinned)
+	}
+}
@@ -0,0 +1,240 @@
+package common
+
+import (
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const RedactedValue = "********"
+
+// Values shorter than this are not masked in free-form output since they would match too much (e.g. "true")
+const minRedactedValueLength = 4
+
+// Env var name patterns that are always treated as secrets, extended via BP_DCNB_SECRET_PATTERNS
+var defaultSecretPatterns = []string{"*TOKEN*", "*SECRET*", "*PASSWORD*", "*PASSWD*", "*CREDENTIAL*", "*API_KEY*", "*PRIVATE_KEY*", "*ACCESS_KEY*"}
+
+var redactor = newSecretRedactor()
+
+type secretRedactor struct {
+	mutex        sync.RWMutex
+	patterns     []string
+	secretNames  []string
+	secretValues []string
+}
+
+// Writer that masks any known secret values before passing output along. Output is held until the end of each line
+// so a secret split across writes (e.g. streamed script output) is still masked.
+type redactingWriter struct {
+	writer  io.Writer
+	mutex   sync.Mutex
+	pending []byte
+}
+
+// Partial lines longer than this are written out rather than held indefinitely
+const maxPendingLogBytes = 64 * 1024
+
+func newSecretRedactor() *secretRedactor {
+	sr := &secretRedactor{patterns: defaultSecretPatterns}
+	for _, pattern := range SplitList(os.Getenv(SecretPatternsEnvVarName)) {
+		sr.patterns = append(sr.patterns, strings.ToUpper(pattern))
+	}
+	for _, envVar := range os.Environ() {
+		name, value := splitEnvVar(envVar)
+		if sr.isSecret(name) {
+			sr.addValue(value)
+		}
+	}
+	return sr
+}
+
+func (sr *secretRedactor) isSecret(name string) bool {
+	name = strings.ToUpper(name)
+	return SliceContainsString(sr.secretNames, name) || MatchesAnyGlob(sr.patterns, name)
+}
+
+func (sr *secretRedactor) addValue(value string) {
+	if len(value) >= minRedactedValueLength {
+		sr.secretValues = AddToSliceIfUnique(sr.secretValues, value)
+	}
+}
+
+func (sr *secretRedactor) redact(text string) string {
+	for _, value := range sr.secretValues {
+		text = strings.ReplaceAll(text, value, RedactedValue)
+	}
+	return text
+}
+
+func (rw *redactingWriter) Write(bytes []byte) (int, error) {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	rw.pending = append(rw.pending, bytes...)
+	lineEnd := strings.LastIndex(string(rw.pending), "\n") + 1
+	if lineEnd == 0 && len(rw.pending) < maxPendingLogBytes {
+		return len(bytes), nil
+	}
+	if lineEnd == 0 {
+		lineEnd = len(rw.pending)
+	}
+	if err := rw.writeRedacted(rw.pending[:lineEnd]); err != nil {
+		return 0, err
+	}
+	rw.pending = append([]byte{}, rw.pending[lineEnd:]...)
+	return len(bytes), nil
+}
+
+// Writes out any partial line that is being held
+func (rw *redactingWriter) Flush() error {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	err := rw.writeRedacted(rw.pending)
+	rw.pending = nil
+	return err
+}
+
+func (rw *redactingWriter) writeRedacted(bytes []byte) error {
+	if len(bytes) == 0 {
+		return nil
+	}
+	redactor.mutex.RLock()
+	redacted := redactor.redact(string(bytes))
+	redactor.mutex.RUnlock()
+	_, err := io.WriteString(rw.writer, redacted)
+	return err
+}
+
+// Routes all log output through the secret redactor. Anything using log.Writer() (e.g. script output) is also covered.
+func InitLogging() {
+	if _, alreadyRedacting := log.Writer().(*redactingWriter); !alreadyRedacting {
+		log.SetOutput(&redactingWriter{writer: log.Writer()})
+	}
+}
+
+// Writes out any partial line of output held by the redactor, e.g. after a script that did not end with a newline
+func FlushLog() {
+	if writer, isRedacting := log.Writer().(*redactingWriter); isRedacting {
+		writer.Flush()
+	}
+}
+
+// Marks an env var name as a secret. Any value it currently has in the environment is also masked in output.
+func AddSecretEnvVarName(name string) {
+	redactor.mutex.Lock()
+	defer redactor.mutex.Unlock()
+	redactor.secretNames = AddToSliceIfUnique(redactor.secretNames, strings.ToUpper(name))
+	if value := os.Getenv(name); value != "" {
+		redactor.addValue(value)
+	}
+}
+
+// Marks a value as a secret so it is masked wherever it appears in output
+func AddSecretValue(value string) {
+	redactor.mutex.Lock()
+	defer redactor.mutex.Unlock()
+	redactor.addValue(value)
+}
+
+// Registers the env vars for any feature options declared with "secret": true
+func AddFeatureSecrets(features []FeatureConfig) {
+	for _, feature := range features {
+		for optionId, option := range feature.Options {
+			if option.Secret {
+				AddSecretEnvVarName(feature.OptionEnvVarName(OptionSelectionEnvVarPrefix, optionId))
+				AddSecretEnvVarName(feature.OptionEnvVarName(ProjectTomlOptionSelectionEnvVarPrefix, optionId))
+			}
+		}
+	}
+}
+
+func IsSecretEnvVarName(name string) bool {
+	redactor.mutex.RLock()
+	defer redactor.mutex.RUnlock()
+	return redactor.isSecret(name)
+}
+
+// Masks the value of a NAME=VALUE string if the name is a secret
+func RedactEnvVar(envVar string) string {
+	name, value := splitEnvVar(envVar)
+	if value != "" && IsSecretEnvVarName(name) {
+		return name + "=" + RedactedValue
+	}
+	return envVar
+}
+
+func RedactEnv(env []string) []string {
+	redacted := make([]string, 0, len(env))
+	for _, envVar := range env {
+		redacted = append(redacted, RedactEnvVar(envVar))
+	}
+	return redacted
+}
+
+// Removes env vars with secret names, e.g. before the environment is written to a file in an image layer
+func OmitSecretEnv(env []string) []string {
+	filtered := make([]string, 0, len(env))
+	for _, envVar := range env {
+		if name, _ := splitEnvVar(envVar); !IsSecretEnvVarName(name) {
+			filtered = append(filtered, envVar)
+		}
+	}
+	return filtered
+}
+
+// Masks secret values in CLI arguments like "-e NAME=VALUE", "--env NAME=VALUE" or "--env=NAME=VALUE". Env vars
+// with secret names are masked, and known secret values are masked wherever they appear.
+func RedactArgs(args []string) []string {
+	redacted := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case (arg == "-e" || arg == "--env") && i+1 < len(args):
+			redacted = append(redacted, arg, redactValues(RedactEnvVar(args[i+1])))
+			i++
+		case strings.HasPrefix(arg, "--env="):
+			redacted = append(redacted, "--env="+redactValues(RedactEnvVar(strings.TrimPrefix(arg, "--env="))))
+		default:
+			redacted = append(redacted, redactValues(arg))
+		}
+	}
+	return redacted
+}
+
+func redactValues(text string) string {
+	redactor.mutex.RLock()
+	defer redactor.mutex.RUnlock()
+	return redactor.redact(text)
+}
+
+func IsDebugLogging() bool {
+	return strings.EqualFold(os.Getenv(LogLevelEnvVarName), "debug")
+}
+
+func LogDebug(v ...interface{}) {
+	if IsDebugLogging() {
+		log.Println(append([]interface{}{"[debug]"}, v...)...)
+	}
+}
+
+// Outputs a sorted, redacted listing of the environment when debug logging is enabled
+func LogDebugEnvironment(env []string) {
+	if !IsDebugLogging() {
+		return
+	}
+	sorted := RedactEnv(env)
+	sort.Strings(sorted)
+	LogDebug("Environment:")
+	for _, envVar := range sorted {
+		LogDebug("  " + envVar)
+	}
+}
+
+func splitEnvVar(envVar string) (string, string) {
+	if index := strings.Index(envVar, "="); index > -1 {
+		return envVar[:index], envVar[index+1:]
+	}
+	return envVar, ""
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRedactingWriterMasksSecretsSplitAcrossWrites(t *testing.T) {
+	AddSecretValue("split-secret-value")
+	var output bytes.Buffer
+	writer := &redactingWriter{writer: &output}
+	for _, chunk := range []string{"token: split-se", "cret-value done\npartial split-secret", "-value"} {
+		writer.Write([]byte(chunk))
+	}
+	if got := output.String(); got != "token: "+RedactedValue+" done\n" {
+		t.Errorf("Unexpected output before flush: %q", got)
+	}
+	writer.Flush()
+	if got := output.String(); got != "token: "+RedactedValue+" done\npartial "+RedactedValue {
+		t.Errorf("Unexpected output after flush: %q", got)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	AddSecretValue("arg-secret-value")
+	AddSecretEnvVarName("MY_SECRET_OPTION")
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"-e", "MY_SECRET_OPTION=abc"}, []string{"-e", "MY_SECRET_OPTION=" + RedactedValue}},
+		{[]string{"--env", "OTHER=arg-secret-value"}, []string{"--env", "OTHER=" + RedactedValue}},
+		{[]string{"--env=OTHER=xarg-secret-valuex"}, []string{"--env=OTHER=x" + RedactedValue + "x"}},
+		{[]string{"--token", "arg-secret-value"}, []string{"--token", RedactedValue}},
+		{[]string{"-e", "PLAIN=value"}, []string{"-e", "PLAIN=value"}},
+	}
+	for _, test := range tests {
+		if got := RedactArgs(test.args); strings.Join(got, " ") != strings.Join(test.expected, " ") {
+			t.Errorf("RedactArgs(%v) = %v, expected %v", test.args, got, test.expected)
+		}
+	}
+}
+
+func TestOmitSecretEnv(t *testing.T) {
+	AddSecretEnvVarName("_BUILD_ARG_FEATURE_PASSPHRASE")
+	env := OmitSecretEnv([]string{"PATH=/usr/bin", "GITHUB_TOKEN=abc", "_BUILD_ARG_FEATURE_PASSPHRASE=def", "_BUILD_ARG_FEATURE_VERSION=1"})
+	if strings.Join(env, " ") != "PATH=/usr/bin _BUILD_ARG_FEATURE_VERSION=1" {
+		t.Errorf("Unexpected env: %v", env)
+	}
+}
@@ -0,0 +1,154 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// A mount in either the "source=...,target=...,type=..." string form or object form used by devcontainer.json
+type FeatureMount struct {
+	Source      string `json:"source,omitempty" toml:"source,omitempty"`
+	Target      string `json:"target,omitempty" toml:"target,omitempty"`
+	Type        string `json:"type,omitempty" toml:"type,omitempty"`
+	ReadOnly    bool   `json:"readonly,omitempty" toml:"readonly,omitempty"`
+	Consistency string `json:"consistency,omitempty" toml:"consistency,omitempty"`
+	// Other "--mount" properties like bind-propagation or volume-opt, passed through as-is. A value of "" is
+	// output as just the key.
+	Extra map[string]string `json:"extra,omitempty" toml:"extra,omitempty"`
+
+	// UnmarshalJSON(data []byte) error
+	// MarshalJSON() ([]byte, error)
+	// String() string
+	// SubstituteVariables(variables map[string]string) FeatureMount
+}
+
+// Parses the "--mount" string form. Supports the same aliases as the docker CLI (src, dst, destination, ro). Other
+// properties are kept in Extra.
+func ParseMount(mountString string) (FeatureMount, error) {
+	mount := FeatureMount{}
+	for _, property := range strings.Split(mountString, ",") {
+		property = strings.TrimSpace(property)
+		if property == "" {
+			continue
+		}
+		key, value := property, ""
+		if index := strings.Index(property, "="); index > -1 {
+			key, value = property[:index], property[index+1:]
+		}
+		switch strings.ToLower(key) {
+		case "source", "src":
+			mount.Source = value
+		case "target", "dst", "destination":
+			mount.Target = value
+		case "type":
+			mount.Type = value
+		case "readonly", "ro":
+			mount.ReadOnly = value == "" || value == "true" || value == "1"
+		case "consistency":
+			mount.Consistency = value
+		default:
+			if mount.Extra == nil {
+				mount.Extra = make(map[string]string)
+			}
+			mount.Extra[strings.ToLower(key)] = value
+		}
+	}
+	if mount.Target == "" {
+		return mount, errors.New("Mount is missing a target: " + mountString)
+	}
+	return mount, nil
+}
+
+// Accepts either the string or object form of a mount
+func (mount *FeatureMount) UnmarshalJSON(data []byte) error {
+	var mountString string
+	if err := json.Unmarshal(data, &mountString); err == nil {
+		parsedMount, err := ParseMount(mountString)
+		if err != nil {
+			return err
+		}
+		*mount = parsedMount
+		return nil
+	}
+	// Use an alias type to avoid recursing back into this function
+	type mountObject FeatureMount
+	var object mountObject
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	*mount = FeatureMount(object)
+	return nil
+}
+
+// Uses the object form unless the mount has Extra properties, which the devcontainer.json object form does not support
+func (mount FeatureMount) MarshalJSON() ([]byte, error) {
+	if len(mount.Extra) > 0 {
+		return json.Marshal(mount.String())
+	}
+	type mountObject FeatureMount
+	return json.Marshal(mountObject(mount))
+}
+
+// Returns the "--mount" string form of the mount
+func (mount FeatureMount) String() string {
+	properties := []string{}
+	if mount.Source != "" {
+		properties = append(properties, "source="+mount.Source)
+	}
+	properties = append(properties, "target="+mount.Target)
+	if mount.Type != "" {
+		properties = append(properties, "type="+mount.Type)
+	}
+	if mount.ReadOnly {
+		properties = append(properties, "readonly")
+	}
+	if mount.Consistency != "" {
+		properties = append(properties, "consistency="+mount.Consistency)
+	}
+	extraKeys := make([]string, 0, len(mount.Extra))
+	for key := range mount.Extra {
+		extraKeys = append(extraKeys, key)
+	}
+	sort.Strings(extraKeys)
+	for _, key := range extraKeys {
+		if value := mount.Extra[key]; value != "" {
+			properties = append(properties, key+"="+value)
+		} else {
+			properties = append(properties, key)
+		}
+	}
+	return strings.Join(properties, ",")
+}
+
+// Replaces ${name} references to the specified variables in the source and target. Any other
+// variables (e.g. ${localEnv:HOME}) are left as-is for the dev container tool to resolve.
+func (mount FeatureMount) SubstituteVariables(variables map[string]string) FeatureMount {
+	for name, value := range variables {
+		mount.Source = strings.ReplaceAll(mount.Source, "${"+name+"}", value)
+		mount.Target = strings.ReplaceAll(mount.Target, "${"+name+"}", value)
+	}
+	return mount
+}
+
+// Adds mounts to a list unless a mount with the same target is already in it. Returns the updated
+// list and any mounts that were skipped due to a conflicting target.
+func AddMountsIfUniqueTarget(mounts []FeatureMount, newMounts ...FeatureMount) ([]FeatureMount, []FeatureMount) {
+	skipped := []FeatureMount{}
+	for _, newMount := range newMounts {
+		isUnique := true
+		for _, mount := range mounts {
+			if mount.Target == newMount.Target {
+				isUnique = false
+				break
+			}
+		}
+		if isUnique {
+			mounts = append(mounts, newMount)
+		} else {
+			skipped = append(skipped, newMount)
+		}
+	}
+	return mounts, skipped
+}
@@ -0,0 +1,198 @@
+package common
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseMount(t *testing.T) {
+	tests := []struct {
+		name        string
+		mountString string
+		expected    FeatureMount
+		expectError bool
+	}{
+		{
+			name:        "full names",
+			mountString: "source=vol,target=/data,type=volume",
+			expected:    FeatureMount{Source: "vol", Target: "/data", Type: "volume"},
+		},
+		{
+			name:        "docker CLI aliases",
+			mountString: "src=/host, dst=/container ,type=bind,ro",
+			expected:    FeatureMount{Source: "/host", Target: "/container", Type: "bind", ReadOnly: true},
+		},
+		{
+			name:        "destination alias and readonly value",
+			mountString: "destination=/container,readonly=false,consistency=cached",
+			expected:    FeatureMount{Target: "/container", Consistency: "cached"},
+		},
+		{
+			name:        "extra properties are kept",
+			mountString: "type=volume,source=vol,target=/data,volume-nocopy,volume-opt=o=size=1g,Bind-Propagation=rslave",
+			expected: FeatureMount{Source: "vol", Target: "/data", Type: "volume",
+				Extra: map[string]string{"volume-nocopy": "", "volume-opt": "o=size=1g", "bind-propagation": "rslave"}},
+		},
+		{
+			name:        "tmpfs options",
+			mountString: "type=tmpfs,target=/tmp/cache,tmpfs-size=64m,tmpfs-mode=1770",
+			expected:    FeatureMount{Target: "/tmp/cache", Type: "tmpfs", Extra: map[string]string{"tmpfs-size": "64m", "tmpfs-mode": "1770"}},
+		},
+		{
+			name:        "missing target",
+			mountString: "source=vol,type=volume",
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mount, err := ParseMount(test.mountString)
+			if test.expectError {
+				if err == nil {
+					t.Fatalf("Expected an error, got %+v", mount)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(mount, test.expected) {
+				t.Errorf("Got %+v, expected %+v", mount, test.expected)
+			}
+		})
+	}
+}
+
+func TestMountString(t *testing.T) {
+	tests := []struct {
+		mount    FeatureMount
+		expected string
+	}{
+		{FeatureMount{Target: "/data"}, "target=/data"},
+		{FeatureMount{Source: "vol", Target: "/data", Type: "volume", ReadOnly: true, Consistency: "cached"}, "source=vol,target=/data,type=volume,readonly,consistency=cached"},
+		{FeatureMount{Source: "vol", Target: "/data", Type: "volume", Extra: map[string]string{"volume-opt": "o=bind", "volume-nocopy": ""}}, "source=vol,target=/data,type=volume,volume-nocopy,volume-opt=o=bind"},
+	}
+	for _, test := range tests {
+		if got := test.mount.String(); got != test.expected {
+			t.Errorf("Got %q, expected %q", got, test.expected)
+		}
+		// The string form should parse back to the same mount
+		parsed, err := ParseMount(test.mount.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parsed, test.mount) {
+			t.Errorf("Round trip of %q got %+v, expected %+v", test.expected, parsed, test.mount)
+		}
+	}
+}
+
+func TestMountJson(t *testing.T) {
+	tests := []struct {
+		name     string
+		json     string
+		expected FeatureMount
+		marshal  string
+	}{
+		{
+			name:     "string form",
+			json:     `"source=vol,target=/data,type=volume"`,
+			expected: FeatureMount{Source: "vol", Target: "/data", Type: "volume"},
+			marshal:  `{"source":"vol","target":"/data","type":"volume"}`,
+		},
+		{
+			name:     "object form",
+			json:     `{"source":"/host","target":"/container","type":"bind","readonly":true}`,
+			expected: FeatureMount{Source: "/host", Target: "/container", Type: "bind", ReadOnly: true},
+			marshal:  `{"source":"/host","target":"/container","type":"bind","readonly":true}`,
+		},
+		{
+			name:     "extra properties marshal to the string form",
+			json:     `"target=/data,type=volume,volume-nocopy"`,
+			expected: FeatureMount{Target: "/data", Type: "volume", Extra: map[string]string{"volume-nocopy": ""}},
+			marshal:  `"target=/data,type=volume,volume-nocopy"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mount FeatureMount
+			if err := json.Unmarshal([]byte(test.json), &mount); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(mount, test.expected) {
+				t.Errorf("Got %+v, expected %+v", mount, test.expected)
+			}
+			marshalled, err := json.Marshal(mount)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(marshalled) != test.marshal {
+				t.Errorf("Marshalled to %s, expected %s", marshalled, test.marshal)
+			}
+		})
+	}
+}
+
+func TestMountSubstituteVariables(t *testing.T) {
+	variables := map[string]string{"containerEnv:CACHE": "/cache", "featureId": "python"}
+	tests := []struct {
+		mount    FeatureMount
+		expected FeatureMount
+	}{
+		{
+			mount:    FeatureMount{Source: "${featureId}-cache", Target: "${containerEnv:CACHE}/pip", Type: "volume"},
+			expected: FeatureMount{Source: "python-cache", Target: "/cache/pip", Type: "volume"},
+		},
+		{
+			mount:    FeatureMount{Source: "${localEnv:HOME}/.ssh", Target: "/home/${containerEnv:USER}/.ssh", Type: "bind"},
+			expected: FeatureMount{Source: "${localEnv:HOME}/.ssh", Target: "/home/${containerEnv:USER}/.ssh", Type: "bind"},
+		},
+	}
+	for _, test := range tests {
+		if got := test.mount.SubstituteVariables(variables); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Got %+v, expected %+v", got, test.expected)
+		}
+	}
+}
+
+func TestAddMountsIfUniqueTarget(t *testing.T) {
+	tests := []struct {
+		name            string
+		mounts          []FeatureMount
+		newMounts       []FeatureMount
+		expectedMounts  []FeatureMount
+		expectedSkipped []FeatureMount
+	}{
+		{
+			name:            "adds to empty list",
+			newMounts:       []FeatureMount{{Source: "a", Target: "/a"}},
+			expectedMounts:  []FeatureMount{{Source: "a", Target: "/a"}},
+			expectedSkipped: []FeatureMount{},
+		},
+		{
+			name:            "existing target wins",
+			mounts:          []FeatureMount{{Source: "user", Target: "/a"}},
+			newMounts:       []FeatureMount{{Source: "feature", Target: "/a"}, {Source: "b", Target: "/b"}},
+			expectedMounts:  []FeatureMount{{Source: "user", Target: "/a"}, {Source: "b", Target: "/b"}},
+			expectedSkipped: []FeatureMount{{Source: "feature", Target: "/a"}},
+		},
+		{
+			name:            "duplicates within new mounts",
+			newMounts:       []FeatureMount{{Source: "first", Target: "/a"}, {Source: "second", Target: "/a"}},
+			expectedMounts:  []FeatureMount{{Source: "first", Target: "/a"}},
+			expectedSkipped: []FeatureMount{{Source: "second", Target: "/a"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mounts, skipped := AddMountsIfUniqueTarget(test.mounts, test.newMounts...)
+			if !reflect.DeepEqual(mounts, test.expectedMounts) {
+				t.Errorf("Got mounts %+v, expected %+v", mounts, test.expectedMounts)
+			}
+			if !reflect.DeepEqual(skipped, test.expectedSkipped) {
+				t.Errorf("Got skipped %+v, expected %+v", skipped, test.expectedSkipped)
+			}
+		})
+	}
+}
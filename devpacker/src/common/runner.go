@@ -0,0 +1,52 @@
+package common
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// Runs external commands. Lets callers swap in a fake implementation (e.g. a fake CLI in tests).
+type CommandRunner interface {
+	// Runs a command with output going to the log
+	Run(workingDir string, name string, args ...string) error
+	// Runs a command and returns what it wrote to stdout
+	Output(workingDir string, name string, args ...string) ([]byte, error)
+}
+
+// CommandRunner that executes commands using os/exec
+type ExecRunner struct{}
+
+func (runner ExecRunner) Run(workingDir string, name string, args ...string) error {
+	log.Println("Running:", name, RedactArgs(args))
+	command := exec.Command(name, args...)
+	command.Env = os.Environ()
+	writer := log.Writer()
+	command.Stdout = writer
+	command.Stderr = writer
+	command.Dir = workingDir
+	err := command.Run()
+	FlushLog()
+	return toNonZeroExitError(err, "")
+}
+
+// Anything written to stderr is only included in the error if the command fails, so warnings do not cause failures
+func (runner ExecRunner) Output(workingDir string, name string, args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	command := exec.Command(name, args...)
+	command.Env = os.Environ()
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+	command.Dir = workingDir
+	err := toNonZeroExitError(command.Run(), stderr.String())
+	return stdout.Bytes(), err
+}
+
+func toNonZeroExitError(err error, stderr string) error {
+	if exitErr, isExitErr := err.(*exec.ExitError); isExitErr {
+		return NonZeroExitError{ExitCode: exitErr.ExitCode(), Stderr: stderr}
+	}
+	return err
+}
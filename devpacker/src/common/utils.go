@@ -1,7 +1,6 @@
 package common
 
 import (
-	"bytes"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -9,49 +8,24 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
 
 	"gonum.org/v1/gonum/stat/combin"
 )
 
 type NonZeroExitError struct {
 	ExitCode int
+	Stderr   string
 }
 
 func (err NonZeroExitError) Error() string {
-	return "Non-zero exit code: " + strconv.FormatInt(int64(err.ExitCode), 10)
-}
-
-func PropertyMapToInterface(propertyMap map[string]interface{}, typ reflect.Type) interface{} {
-	objValue := reflect.New(typ)
-	objValueElem := objValue.Elem()
-	for key, value := range propertyMap {
-		field := objValueElem.FieldByName(key)
-		SetFieldValue(field, value)
-	}
-	return objValue.Interface()
-}
-
-func SetFieldValue(field reflect.Value, value interface{}) {
-	reflectValue := reflect.ValueOf(value)
-	reflectValueType := reflectValue.Type().Kind().String()
-	switch reflectValueType {
-	case "slice":
-		convertedSliceValue := reflect.MakeSlice(field.Type(), 0, reflectValue.Len())
-		for _, sliceItem := range value.([]interface{}) {
-			convertedSliceValue = reflect.Append(convertedSliceValue, reflect.ValueOf(sliceItem))
-		}
-		field.Set(convertedSliceValue)
-	case "map":
-		convertedMapValue := reflect.MakeMap(field.Type())
-		for key, value := range value.(map[string]interface{}) {
-			convertedMapValue.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(value))
-		}
-		field.Set(convertedMapValue)
-	default:
-		field.Set(reflectValue.Convert(field.Type()))
+	message := "Non-zero exit code: " + strconv.FormatInt(int64(err.ExitCode), 10)
+	if err.Stderr != "" {
+		message += ". " + strings.TrimSpace(err.Stderr)
 	}
+	return message
 }
 
 func CpR(sourcePath string, targetFolderPath string) {
@@ -158,6 +132,114 @@ func SliceUnion(slice1 []string, slice2 []string) []string {
 	return union
 }
 
+// Splits a comma separated list like those used in env vars, dropping empty items
+func SplitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Matches a "/" separated relative path against a glob pattern using the filepath.Match syntax: "*" matches any
+// characters other than "/", "?" matches one, "[a-z]" and "[^a-z]" match a character class, and "\\" escapes the
+// next character. In addition, "**" matches any number of path segments. e.g. ".devcontainer/**" or "**/*.lock".
+// Patterns are anchored, so they need to match the whole path.
+func MatchesGlob(pattern string, relativePath string) bool {
+	var expression strings.Builder
+	expression.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		char := pattern[i]
+		switch char {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					expression.WriteString("(?:.*/)?")
+				} else {
+					expression.WriteString(".*")
+				}
+			} else {
+				expression.WriteString("[^/]*")
+			}
+		case '?':
+			expression.WriteString("[^/]")
+		case '[':
+			classLength := globClassLength(pattern[i:])
+			if classLength < 0 {
+				log.Fatal("Invalid glob pattern ", pattern, ": missing ]")
+			}
+			expression.WriteString(globClassExpression(pattern[i+1 : i+classLength-1]))
+			i += classLength - 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				char = pattern[i]
+			}
+			expression.WriteString(regexp.QuoteMeta(string(char)))
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	expression.WriteString("$")
+	matched, err := regexp.MatchString(expression.String(), filepath.ToSlash(relativePath))
+	if err != nil {
+		log.Fatal("Invalid glob pattern ", pattern, ": ", err)
+	}
+	return matched
+}
+
+// Returns the length of the character class at the start of pattern including the brackets, or -1 if it is not closed
+func globClassLength(pattern string) int {
+	i := 1
+	if i < len(pattern) && pattern[i] == '^' {
+		i++
+	}
+	for ; i < len(pattern); i++ {
+		if pattern[i] == '\\' {
+			i++
+		} else if pattern[i] == ']' {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// Converts the inside of a character class to a regular expression class
+func globClassExpression(class string) string {
+	var expression strings.Builder
+	expression.WriteString("[")
+	if strings.HasPrefix(class, "^") {
+		expression.WriteString("^")
+		class = class[1:]
+	}
+	for i := 0; i < len(class); i++ {
+		char := class[i]
+		if char == '\\' && i+1 < len(class) {
+			i++
+			char = class[i]
+		} else if char == '-' && i > 0 && i+1 < len(class) {
+			expression.WriteString("-")
+			continue
+		}
+		expression.WriteString(regexp.QuoteMeta(string(char)))
+	}
+	expression.WriteString("]")
+	return expression.String()
+}
+
+func MatchesAnyGlob(patterns []string, relativePath string) bool {
+	for _, pattern := range patterns {
+		if MatchesGlob(pattern, relativePath) {
+			return true
+		}
+	}
+	return false
+}
+
 func ToJsonRawMessage(value interface{}) json.RawMessage {
 	var err error
 	var bytes json.RawMessage
@@ -167,26 +249,7 @@ func ToJsonRawMessage(value interface{}) json.RawMessage {
 	return bytes
 }
 
-func DockerCli(workingDir string, captureOutput bool, args ...string) []byte {
-	var outputBytes bytes.Buffer
-	var errorOutput bytes.Buffer
-
-	dockerCommand := exec.Command("docker", args...)
-	dockerCommand.Env = os.Environ()
-	if captureOutput {
-		dockerCommand.Stdout = &outputBytes
-		dockerCommand.Stderr = &errorOutput
-	} else {
-		writer := log.Writer()
-		dockerCommand.Stdout = writer
-		dockerCommand.Stderr = writer
-	}
-	if workingDir != "" {
-		dockerCommand.Dir = workingDir
-	}
-	commandErr := dockerCommand.Run()
-	if commandErr != nil || dockerCommand.ProcessState.ExitCode() != 0 || errorOutput.Len() != 0 {
-		log.Fatal("Docker command failed: " + errorOutput.String() + commandErr.Error())
-	}
-	return outputBytes.Bytes()
+func IsInPath(command string) bool {
+	_, err := exec.LookPath(command)
+	return err == nil
 }
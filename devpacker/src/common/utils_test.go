@@ -0,0 +1,62 @@
+package common
+
+import "testing"
+
+func TestMatchesGlob(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		path     string
+		expected bool
+	}{
+		// "*" and "?" stay within a path segment
+		{"*.lock", "yarn.lock", true},
+		{"*.lock", "sub/yarn.lock", false},
+		{"src/*", "src/main.go", true},
+		{"src/*", "src/pkg/main.go", false},
+		{"file?.txt", "file1.txt", true},
+		{"file?.txt", "file12.txt", false},
+		{"a?b", "a/b", false},
+		// "**" matches any number of segments, including none
+		{"**/*.lock", "yarn.lock", true},
+		{"**/*.lock", "a/b/yarn.lock", true},
+		{".devcontainer/**", ".devcontainer/devcontainer.json", true},
+		{".devcontainer/**", ".devcontainer/scripts/setup.sh", true},
+		{".devcontainer/**", "src/.devcontainer/devcontainer.json", false},
+		{"src/**/test", "src/test", true},
+		{"src/**/test", "src/a/b/test", true},
+		{"node_modules**", "node_modules/a/index.js", true},
+		// Patterns are anchored at both ends
+		{"build", "build", true},
+		{"build", "src/build", false},
+		{"build", "build/output", false},
+		{"build", "rebuild", false},
+		// Character classes and escapes
+		{"file[0-9].txt", "file7.txt", true},
+		{"file[0-9].txt", "filex.txt", false},
+		{"file[^0-9].txt", "filex.txt", true},
+		{"file[^0-9].txt", "file7.txt", false},
+		{"[abc]*.go", "b_test.go", true},
+		{"[a-]", "-", true},
+		{"file[\\]].txt", "file].txt", true},
+		{"\\*.txt", "*.txt", true},
+		{"\\*.txt", "a.txt", false},
+		// Regular expression characters are literal
+		{"a.b", "axb", false},
+		{"(a)+", "(a)+", true},
+	}
+	for _, test := range tests {
+		if matched := MatchesGlob(test.pattern, test.path); matched != test.expected {
+			t.Errorf("MatchesGlob(%q, %q) = %v, expected %v", test.pattern, test.path, matched, test.expected)
+		}
+	}
+}
+
+func TestMatchesAnyGlob(t *testing.T) {
+	patterns := []string{"*.md", "docs/**"}
+	if !MatchesAnyGlob(patterns, "docs/guide/index.html") || !MatchesAnyGlob(patterns, "README.md") {
+		t.Errorf("Expected a match for any of %v", patterns)
+	}
+	if MatchesAnyGlob(patterns, "src/main.go") || MatchesAnyGlob(nil, "README.md") {
+		t.Errorf("Expected no match")
+	}
+}
@@ -90,7 +90,7 @@ for feature in ${post_procesing_array[@]}; do
             if [ -f "${entrypoint}" ]; then
                 echo "- Wiring up entrypoint ${entrypoint}..."
                 chmod +x "${entrypoint}"
-                ln -s "${entrypoint}" "${COMMON_ENTRYPOINT_D}/layer-${buildpack_folder_name}-${feature_id}-$(basename "${entrypoint}")"
+                ln -sf "${entrypoint}" "${COMMON_ENTRYPOINT_D}/layer-${buildpack_folder_name}-${feature_id}-$(basename "${entrypoint}")"
             fi
         done
     fi
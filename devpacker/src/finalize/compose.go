@@ -0,0 +1,243 @@
+package finalize
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+// Override file written next to devcontainer.json for Docker Compose based dev containers
+const DockerComposeOverrideFile = "docker-compose.devpack.yml"
+
+func isDockerComposeConfig(devContainerJsonMap map[string]json.RawMessage) bool {
+	return devContainerJsonMap["dockerComposeFile"] != nil
+}
+
+// Writes a Docker Compose override that uses the finalized image for the service in devcontainer.json and adds
+// it to dockerComposeFile. In merge output mode, the override also has the compose equivalents of feature runArgs,
+// mounts, and containerEnv since tools ignore runArgs and mounts in devcontainer.json when using Docker Compose.
+func addDockerComposeOverride(postProcessingConfig PostProcessingConfig, devContainerJsonMap map[string]json.RawMessage, targetFolder string) map[string]json.RawMessage {
+	var service string
+	if devContainerJsonMap["service"] != nil {
+		if err := json.Unmarshal(devContainerJsonMap["service"], &service); err != nil {
+			log.Fatal("Failed to unmarshal service from devcontainer.json: ", err)
+		}
+	}
+	if service == "" {
+		log.Fatal("devcontainer.json uses dockerComposeFile, but does not specify a service.")
+	}
+
+	var featureConfig common.FeatureConfig
+	if postProcessingConfig.Options.OutputMode != OutputModeFeature {
+		featureConfig = generateFinalizeFeatureConfig(postProcessingConfig, newSettingsMerger(postProcessingConfig.Options.SettingsArrayMerge))
+		// Compose does not expand references to other variables like ${PATH}, so use the values in the finalized image
+		env := append([]string{}, postProcessingConfig.ImageConfig.Env...)
+		for _, featureId := range postProcessingConfig.LayerOrder {
+			containerEnv := postProcessingConfig.LayerFeatureMetadata[featureId].Config.ContainerEnv
+			for _, varName := range sortedKeys(containerEnv) {
+				env = setEnvVarValue(env, varName, expandEnvVars(containerEnv[varName], env))
+			}
+		}
+		for varName := range featureConfig.ContainerEnv {
+			featureConfig.ContainerEnv[varName] = envVarValue(env, varName)
+		}
+	}
+	overridePath := filepath.Join(targetFolder, DockerComposeOverrideFile)
+	log.Println("Writing out Docker Compose override file:", overridePath)
+	override, err := dockerComposeOverride(service, postProcessingConfig.Image, featureConfig)
+	if err != nil {
+		log.Fatal("Failed to generate Docker Compose override file: ", err)
+	}
+	if err := common.WriteFile(overridePath, []byte(override)); err != nil {
+		log.Fatal("Failed to write Docker Compose override file: ", err)
+	}
+
+	// dockerComposeFile can be a string or an array
+	var composeFiles []string
+	if err := json.Unmarshal(devContainerJsonMap["dockerComposeFile"], &composeFiles); err != nil {
+		var composeFile string
+		if err := json.Unmarshal(devContainerJsonMap["dockerComposeFile"], &composeFile); err != nil {
+			log.Fatal("Failed to unmarshal dockerComposeFile from devcontainer.json: ", err)
+		}
+		composeFiles = []string{composeFile}
+	}
+	devContainerJsonMap["dockerComposeFile"] = common.ToJsonRawMessage(common.AddToSliceIfUnique(composeFiles, DockerComposeOverrideFile))
+	return devContainerJsonMap
+}
+
+// Returns the contents of the override file. Strings are written JSON encoded, which is valid in YAML.
+func dockerComposeOverride(service string, image string, featureConfig common.FeatureConfig) (string, error) {
+	lines := []string{
+		"# Generated by devpacker. Uses the finalized image for the " + service + " service.",
+		"services:",
+		"  " + composeString(service) + ":",
+		"    image: " + composeString(image),
+	}
+	if featureConfig.Privileged {
+		lines = append(lines, "    privileged: true")
+	}
+	if featureConfig.Init {
+		lines = append(lines, "    init: true")
+	}
+	if len(featureConfig.CapAdd) > 0 {
+		lines = append(lines, "    cap_add:")
+		for _, capability := range featureConfig.CapAdd {
+			lines = append(lines, "      - "+composeString(capability))
+		}
+	}
+	if len(featureConfig.SecurityOpt) > 0 {
+		lines = append(lines, "    security_opt:")
+		for _, opt := range featureConfig.SecurityOpt {
+			lines = append(lines, "      - "+composeString(opt))
+		}
+	}
+	if len(featureConfig.ContainerEnv) > 0 {
+		lines = append(lines, "    environment:")
+		for _, varName := range sortedKeys(featureConfig.ContainerEnv) {
+			lines = append(lines, "      "+composeString(varName)+": "+composeString(featureConfig.ContainerEnv[varName]))
+		}
+	}
+
+	// Named volumes need to be declared at the top level, along with any driver options
+	namedVolumes := make(map[string][]string)
+	if len(featureConfig.Mounts) > 0 {
+		variables := make(map[string]string)
+		for varName, varValue := range featureConfig.ContainerEnv {
+			variables["containerEnv:"+varName] = varValue
+		}
+		lines = append(lines, "    volumes:")
+		for _, mount := range featureConfig.Mounts {
+			mount = mount.SubstituteVariables(variables)
+			if mount.Type == "" {
+				mount.Type = "volume"
+			}
+			lines = append(lines, "      - type: "+composeString(mount.Type))
+			if mount.Source != "" {
+				lines = append(lines, "        source: "+composeString(mount.Source))
+			}
+			lines = append(lines, "        target: "+composeString(mount.Target))
+			if mount.ReadOnly {
+				lines = append(lines, "        read_only: true")
+			}
+			if mount.Consistency != "" {
+				lines = append(lines, "        consistency: "+composeString(mount.Consistency))
+			}
+			mountOptions, volumeOptions, err := composeMountOptions(mount)
+			if err != nil {
+				return "", err
+			}
+			if len(mountOptions) > 0 {
+				lines = append(lines, "        "+mount.Type+":")
+				for _, option := range mountOptions {
+					lines = append(lines, "          "+option)
+				}
+			}
+			if mount.Type == "volume" && mount.Source != "" {
+				if existingOptions, declared := namedVolumes[mount.Source]; declared && !reflect.DeepEqual(existingOptions, volumeOptions) {
+					return "", errors.New("Mounts for volume " + mount.Source + " use different volume options")
+				}
+				namedVolumes[mount.Source] = volumeOptions
+			}
+		}
+	}
+	if len(namedVolumes) > 0 {
+		lines = append(lines, "volumes:")
+		for _, volume := range sortedSliceMapKeys(namedVolumes) {
+			if len(namedVolumes[volume]) == 0 {
+				lines = append(lines, "  "+composeString(volume)+": {}")
+				continue
+			}
+			lines = append(lines, "  "+composeString(volume)+":")
+			for _, option := range namedVolumes[volume] {
+				lines = append(lines, "    "+option)
+			}
+		}
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// Maps "--mount" properties in Extra to compose. Returns the lines for the mount's type specific options, and the
+// lines for the top level declaration of a named volume. Properties compose has no equivalent for are an error
+// rather than being dropped.
+func composeMountOptions(mount common.FeatureMount) ([]string, []string, error) {
+	var mountOptions []string
+	var driver string
+	driverOpts := make(map[string]string)
+	labels := make(map[string]string)
+	for _, key := range sortedKeys(mount.Extra) {
+		value := mount.Extra[key]
+		optionType := key
+		if index := strings.Index(key, "-"); index > -1 {
+			optionType = key[:index]
+		}
+		if optionType != mount.Type {
+			return nil, nil, errors.New("Mount option " + key + " is not supported for " + mount.Type + " mounts: " + mount.String())
+		}
+		switch key {
+		case "bind-propagation":
+			mountOptions = append(mountOptions, "propagation: "+composeString(value))
+		case "volume-nocopy":
+			if value == "" || value == "true" || value == "1" {
+				mountOptions = append(mountOptions, "nocopy: true")
+			}
+		case "volume-subpath":
+			mountOptions = append(mountOptions, "subpath: "+composeString(value))
+		case "tmpfs-size":
+			mountOptions = append(mountOptions, "size: "+composeString(value))
+		case "volume-driver":
+			driver = value
+		case "volume-opt", "volume-label":
+			index := strings.Index(value, "=")
+			if index < 0 {
+				return nil, nil, errors.New("Mount option " + key + " must be in the form name=value: " + mount.String())
+			}
+			if key == "volume-opt" {
+				driverOpts[value[:index]] = value[index+1:]
+			} else {
+				labels[value[:index]] = value[index+1:]
+			}
+		default:
+			return nil, nil, errors.New("Mount option " + key + " has no Docker Compose equivalent: " + mount.String())
+		}
+	}
+	if (driver != "" || len(driverOpts) > 0 || len(labels) > 0) && mount.Source == "" {
+		return nil, nil, errors.New("Volume options need a named volume: " + mount.String())
+	}
+	var volumeOptions []string
+	if driver != "" {
+		volumeOptions = append(volumeOptions, "driver: "+composeString(driver))
+	}
+	for _, section := range []struct {
+		name    string
+		options map[string]string
+	}{{"driver_opts", driverOpts}, {"labels", labels}} {
+		if len(section.options) == 0 {
+			continue
+		}
+		volumeOptions = append(volumeOptions, section.name+":")
+		for _, name := range sortedKeys(section.options) {
+			volumeOptions = append(volumeOptions, "  "+composeString(name)+": "+composeString(section.options[name]))
+		}
+	}
+	return mountOptions, volumeOptions, nil
+}
+
+func sortedSliceMapKeys(values map[string][]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Quotes a value for the override file. Docker Compose interpolates $ references, so they are escaped.
+func composeString(value string) string {
+	return string(common.ToJsonRawMessage(strings.ReplaceAll(value, "$", "$$")))
+}
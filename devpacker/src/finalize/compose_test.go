@@ -0,0 +1,110 @@
+package finalize
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+func TestDockerComposeOverride(t *testing.T) {
+	featureConfig := common.FeatureConfig{
+		Privileged:   true,
+		Init:         true,
+		CapAdd:       []string{"SYS_PTRACE"},
+		SecurityOpt:  []string{"seccomp=unconfined"},
+		ContainerEnv: map[string]string{"CACHE": "/cache", "PRICE": "$5"},
+	}
+	for _, mountString := range []string{
+		"source=node-cache,target=/home/cnb/.npm,type=volume",
+		"source=${localEnv:HOME}/.ssh,target=/home/cnb/.ssh,type=bind,readonly,consistency=cached,bind-propagation=rslave",
+		"source=data,target=${containerEnv:CACHE},volume-nocopy,volume-subpath=app,volume-driver=local,volume-opt=o=size=1g,volume-label=owner=devpacker",
+		"target=/tmp/scratch,type=tmpfs,tmpfs-size=64m",
+	} {
+		mount, err := common.ParseMount(mountString)
+		if err != nil {
+			t.Fatal(err)
+		}
+		featureConfig.Mounts = append(featureConfig.Mounts, mount)
+	}
+
+	override, err := dockerComposeOverride("app", "test_image:devpack", featureConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile(filepath.Join("testdata", DockerComposeOverrideFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if override != string(expected) {
+		t.Errorf("Got override file:\n%s\nexpected:\n%s", override, expected)
+	}
+}
+
+func TestDockerComposeOverrideImageOnly(t *testing.T) {
+	override, err := dockerComposeOverride("app", "test_image:devpack", common.FeatureConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# Generated by devpacker. Uses the finalized image for the app service.\nservices:\n  \"app\":\n    image: \"test_image:devpack\"\n"
+	if override != expected {
+		t.Errorf("Got override file:\n%s\nexpected:\n%s", override, expected)
+	}
+}
+
+func TestDockerComposeOverrideUnsupportedMounts(t *testing.T) {
+	for _, mountStrings := range [][]string{
+		{"source=data,target=/data,type=volume,volume-foo=bar"},
+		{"target=/tmp/scratch,type=tmpfs,tmpfs-mode=1770"},
+		{"source=/src,target=/src,type=bind,bind-nonrecursive"},
+		{"source=/src,target=/src,type=bind,volume-nocopy"},
+		{"target=/data,type=volume,volume-opt=o=size=1g"},
+		{"source=data,target=/data,type=volume,volume-opt=size"},
+		{"source=data,target=/data,volume-driver=local", "source=data,target=/other"},
+	} {
+		featureConfig := common.FeatureConfig{}
+		for _, mountString := range mountStrings {
+			mount, err := common.ParseMount(mountString)
+			if err != nil {
+				t.Fatal(err)
+			}
+			featureConfig.Mounts = append(featureConfig.Mounts, mount)
+		}
+		if override, err := dockerComposeOverride("app", "test_image:devpack", featureConfig); err == nil {
+			t.Errorf("Expected an error for %v, got:\n%s", mountStrings, override)
+		}
+	}
+}
+
+func TestAddUserPropertiesDockerCompose(t *testing.T) {
+	engine, imageInspect := loadTestImageInspect(t)
+	postProcessingConfig := newPostProcessingConfig(testImage, imageInspect, "", FinalizeOptions{Engine: engine})
+	tests := []struct {
+		name                string
+		devContainerJsonMap map[string]json.RawMessage
+		expectContainerUser bool
+	}{
+		{
+			name:                "image",
+			devContainerJsonMap: map[string]json.RawMessage{"image": json.RawMessage(`"test_image"`)},
+			expectContainerUser: true,
+		},
+		{
+			name:                "docker compose",
+			devContainerJsonMap: map[string]json.RawMessage{"dockerComposeFile": json.RawMessage(`"docker-compose.yml"`), "service": json.RawMessage(`"app"`)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			devContainerJsonMap := addUserProperties(postProcessingConfig, test.devContainerJsonMap)
+			if string(devContainerJsonMap["remoteUser"]) != `"cnb"` {
+				t.Errorf("Got remoteUser %s, expected cnb", devContainerJsonMap["remoteUser"])
+			}
+			if _, hasContainerUser := devContainerJsonMap["containerUser"]; hasContainerUser != test.expectContainerUser {
+				t.Errorf("Got containerUser %s", devContainerJsonMap["containerUser"])
+			}
+		})
+	}
+}
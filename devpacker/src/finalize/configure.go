@@ -0,0 +1,163 @@
+package finalize
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// Sources the feature's env file and executes its configure script, like post-processing.sh
+const configureCommand = `set -e; set -a; . "$1"; set +a; chmod +x "$2"; "$2"`
+
+// Repository the image is loaded into the container engine as while configure scripts run
+const configureImageRepository = "devpacker-configure"
+
+// Runs feature configure scripts as root in a container using the container engine, and returns the layers with
+// whatever they changed. The image is loaded into the engine and built on with one RUN per feature, so the scripts
+// are isolated the same way as in a daemon based finalize. There is no fallback without an engine.
+func runConfigureScripts(postProcessingConfig PostProcessingConfig, image v1.Image, featurePathsToConfigure []featureLayerPaths) ([]v1.Layer, error) {
+	var configureScripts []string
+	for _, featurePaths := range featurePathsToConfigure {
+		configureScripts = append(configureScripts, featurePaths.ConfigureScriptPath())
+	}
+	engine := postProcessingConfig.Options.Engine
+	if engine == nil {
+		var err error
+		if engine, err = common.NewContainerEngine(postProcessingConfig.Options.EngineName, postProcessingConfig.Options.DockerHost, postProcessingConfig.Options.Runner); err != nil {
+			return nil, errors.New("Feature configure scripts need to run in a container, but no container engine is available (" + err.Error() + "). Configure scripts: " + strings.Join(configureScripts, ", "))
+		}
+	}
+
+	tempDir, err := ioutil.TempDir("", "devpacker-configure-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+	suffix := strconv.FormatInt(rand.Int63(), 36)
+	baseTag, err := name.NewTag(configureImageRepository + ":base-" + suffix)
+	if err != nil {
+		return nil, err
+	}
+	configuredTag := configureImageRepository + ":" + suffix
+
+	// Load the image into the engine
+	baseTarballPath := filepath.Join(tempDir, "base.tar")
+	if err := tarball.WriteToFile(baseTarballPath, baseTag, image); err != nil {
+		return nil, err
+	}
+	if err := engine.ImageLoad(baseTarballPath); err != nil {
+		return nil, errors.New("Failed to load the image into " + engine.Name() + " to run configure scripts: " + err.Error())
+	}
+	defer removeConfigureImage(engine, baseTag.String())
+	os.Remove(baseTarballPath)
+
+	// Build on it with the configure scripts
+	dockerfile, err := configureDockerfile(baseTag.String(), featurePathsToConfigure)
+	if err != nil {
+		return nil, err
+	}
+	if err := common.WriteFile(filepath.Join(tempDir, "Dockerfile"), []byte(dockerfile)); err != nil {
+		return nil, err
+	}
+	for _, configureScript := range configureScripts {
+		log.Println("- Executing", configureScript+"...")
+	}
+	if err := engine.ImageBuild(common.ImageBuildOptions{ContextDir: tempDir, Dockerfile: "Dockerfile", Tag: configuredTag, NoCache: true}); err != nil {
+		return nil, errors.New("Failed to run configure scripts: " + err.Error())
+	}
+	defer removeConfigureImage(engine, configuredTag)
+
+	// Get the layers the build added
+	configuredTarballPath := filepath.Join(tempDir, "configured.tar")
+	if err := engine.ImageSave(configuredTag, configuredTarballPath); err != nil {
+		return nil, errors.New("Failed to save the result of running configure scripts: " + err.Error())
+	}
+	return addedLayers(image, configuredTarballPath, len(featurePathsToConfigure))
+}
+
+// Returns a Dockerfile that runs each configure script as root on top of the image
+func configureDockerfile(baseImage string, featurePathsToConfigure []featureLayerPaths) (string, error) {
+	lines := []string{"FROM " + baseImage, "USER root"}
+	for _, featurePaths := range featurePathsToConfigure {
+		// The exec form is JSON, and keeps the paths out of the shell command
+		runArgs, err := json.Marshal([]string{"/bin/bash", "-c", configureCommand, "configure", featurePaths.EnvFilePath(), featurePaths.ConfigureScriptPath()})
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, "RUN "+string(runArgs))
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// Returns the layers in a saved image that are not in the original image. The layers are read into memory so the
+// tarball can be removed.
+func addedLayers(image v1.Image, tarballPath string, expectedCount int) ([]v1.Layer, error) {
+	originalLayers, err := image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	configuredImage, err := tarball.ImageFromPath(tarballPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	configuredLayers, err := configuredImage.Layers()
+	if err != nil {
+		return nil, err
+	}
+	if len(configuredLayers) != len(originalLayers)+expectedCount {
+		return nil, errors.New("Expected running configure scripts to add " + strconv.Itoa(expectedCount) + " layers, but the image has " + strconv.Itoa(len(configuredLayers)) + " layers rather than " + strconv.Itoa(len(originalLayers)+expectedCount))
+	}
+	for index, originalLayer := range originalLayers {
+		originalDiffId, err := originalLayer.DiffID()
+		if err != nil {
+			return nil, err
+		}
+		configuredDiffId, err := configuredLayers[index].DiffID()
+		if err != nil {
+			return nil, err
+		}
+		if originalDiffId != configuredDiffId {
+			return nil, errors.New("Layer " + configuredDiffId.String() + " in the image from running configure scripts does not match " + originalDiffId.String() + " in the original image")
+		}
+	}
+
+	var layers []v1.Layer
+	for _, configuredLayer := range configuredLayers[len(originalLayers):] {
+		reader, err := configuredLayer.Uncompressed()
+		if err != nil {
+			return nil, err
+		}
+		layerBytes, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(layerBytes)), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+func removeConfigureImage(engine common.ContainerEngine, image string) {
+	if err := engine.ImageRemove(image); err != nil {
+		log.Println("Warning: Failed to remove", image, "from the container engine:", err)
+	}
+}
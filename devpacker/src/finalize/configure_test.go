@@ -0,0 +1,289 @@
+package finalize
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// Container engine that loads and saves real image tarballs. Builds add one layer per RUN with a file named after
+// the configure script it runs.
+func newConfigureTestEngine(t *testing.T) *common.ReplayEngine {
+	t.Helper()
+	engine := common.NewReplayEngine()
+	loaded := make(map[string]v1.Image)
+	engine.LoadResult = func(tarballPath string) error {
+		manifest, err := tarball.LoadManifest(func() (io.ReadCloser, error) { return os.Open(tarballPath) })
+		if err != nil {
+			return err
+		}
+		for _, repoTag := range manifest[0].RepoTags {
+			tag, err := name.NewTag(repoTag)
+			if err != nil {
+				return err
+			}
+			if loaded[repoTag], err = tarball.ImageFromPath(tarballPath, &tag); err != nil {
+				return err
+			}
+			// Read it now since the tarball is removed once loaded
+			if loaded[repoTag], err = copyTestImage(loaded[repoTag]); err != nil {
+				return err
+			}
+			engine.AddImage(common.ImageInspect{Id: repoTag, RepoTags: []string{repoTag}})
+		}
+		return nil
+	}
+	engine.BuildResult = func(options common.ImageBuildOptions) (common.ImageInspect, error) {
+		dockerfile, err := os.ReadFile(filepath.Join(options.ContextDir, options.Dockerfile))
+		if err != nil {
+			return common.ImageInspect{}, err
+		}
+		lines := strings.Split(strings.TrimSpace(string(dockerfile)), "\n")
+		image := loaded[strings.TrimPrefix(lines[0], "FROM ")]
+		if image == nil {
+			return common.ImageInspect{}, errors.New("Base image was not loaded: " + lines[0])
+		}
+		for _, line := range lines[1:] {
+			if !strings.HasPrefix(line, "RUN ") {
+				continue
+			}
+			var runArgs []string
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "RUN ")), &runArgs); err != nil {
+				return common.ImageInspect{}, err
+			}
+			layer := newLayerWriter()
+			layer.addFile(configuredTestFile(runArgs[len(runArgs)-1]), 0644, []byte(line))
+			configureLayer, err := layer.layer()
+			if err != nil {
+				return common.ImageInspect{}, err
+			}
+			if image, err = mutate.AppendLayers(image, configureLayer); err != nil {
+				return common.ImageInspect{}, err
+			}
+		}
+		loaded[options.Tag] = image
+		return common.ImageInspect{Id: options.Tag}, nil
+	}
+	engine.SaveResult = func(image string, tarballPath string) error {
+		tag, err := name.NewTag(image)
+		if err != nil {
+			return err
+		}
+		return tarball.WriteToFile(tarballPath, tag, loaded[image])
+	}
+	return engine
+}
+
+func configuredTestFile(configureScriptPath string) string {
+	return "/configured/" + strings.ReplaceAll(strings.TrimPrefix(configureScriptPath, "/"), "/", "_")
+}
+
+func copyTestImage(image v1.Image) (v1.Image, error) {
+	layers, err := image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	var copiedLayers []v1.Layer
+	for _, layer := range layers {
+		reader, err := layer.Uncompressed()
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		copiedLayer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		copiedLayers = append(copiedLayers, copiedLayer)
+	}
+	return mutate.AppendLayers(empty.Image, copiedLayers...)
+}
+
+func TestRunConfigureScripts(t *testing.T) {
+	image := newTestFeatureImage(t)
+	engine := newConfigureTestEngine(t)
+	featurePaths := []featureLayerPaths{
+		newFeatureLayerPaths(defaultLayersDir, testFeaturePython),
+		newFeatureLayerPaths(defaultLayersDir, testFeatureNode),
+	}
+
+	layers, err := runConfigureScripts(PostProcessingConfig{Options: FinalizeOptions{Engine: engine}}, image, featurePaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 2 {
+		t.Fatalf("Got %d layers, expected one per configure script", len(layers))
+	}
+	for index, layer := range layers {
+		configured, err := mutate.AppendLayers(empty.Image, layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err := readImageFiles(configured, func(string) bool { return true })
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedFile := configuredTestFile(featurePaths[index].ConfigureScriptPath())
+		if _, exists := files[expectedFile]; !exists {
+			t.Errorf("Expected layer %d to have %s, got %v", index, expectedFile, files)
+		}
+	}
+
+	if len(engine.Builds) != 1 || !engine.Builds[0].NoCache {
+		t.Fatalf("Expected a single build without the cache, got %+v", engine.Builds)
+	}
+	if len(engine.Removed) != 2 {
+		t.Errorf("Expected the loaded and built images to be removed, got %v", engine.Removed)
+	}
+	for _, removed := range engine.Removed {
+		if !strings.Contains(removed, configureImageRepository) {
+			t.Errorf("Removed %s, expected only temporary images to be removed", removed)
+		}
+	}
+}
+
+func TestConfigureDockerfile(t *testing.T) {
+	featurePaths := newFeatureLayerPaths(defaultLayersDir, testFeaturePython)
+	dockerfile, err := configureDockerfile("devpacker-configure:base-test", []featureLayerPaths{featurePaths})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "FROM devpacker-configure:base-test\nUSER root\n" +
+		`RUN ["/bin/bash","-c","set -e; set -a; . \"$1\"; set +a; chmod +x \"$2\"; \"$2\"","configure",` +
+		`"` + featurePaths.EnvFilePath() + `","` + featurePaths.ConfigureScriptPath() + `"]` + "\n"
+	if dockerfile != expected {
+		t.Errorf("Got Dockerfile:\n%s\nexpected:\n%s", dockerfile, expected)
+	}
+}
+
+func TestRunConfigureScriptsErrors(t *testing.T) {
+	featurePaths := []featureLayerPaths{newFeatureLayerPaths(defaultLayersDir, testFeaturePython)}
+	tests := []struct {
+		name          string
+		options       FinalizeOptions
+		setup         func(engine *common.ReplayEngine)
+		expectedError string
+	}{
+		{
+			name:          "no container engine",
+			options:       FinalizeOptions{EngineName: "not-an-engine"},
+			expectedError: "no container engine is available",
+		},
+		{
+			name: "build fails",
+			setup: func(engine *common.ReplayEngine) {
+				engine.BuildResult = func(options common.ImageBuildOptions) (common.ImageInspect, error) {
+					return common.ImageInspect{}, errors.New("configure exited with code 1")
+				}
+			},
+			expectedError: "Failed to run configure scripts: configure exited with code 1",
+		},
+		{
+			name: "unexpected layers",
+			setup: func(engine *common.ReplayEngine) {
+				engine.SaveResult = func(image string, tarballPath string) error {
+					tag, _ := name.NewTag(image)
+					return tarball.WriteToFile(tarballPath, tag, newTestFeatureImage(t))
+				}
+			},
+			expectedError: "add 1 layers",
+		},
+		{
+			name: "changed base layers",
+			setup: func(engine *common.ReplayEngine) {
+				engine.SaveResult = func(image string, tarballPath string) error {
+					layer := newLayerWriter()
+					layer.addFile("/changed", 0644, []byte("changed"))
+					first, _ := layer.layer()
+					second, _ := newLayerWriter().layer()
+					changed, err := mutate.AppendLayers(empty.Image, first, second)
+					if err != nil {
+						return err
+					}
+					tag, _ := name.NewTag(image)
+					return tarball.WriteToFile(tarballPath, tag, changed)
+				}
+			},
+			expectedError: "does not match",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := test.options
+			if options.EngineName == "" {
+				engine := newConfigureTestEngine(t)
+				if test.setup != nil {
+					test.setup(engine)
+				}
+				options.Engine = engine
+			}
+			_, err := runConfigureScripts(PostProcessingConfig{Options: options}, newTestFeatureImage(t), featurePaths)
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("Expected an error containing %q, got %v", test.expectedError, err)
+			}
+			if engine, isReplay := options.Engine.(*common.ReplayEngine); isReplay && len(engine.Images) != 0 {
+				t.Errorf("Expected temporary images to be removed, got %v", engine.Images)
+			}
+		})
+	}
+}
+
+func TestExecuteDaemonlessPostProcessingConfigure(t *testing.T) {
+	image := newTestFeatureImage(t)
+	featurePaths := newFeatureLayerPaths(defaultLayersDir, testFeaturePython)
+	layer := newLayerWriter()
+	layer.addFile(featurePaths.ConfigureScriptPath(), 0755, []byte("#!/bin/bash\necho configured\n"))
+	scriptLayer, err := layer.layer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image, err = mutate.AppendLayers(image, scriptLayer); err != nil {
+		t.Fatal(err)
+	}
+	imageInspect, err := inspectImage(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := newConfigureTestEngine(t)
+	postProcessingConfig := newPostProcessingConfig("test_image", imageInspect, "", FinalizeOptions{Engine: engine})
+
+	finalized, err := executeDaemonlessPostProcessing(postProcessingConfig, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile, err := finalized.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var createdBy []string
+	for _, history := range configFile.History[len(configFile.History)-2:] {
+		createdBy = append(createdBy, history.CreatedBy)
+	}
+	expected := []string{"devpacker finalize: configure script for python", "devpacker finalize: post processing"}
+	if !reflect.DeepEqual(createdBy, expected) {
+		t.Errorf("Got history %v, expected %v", createdBy, expected)
+	}
+	if configFile.Config.User != "cnb" {
+		t.Errorf("Got user %q, expected the build's USER root to not end up in the image", configFile.Config.User)
+	}
+}
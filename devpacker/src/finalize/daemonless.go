@@ -0,0 +1,366 @@
+package finalize
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+const defaultLayersDir = "/layers"
+const commonConfigRoot = "/usr/local" + common.DevContainerConfigRelativeRoot
+const commonEntrypointD = "/usr/local" + common.DevContainerEntrypointD
+
+// Same snippet post-processing.sh adds to the top of shell startup files
+const launcherShellSnippet = `# Ensure all interactive or login shells are initalized via /cnb/lifecycle/launcher (which is also the default entrypoint)
+if [ ! -z "${CNB_APP_DIR}" ] && [ -z "${DCNB_ENV_LOADED}" ]; then export DCNB_ENV_LOADED=true; mapfile -d $'\0' _cmd_line < /proc/$$/cmdline; exec /cnb/lifecycle/launcher "${_cmd_line[@]//\"/\\\"}"; fi`
+
+// Same script post-processing.sh writes to common.CommonEntrypointDBootstrapPath
+const entrypointBootstrapScript = `#!/bin/bash
+if [ -z "${DEV_CONTAINER_ENTRYPOINTS_DONE}" ] && [ -d "` + commonEntrypointD + `" ]; then
+    for entrypoint in "` + commonEntrypointD + `"/*; do
+        if [ -r "${entrypoint}" ]; then
+            "${entrypoint}"
+        fi
+    done
+    export DEV_CONTAINER_ENTRYPOINTS_DONE=true
+fi
+exec "$@"
+`
+
+// Shell startup files that get the launcher snippet, and the path that needs to exist for them to be updated
+var launcherShellStartupFiles = [][2]string{
+	{"/etc/bash.bashrc", "/etc/bash.bashrc"},
+	{"/etc/profile", "/etc/profile"},
+	{"/etc/zsh/zshenv", "/etc/zsh"},
+}
+
+// Locations of a feature's files in its buildpack layer
+type featureLayerPaths struct {
+	FeatureId       string
+	BuildpackFolder string
+	LayerPath       string
+	ConfigPath      string
+	EntrypointD     string
+}
+
+func newFeatureLayerPaths(layersDir string, fullFeatureId string) featureLayerPaths {
+	featurePaths := featureLayerPaths{FeatureId: fullFeatureId}
+	if index := strings.LastIndex(fullFeatureId, "/"); index > -1 {
+		featurePaths.FeatureId = fullFeatureId[index+1:]
+		featurePaths.BuildpackFolder = strings.ReplaceAll(fullFeatureId[:index], "/", "_")
+	}
+	featurePaths.LayerPath = path.Join(layersDir, featurePaths.BuildpackFolder, featurePaths.FeatureId)
+	featurePaths.ConfigPath = path.Join(featurePaths.LayerPath, common.DevContainerFeatureConfigSubfolder, "features", featurePaths.FeatureId)
+	featurePaths.EntrypointD = path.Join(featurePaths.LayerPath, common.DevContainerEntrypointD)
+	return featurePaths
+}
+
+func (featurePaths featureLayerPaths) ConfigureScriptPath() string {
+	return path.Join(featurePaths.ConfigPath, "bin", "configure")
+}
+
+func (featurePaths featureLayerPaths) EnvFilePath() string {
+	return path.Join(featurePaths.ConfigPath, "devcontainer-features.env")
+}
+
+// A file from the flattened image filesystem. Content is only set for regular files.
+type imageFile struct {
+	Header  *tar.Header
+	Content []byte
+}
+
+// Applies the same changes as post-processing.sh without a container engine by adding a layer and updating the
+// image config. Only feature configure scripts need to execute in the image, which is done in a container.
+func executeDaemonlessPostProcessing(postProcessingConfig PostProcessingConfig, image v1.Image) (v1.Image, error) {
+	featuresToProcess, postProcessingState := featuresToPostProcess(postProcessingConfig)
+	log.Println("To post process:", strings.Join(featuresToProcess, " "))
+	configFile, err := image.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	layersDir := envVarValue(configFile.Config.Env, "CNB_LAYERS_DIR")
+	if layersDir == "" {
+		layersDir = defaultLayersDir
+	}
+	var featurePathsToProcess []featureLayerPaths
+	for _, featureId := range featuresToProcess {
+		featurePathsToProcess = append(featurePathsToProcess, newFeatureLayerPaths(layersDir, featureId))
+	}
+	fileFilter := postProcessingFileFilter(featurePathsToProcess)
+	files, err := readImageFiles(image, fileFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Execute "configure" scripts first since they can also modify shell startup files
+	var featurePathsToConfigure []featureLayerPaths
+	for _, featurePaths := range featurePathsToProcess {
+		if _, hasConfigureScript := files[featurePaths.ConfigureScriptPath()]; hasConfigureScript {
+			featurePathsToConfigure = append(featurePathsToConfigure, featurePaths)
+		}
+	}
+	if len(featurePathsToConfigure) > 0 {
+		configureLayers, err := runConfigureScripts(postProcessingConfig, image, featurePathsToConfigure)
+		if err != nil {
+			return nil, err
+		}
+		for index, configureLayer := range configureLayers {
+			history := postProcessingHistory("configure script for " + featurePathsToConfigure[index].FeatureId)
+			if image, err = mutate.Append(image, mutate.Addendum{Layer: configureLayer, History: history}); err != nil {
+				return nil, err
+			}
+		}
+		if files, err = readImageFiles(image, fileFilter); err != nil {
+			return nil, err
+		}
+	}
+
+	layer := newLayerWriter()
+	for _, startupFile := range launcherShellStartupFiles {
+		addLauncherSnippet(layer, files, startupFile[0], startupFile[1])
+	}
+
+	// Create common entrypoint location and script
+	for _, folder := range []string{"/usr/local/etc", commonConfigRoot, commonEntrypointD} {
+		if _, exists := files[folder]; !exists {
+			layer.addDir(folder, 0755)
+		}
+	}
+	layer.addFile(common.CommonEntrypointDBootstrapPath, 0755, []byte(entrypointBootstrapScript))
+
+	for _, featurePaths := range featurePathsToProcess {
+		log.Println("Processing:", featurePaths.LayerPath)
+		// Remove env vars for features since this will result in duplicates after post-processing
+		layer.addWhiteout(path.Join(featurePaths.LayerPath, "env"))
+		layer.addWhiteout(path.Join(featurePaths.LayerPath, common.DevContainerFeatureConfigSubfolder))
+
+		// Symlink entrypoint scripts
+		for _, entrypointPath := range sortedChildFiles(files, featurePaths.EntrypointD) {
+			log.Println("- Wiring up entrypoint", entrypointPath+"...")
+			entrypoint := files[entrypointPath]
+			if entrypoint.Header.Mode&0111 != 0111 {
+				layer.addFile(entrypointPath, entrypoint.Header.Mode|0111, entrypoint.Content)
+			}
+			layer.addSymlink(path.Join(commonEntrypointD, "layer-"+featurePaths.BuildpackFolder+"-"+featurePaths.FeatureId+"-"+path.Base(entrypointPath)), entrypointPath)
+		}
+	}
+	postProcessingLayer, err := layer.layer()
+	if err != nil {
+		return nil, err
+	}
+	if image, err = mutate.Append(image, mutate.Addendum{Layer: postProcessingLayer, History: postProcessingHistory("post processing")}); err != nil {
+		return nil, err
+	}
+
+	// Update the config the same way post-processing.Dockerfile does
+	config := *configFile.Config.DeepCopy()
+	for _, featureId := range featuresToProcess {
+		containerEnv := postProcessingConfig.LayerFeatureMetadata[featureId].Config.ContainerEnv
+		for _, varName := range sortedKeys(containerEnv) {
+			config.Env = setEnvVarValue(config.Env, varName, expandEnvVars(containerEnv[varName], config.Env))
+		}
+	}
+	config.Entrypoint = wrapEntrypoint(config.Entrypoint)
+	if config.Labels == nil {
+		config.Labels = make(map[string]string)
+	}
+	config.Labels[common.PostProcessingDoneMetadataId] = strings.Join(postProcessingStateIds(postProcessingState), " ")
+	config.Labels[common.PostProcessingStateMetadataId] = postProcessingStateLabel(postProcessingState)
+	config.Labels[DevContainerMetadataLabel] = devContainerMetadataLabel(postProcessingConfig)
+	if image, err = mutate.Config(image, config); err != nil {
+		return nil, err
+	}
+	resultInspect, err := inspectImage(image)
+	if err != nil {
+		return nil, err
+	}
+	return image, verifyPostProcessedImage(postProcessingConfig, featuresToProcess, resultInspect.Config)
+}
+
+// Prepends the launcher snippet to a shell startup file unless it is already there
+func addLauncherSnippet(layer *layerWriter, files map[string]imageFile, filePath string, checkExists string) {
+	if _, exists := files[checkExists]; !exists {
+		log.Println(checkExists, "does not exist. Skipping.")
+		return
+	}
+	existingFile, exists := files[filePath]
+	mode := int64(0644)
+	if exists {
+		if existingFile.Header.Typeflag != tar.TypeReg && existingFile.Header.Typeflag != tar.TypeRegA {
+			log.Println(filePath, "is not a regular file. Skipping.")
+			return
+		}
+		mode = existingFile.Header.Mode
+	}
+	// Like grep -Fx, any line of the snippet counts as a match
+	for _, line := range strings.Split(string(existingFile.Content), "\n") {
+		for _, snippetLine := range strings.Split(launcherShellSnippet, "\n") {
+			if line == snippetLine {
+				log.Println("/cnb/lifecycle/launcher already exists in", filePath+". Skipping.")
+				return
+			}
+		}
+	}
+	layer.addFile(filePath, mode, []byte(launcherShellSnippet+"\n"+strings.TrimRight(string(existingFile.Content), "\n")+"\n"))
+	log.Println("Adding /cnb/lifecycle/launcher to", filePath+".")
+}
+
+// Returns a filter that matches every path post processing needs to look at
+func postProcessingFileFilter(featurePathsToProcess []featureLayerPaths) func(string) bool {
+	paths := []string{"/usr/local/etc", commonConfigRoot, commonEntrypointD}
+	for _, startupFile := range launcherShellStartupFiles {
+		paths = append(paths, startupFile[0], startupFile[1])
+	}
+	for _, featurePaths := range featurePathsToProcess {
+		paths = append(paths, featurePaths.ConfigureScriptPath(), featurePaths.EnvFilePath())
+	}
+	return func(filePath string) bool {
+		if common.SliceContainsString(paths, filePath) {
+			return true
+		}
+		for _, featurePaths := range featurePathsToProcess {
+			if path.Dir(filePath) == featurePaths.EntrypointD {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Reads the headers, and content of regular files, for paths in the flattened image filesystem that match the filter
+func readImageFiles(image v1.Image, filter func(string) bool) (map[string]imageFile, error) {
+	files := make(map[string]imageFile)
+	reader := mutate.Extract(image)
+	defer reader.Close()
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return nil, err
+		}
+		filePath := path.Clean("/" + header.Name)
+		if !filter(filePath) {
+			continue
+		}
+		file := imageFile{Header: header}
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			if file.Content, err = ioutil.ReadAll(tarReader); err != nil {
+				return nil, err
+			}
+		}
+		files[filePath] = file
+	}
+}
+
+// Returns the sorted paths of regular files directly in a folder
+func sortedChildFiles(files map[string]imageFile, folder string) []string {
+	var childFiles []string
+	for filePath, file := range files {
+		if path.Dir(filePath) == folder && (file.Header.Typeflag == tar.TypeReg || file.Header.Typeflag == tar.TypeRegA) {
+			childFiles = append(childFiles, filePath)
+		}
+	}
+	sort.Strings(childFiles)
+	return childFiles
+}
+
+func postProcessingHistory(step string) v1.History {
+	return v1.History{Created: v1.Time{Time: time.Now()}, CreatedBy: "devpacker finalize: " + step}
+}
+
+func envVarValue(env []string, varName string) string {
+	for _, envVar := range env {
+		if strings.HasPrefix(envVar, varName+"=") {
+			return strings.TrimPrefix(envVar, varName+"=")
+		}
+	}
+	return ""
+}
+
+func setEnvVarValue(env []string, varName string, value string) []string {
+	for i, envVar := range env {
+		if strings.HasPrefix(envVar, varName+"=") {
+			env[i] = varName + "=" + value
+			return env
+		}
+	}
+	return append(env, varName+"="+value)
+}
+
+// Expands $VAR and ${VAR} references like the Dockerfile ENV instruction
+func expandEnvVars(value string, env []string) string {
+	return os.Expand(value, func(varName string) string {
+		return envVarValue(env, varName)
+	})
+}
+
+// Builds an uncompressed layer tarball in memory. Errors are returned from layer().
+type layerWriter struct {
+	buffer    bytes.Buffer
+	tarWriter *tar.Writer
+	modTime   time.Time
+	err       error
+}
+
+func newLayerWriter() *layerWriter {
+	layer := &layerWriter{modTime: time.Now()}
+	layer.tarWriter = tar.NewWriter(&layer.buffer)
+	return layer
+}
+
+func (layer *layerWriter) writeEntry(header *tar.Header, content []byte) {
+	if layer.err != nil {
+		return
+	}
+	header.Name = strings.TrimPrefix(path.Clean(header.Name), "/")
+	if header.ModTime.IsZero() {
+		header.ModTime = layer.modTime
+	}
+	if layer.err = layer.tarWriter.WriteHeader(header); layer.err == nil && len(content) > 0 {
+		_, layer.err = layer.tarWriter.Write(content)
+	}
+}
+
+func (layer *layerWriter) addDir(dirPath string, mode int64) {
+	layer.writeEntry(&tar.Header{Typeflag: tar.TypeDir, Name: dirPath, Mode: mode}, nil)
+}
+
+func (layer *layerWriter) addFile(filePath string, mode int64, content []byte) {
+	layer.writeEntry(&tar.Header{Typeflag: tar.TypeReg, Name: filePath, Mode: mode, Size: int64(len(content))}, content)
+}
+
+func (layer *layerWriter) addSymlink(linkPath string, target string) {
+	layer.writeEntry(&tar.Header{Typeflag: tar.TypeSymlink, Name: linkPath, Linkname: target, Mode: 0777}, nil)
+}
+
+// Adds an OCI whiteout so the path is removed from lower layers
+func (layer *layerWriter) addWhiteout(removedPath string) {
+	layer.writeEntry(&tar.Header{Typeflag: tar.TypeReg, Name: path.Join(path.Dir(removedPath), ".wh."+path.Base(removedPath)), Mode: 0644}, nil)
+}
+
+func (layer *layerWriter) layer() (v1.Layer, error) {
+	if layer.err != nil {
+		return nil, layer.err
+	}
+	if err := layer.tarWriter.Close(); err != nil {
+		return nil, err
+	}
+	layerBytes := layer.buffer.Bytes()
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(layerBytes)), nil
+	})
+}
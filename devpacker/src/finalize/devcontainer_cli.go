@@ -0,0 +1,109 @@
+package finalize
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+const DefaultDevContainerCliPath = "devcontainer"
+
+// Temporarily swaps the generated devcontainer.json.devpack file in for devcontainer.json
+type devContainerJsonSwap struct {
+	devContainerJsonPath string
+	generatedPath        string
+	backupPath           string
+	hadOriginal          bool
+	restoreOnce          sync.Once
+	restoreErr           error
+}
+
+func newDevContainerJsonSwap(devContainerJsonPath string) *devContainerJsonSwap {
+	return &devContainerJsonSwap{
+		devContainerJsonPath: devContainerJsonPath,
+		generatedPath:        devContainerJsonPath + ".devpack",
+		backupPath:           devContainerJsonPath + ".orig",
+	}
+}
+
+func (swap *devContainerJsonSwap) swap() error {
+	if _, err := os.Stat(swap.devContainerJsonPath); err == nil {
+		swap.hadOriginal = true
+		if err := os.Rename(swap.devContainerJsonPath, swap.backupPath); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(swap.generatedPath, swap.devContainerJsonPath); err != nil {
+		swap.restore()
+		return err
+	}
+	return nil
+}
+
+// Puts files back where they were. Safe to call more than once (e.g. from both a signal handler and a defer).
+func (swap *devContainerJsonSwap) restore() error {
+	swap.restoreOnce.Do(func() {
+		if _, err := os.Stat(swap.devContainerJsonPath); err == nil {
+			if _, err := os.Stat(swap.generatedPath); os.IsNotExist(err) {
+				swap.restoreErr = os.Rename(swap.devContainerJsonPath, swap.generatedPath)
+			}
+		}
+		if swap.hadOriginal {
+			if err := os.Rename(swap.backupPath, swap.devContainerJsonPath); err != nil && swap.restoreErr == nil {
+				swap.restoreErr = err
+			}
+		}
+	})
+	return swap.restoreErr
+}
+
+// Calls "devcontainer build" using the generated devcontainer.json so any features that are not in the
+// devpack are added to the image. The original devcontainer.json is restored even on failure or a signal.
+func devContainerImageBuild(postProcessingConfig PostProcessingConfig, devContainerJsonPath string) (err error) {
+	runner := postProcessingConfig.Options.Runner
+	if runner == nil {
+		runner = common.ExecRunner{}
+	}
+	cliPath := postProcessingConfig.Options.DevContainerCliPath
+	if cliPath == "" {
+		cliPath = DefaultDevContainerCliPath
+	}
+
+	swap := newDevContainerJsonSwap(devContainerJsonPath)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case receivedSignal := <-signals:
+			log.Println("Received", receivedSignal, "- restoring devcontainer.json.")
+			if err := swap.restore(); err != nil {
+				log.Println("Failed to restore devcontainer.json:", err)
+			}
+			// Exit like a shell would, e.g. 130 for SIGINT and 143 for SIGTERM
+			os.Exit(128 + int(receivedSignal.(syscall.Signal)))
+		case <-done:
+		}
+	}()
+
+	if err := swap.swap(); err != nil {
+		return err
+	}
+	defer func() {
+		if restoreErr := swap.restore(); restoreErr != nil {
+			log.Println("Failed to restore devcontainer.json:", restoreErr)
+			if err == nil {
+				err = restoreErr
+			}
+		}
+	}()
+	return runner.Run(postProcessingConfig.ApplicationFolder, cliPath, "build",
+		"--workspace-folder", postProcessingConfig.ApplicationFolder,
+		"--image-name", postProcessingConfig.Image)
+}
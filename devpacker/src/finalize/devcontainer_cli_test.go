@@ -0,0 +1,94 @@
+package finalize
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// CommandRunner that records calls and checks which devcontainer.json the CLI would see
+type stubDevContainerCli struct {
+	devContainerJsonPath string
+	calls                [][]string
+	seenContent          string
+	err                  error
+	panicMessage         string
+}
+
+func (cli *stubDevContainerCli) Run(workingDir string, name string, args ...string) error {
+	cli.calls = append(cli.calls, append([]string{name}, args...))
+	content, _ := os.ReadFile(cli.devContainerJsonPath)
+	cli.seenContent = string(content)
+	if cli.panicMessage != "" {
+		panic(cli.panicMessage)
+	}
+	return cli.err
+}
+
+func (cli *stubDevContainerCli) Output(workingDir string, name string, args ...string) ([]byte, error) {
+	return nil, cli.Run(workingDir, name, args...)
+}
+
+func TestDevContainerImageBuild(t *testing.T) {
+	tests := []struct {
+		name         string
+		hasOriginal  bool
+		err          error
+		panicMessage string
+	}{
+		{name: "success", hasOriginal: true},
+		{name: "no original devcontainer.json"},
+		{name: "CLI fails", hasOriginal: true, err: errors.New("build failed")},
+		{name: "CLI panics", hasOriginal: true, panicMessage: "unexpected"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			appFolder := t.TempDir()
+			devContainerJsonPath := filepath.Join(appFolder, ".devcontainer", "devcontainer.json")
+			os.MkdirAll(filepath.Dir(devContainerJsonPath), 0755)
+			if test.hasOriginal {
+				os.WriteFile(devContainerJsonPath, []byte("original"), 0644)
+			}
+			os.WriteFile(devContainerJsonPath+".devpack", []byte("generated"), 0644)
+			cli := &stubDevContainerCli{devContainerJsonPath: devContainerJsonPath, err: test.err, panicMessage: test.panicMessage}
+			postProcessingConfig := PostProcessingConfig{Image: "test-image", ApplicationFolder: appFolder}
+			postProcessingConfig.Options.Runner = cli
+			postProcessingConfig.Options.DevContainerCliPath = "/path/to/devcontainer"
+
+			var err error
+			func() {
+				defer func() {
+					if recovered := recover(); recovered != nil && recovered != test.panicMessage {
+						t.Fatalf("Unexpected panic: %v", recovered)
+					}
+				}()
+				err = devContainerImageBuild(postProcessingConfig, devContainerJsonPath)
+			}()
+
+			if err != test.err {
+				t.Errorf("Got error %v, expected %v", err, test.err)
+			}
+			if cli.seenContent != "generated" {
+				t.Errorf("CLI saw %q instead of the generated devcontainer.json", cli.seenContent)
+			}
+			expectedCall := "/path/to/devcontainer build --workspace-folder " + appFolder + " --image-name test-image"
+			if len(cli.calls) != 1 || strings.Join(cli.calls[0], " ") != expectedCall {
+				t.Errorf("Got calls %v, expected %s", cli.calls, expectedCall)
+			}
+			if generated, _ := os.ReadFile(devContainerJsonPath + ".devpack"); string(generated) != "generated" {
+				t.Errorf("Generated file not restored, got %q", generated)
+			}
+			original, err := os.ReadFile(devContainerJsonPath)
+			if test.hasOriginal && string(original) != "original" {
+				t.Errorf("Original devcontainer.json not restored, got %q", original)
+			} else if !test.hasOriginal && !os.IsNotExist(err) {
+				t.Errorf("devcontainer.json should not exist, got %q", original)
+			}
+			if _, err := os.Stat(devContainerJsonPath + ".orig"); !os.IsNotExist(err) {
+				t.Error("Backup file was left behind")
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package finalize
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+// Output modes for config from features that are already in the image
+const (
+	OutputModeMerge   = "merge"   // Merge runArgs, extensions, settings, and mounts into devcontainer.json (for older tools)
+	OutputModeFeature = "feature" // Generate a local feature next to devcontainer.json and reference it
+)
+
+const FinalizeFeatureId = "devpack-config"
+const FinalizeFeatureVersion = "1.0.0"
+
+// File in the generated feature folder that marks it as safe for devpacker to replace
+const finalizeFeatureMarkerFilename = ".devpacker-generated"
+
+// Everything the generated feature describes is already in the image, so install.sh has nothing to do
+const finalizeFeatureInstallScript = `#!/bin/sh
+# Generated by devpacker. Features described by devcontainer-feature.json are already in the image.
+exit 0
+`
+
+// Writes a self-contained local feature with the config for features already in the image to a folder
+// next to devcontainer.json. Returns the relative reference to use in the devcontainer.json features property.
+func createFinalizeFeature(postProcessingConfig PostProcessingConfig, devContainerJsonPath string) string {
+	settingsMerger := newSettingsMerger(postProcessingConfig.Options.SettingsArrayMerge)
+	finalizeFeatureConfig := generateFinalizeFeatureConfig(postProcessingConfig, settingsMerger)
+	settingsMerger.logProvenance()
+	finalizeFeatureConfig.Version = FinalizeFeatureVersion
+	finalizeFeatureConfig.Name = "Config for features added to the image by devpacker"
+
+	// Resolve containerEnv references in mounts, but omit containerEnv itself since it is already set in the image
+	variables := make(map[string]string)
+	for varName, varValue := range finalizeFeatureConfig.ContainerEnv {
+		variables["containerEnv:"+varName] = varValue
+	}
+	for i, mount := range finalizeFeatureConfig.Mounts {
+		finalizeFeatureConfig.Mounts[i] = mount.SubstituteVariables(variables)
+	}
+	finalizeFeatureConfig.ContainerEnv = nil
+
+	finalizeFeatureJsonBytes, err := json.MarshalIndent(&finalizeFeatureConfig, "", "\t")
+	if err != nil {
+		log.Fatal("Failed to marshal finalize feature config to json: ", err)
+	}
+	// Local features have to be in a .devcontainer folder, so use one for a .devcontainer.json in the application root
+	featureReference := "./" + FinalizeFeatureId
+	finalizeFeatureTargetFolder := filepath.Join(filepath.Dir(devContainerJsonPath), FinalizeFeatureId)
+	if filepath.Base(devContainerJsonPath) == ".devcontainer.json" {
+		featureReference = "./.devcontainer/" + FinalizeFeatureId
+		finalizeFeatureTargetFolder = filepath.Join(filepath.Dir(devContainerJsonPath), ".devcontainer", FinalizeFeatureId)
+	}
+	if !isGeneratedFinalizeFeatureFolder(finalizeFeatureTargetFolder) {
+		log.Fatal(finalizeFeatureTargetFolder, " already exists and was not generated by devpacker. Rename or remove it to use --output ", OutputModeFeature, ".")
+	}
+	if err := os.RemoveAll(finalizeFeatureTargetFolder); err != nil {
+		log.Fatal("Failed to remove existing finalize feature folder: ", err)
+	}
+	if err := os.MkdirAll(finalizeFeatureTargetFolder, 0755); err != nil {
+		log.Fatal("Failed to create finalize feature target folder: ", err)
+	}
+	if err := common.WriteFile(filepath.Join(finalizeFeatureTargetFolder, finalizeFeatureMarkerFilename), []byte("Generated by devpacker. This folder is replaced when the image is finalized.\n")); err != nil {
+		log.Fatal("Failed to write finalize feature marker: ", err)
+	}
+	log.Println("Writing out finalize feature to:", finalizeFeatureTargetFolder)
+	if err := common.WriteFile(filepath.Join(finalizeFeatureTargetFolder, "devcontainer-feature.json"), finalizeFeatureJsonBytes); err != nil {
+		log.Fatal("Failed to write devcontainer-feature.json: ", err)
+	}
+	installScriptPath := filepath.Join(finalizeFeatureTargetFolder, "install.sh")
+	if err := common.WriteFile(installScriptPath, []byte(finalizeFeatureInstallScript)); err != nil {
+		log.Fatal("Failed to write install.sh: ", err)
+	}
+	if err := os.Chmod(installScriptPath, 0755); err != nil {
+		log.Fatal("Failed to make install.sh executable: ", err)
+	}
+	return featureReference
+}
+
+// Returns true if the folder does not exist, is empty, or was generated by devpacker. Folders from versions without
+// the marker file are recognized by the id in devcontainer-feature.json.
+func isGeneratedFinalizeFeatureFolder(folder string) bool {
+	entries, err := os.ReadDir(folder)
+	if os.IsNotExist(err) {
+		return true
+	} else if err != nil {
+		log.Fatal("Failed to read ", folder, ": ", err)
+	}
+	if len(entries) == 0 {
+		return true
+	}
+	if _, err := os.Stat(filepath.Join(folder, finalizeFeatureMarkerFilename)); err == nil {
+		return true
+	}
+	featureJsonBytes, err := os.ReadFile(filepath.Join(folder, "devcontainer-feature.json"))
+	if err != nil {
+		return false
+	}
+	var featureConfig common.FeatureConfig
+	return json.Unmarshal(featureJsonBytes, &featureConfig) == nil && featureConfig.Id == FinalizeFeatureId
+}
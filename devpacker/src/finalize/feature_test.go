@@ -0,0 +1,70 @@
+package finalize
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+func TestIsGeneratedFinalizeFeatureFolder(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected bool
+	}{
+		{name: "missing folder", expected: true},
+		{name: "empty folder", files: map[string]string{}, expected: true},
+		{name: "marker file", files: map[string]string{finalizeFeatureMarkerFilename: "", "install.sh": ""}, expected: true},
+		{name: "generated without marker", files: map[string]string{"devcontainer-feature.json": `{"id": "devpack-config"}`}, expected: true},
+		{name: "user feature", files: map[string]string{"devcontainer-feature.json": `{"id": "my-feature"}`}, expected: false},
+		{name: "other user files", files: map[string]string{"notes.md": "keep me"}, expected: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			folder := filepath.Join(t.TempDir(), FinalizeFeatureId)
+			if test.files != nil {
+				if err := os.MkdirAll(folder, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for fileName, content := range test.files {
+				if err := os.WriteFile(filepath.Join(folder, fileName), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := isGeneratedFinalizeFeatureFolder(folder); got != test.expected {
+				t.Errorf("Got %v, expected %v", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestCreateFinalizeFeatureLocation(t *testing.T) {
+	tests := []struct {
+		devContainerJson  string
+		expectedReference string
+		expectedFolder    string
+	}{
+		{".devcontainer/devcontainer.json", "./devpack-config", ".devcontainer/devpack-config"},
+		{".devcontainer.json", "./.devcontainer/devpack-config", ".devcontainer/devpack-config"},
+	}
+	for _, test := range tests {
+		t.Run(test.devContainerJson, func(t *testing.T) {
+			appFolder := t.TempDir()
+			postProcessingConfig := PostProcessingConfig{LayerFeatureMetadata: map[string]common.LayerFeatureMetadata{}}
+			reference := createFinalizeFeature(postProcessingConfig, filepath.Join(appFolder, test.devContainerJson))
+			if reference != test.expectedReference {
+				t.Errorf("Got reference %s, expected %s", reference, test.expectedReference)
+			}
+			for _, fileName := range []string{"devcontainer-feature.json", "install.sh", finalizeFeatureMarkerFilename} {
+				if _, err := os.Stat(filepath.Join(appFolder, test.expectedFolder, fileName)); err != nil {
+					t.Error(err)
+				}
+			}
+			// Running again replaces the generated folder
+			createFinalizeFeature(postProcessingConfig, filepath.Join(appFolder, test.devContainerJson))
+		})
+	}
+}
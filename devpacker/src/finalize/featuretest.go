@@ -0,0 +1,164 @@
+package finalize
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+// Folder test scripts are copied to in the container
+const featureTestScriptFolder = "/tmp"
+
+// JUnit XML report, in the format CI systems commonly accept
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Content string `xml:",chardata"`
+}
+
+// Runs the bin/test script of each feature in the image as the image's user, using the scripts from the feature set
+// in featuresPath. Results are logged and written as JUnit XML to junitPath if set. Returns true if at least one test
+// ran and no tests failed.
+func RunFeatureTests(image string, featuresPath string, junitPath string, options FinalizeOptions) bool {
+	if imageRef := ParseImageReference(image, TransportDaemon); !imageRef.IsDaemon() {
+		log.Fatal("Feature tests need to run the image, so it must be in the container engine: ", image)
+	}
+	if options.Engine == nil {
+		engine, err := common.NewContainerEngine(options.EngineName, options.DockerHost, options.Runner)
+		if err != nil {
+			log.Fatal(err)
+		}
+		options.Engine = engine
+	}
+	imageInspect, err := options.Engine.ImageInspect(image)
+	if err != nil {
+		log.Fatal("Failed to inspect image ", image, ": ", err)
+	}
+	postProcessingConfig := newPostProcessingConfig(image, imageInspect, "", options)
+	if featuresToProcess, _, _ := comparePostProcessingState(postProcessingConfig); len(featuresToProcess) > 0 {
+		log.Println("Warning: Image has not been finalized. Tests may fail for:", strings.Join(featuresToProcess, " "))
+	}
+
+	devpackSettings := common.DevpackSettings{}
+	devpackSettings.Load(featuresPath)
+	featuresJson := common.FeaturesJson{}
+	featuresJson.Load(featuresPath)
+	featureSetFeatures := make(map[string]common.FeatureConfig)
+	for _, feature := range featuresJson.Features {
+		featureSetFeatures[feature.FullFeatureId(devpackSettings, "/")] = feature
+	}
+
+	suite := junitTestSuite{Name: image}
+	suiteStart := time.Now()
+	for _, featureId := range postProcessingConfig.LayerOrder {
+		testCase := junitTestCase{Name: featureId, ClassName: image}
+		feature, inFeatureSet := featureSetFeatures[featureId]
+		testStart := time.Now()
+		layerVersion := postProcessingConfig.LayerFeatureMetadata[featureId].Version
+		if !inFeatureSet {
+			testCase.Skipped = &junitMessage{Message: "Feature is not in the feature set in " + featuresPath}
+		} else if layerVersion != devpackSettings.Version {
+			// The test script may not match what the other version of the feature installed
+			testCase.Skipped = &junitMessage{Message: "Feature version " + layerVersion + " in the image does not match the feature set version " + devpackSettings.Version}
+		} else if script, err := ioutil.ReadFile(feature.ScriptPath(featuresPath, "test")); os.IsNotExist(err) {
+			testCase.Skipped = &junitMessage{Message: "Feature has no test script"}
+		} else if err != nil {
+			testCase.Error = &junitMessage{Message: err.Error()}
+		} else {
+			runFeatureTest(postProcessingConfig, featureId, script, &testCase)
+		}
+		testCase.Time = junitSeconds(time.Since(testStart))
+
+		suite.Tests++
+		switch {
+		case testCase.Skipped != nil:
+			suite.Skipped++
+			log.Println("- SKIP", featureId+":", testCase.Skipped.Message)
+		case testCase.Error != nil:
+			suite.Errors++
+			log.Println("- ERROR", featureId+":", testCase.Error.Message)
+		case testCase.Failure != nil:
+			suite.Failures++
+			log.Printf("- FAIL %s (%ss): %s\n%s", featureId, testCase.Time, testCase.Failure.Message, testCase.Failure.Content)
+		default:
+			log.Printf("- PASS %s (%ss)", featureId, testCase.Time)
+		}
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+	suite.Time = junitSeconds(time.Since(suiteStart))
+	log.Printf("Feature tests: %d passed, %d failed, %d errors, %d skipped", suite.Tests-suite.Failures-suite.Errors-suite.Skipped, suite.Failures, suite.Errors, suite.Skipped)
+
+	if junitPath != "" {
+		if err := writeJunitReport(junitPath, junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+			log.Fatal("Failed to write JUnit report: ", err)
+		}
+	}
+	if suite.Tests == suite.Skipped {
+		log.Println("No feature tests ran. Check that", featuresPath, "is the feature set the image was built with.")
+		return false
+	}
+	return suite.Failures == 0 && suite.Errors == 0
+}
+
+// Copies the test script into a container from the image and runs it as the image user in an interactive login
+// shell, so the environment matches what a user would see in a terminal
+func runFeatureTest(postProcessingConfig PostProcessingConfig, featureId string, script []byte, testCase *junitTestCase) {
+	scriptPath := featureTestScriptFolder + "/devpacker-test-" + strings.ReplaceAll(featureId, "/", "_")
+	result, err := postProcessingConfig.Options.Engine.ContainerRun(common.ContainerRunOptions{
+		Image:   postProcessingConfig.Image,
+		User:    postProcessingConfig.ImageConfig.User,
+		Command: []string{"/bin/bash", "-lic", scriptPath + " 2>&1"},
+		Files:   map[string][]byte{scriptPath: script},
+	})
+	if err != nil {
+		testCase.Error = &junitMessage{Message: err.Error()}
+		return
+	}
+	if result.ExitCode != 0 {
+		testCase.Failure = &junitMessage{Message: fmt.Sprintf("Test script exited with code %d", result.ExitCode), Content: result.Output}
+	} else {
+		testCase.SystemOut = result.Output
+	}
+}
+
+func junitSeconds(duration time.Duration) string {
+	return fmt.Sprintf("%.3f", duration.Seconds())
+}
+
+func writeJunitReport(junitPath string, report junitTestSuites) error {
+	reportBytes, err := xml.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	return common.WriteFile(junitPath, append([]byte(xml.Header), reportBytes...))
+}
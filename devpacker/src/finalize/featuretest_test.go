@@ -0,0 +1,178 @@
+package finalize
+
+import (
+	"encoding/xml"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+// Creates a feature set with test scripts for python and nodejs, but not buildpack-test
+func newTestFeatureSet(t *testing.T, version string) string {
+	t.Helper()
+	featuresPath := t.TempDir()
+	files := map[string]string{
+		common.DevpackSettingsFilename:          `{"publisher": "chuxel", "featureSet": "devcontainer-features", "version": "` + version + `"}`,
+		"devcontainer-features.json":            `{"features": [{"id": "python"}, {"id": "nodejs"}, {"id": "buildpack-test"}]}`,
+		"features/python/bin/test":              "#!/bin/bash\npython --version\n",
+		"features/nodejs/bin/test":              "#!/bin/bash\nnode --version\n",
+		"features/buildpack-test/bin/configure": "#!/bin/bash\n",
+	}
+	for filePath, content := range files {
+		fullPath := filepath.Join(featuresPath, filePath)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fullPath, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return featuresPath
+}
+
+func TestRunFeatureTests(t *testing.T) {
+	tests := []struct {
+		name              string
+		featureSetVersion string
+		runResult         func(options common.ContainerRunOptions) (common.ContainerRunResult, error)
+		expectedPassed    bool
+		expectedResults   map[string]string
+		expectedRuns      int
+	}{
+		{
+			name:              "pass and skip",
+			featureSetVersion: "v0.1.11",
+			runResult: func(options common.ContainerRunOptions) (common.ContainerRunResult, error) {
+				return common.ContainerRunResult{Output: "ok"}, nil
+			},
+			expectedPassed:  true,
+			expectedResults: map[string]string{testFeatureTest: "skipped", testFeatureNode: "passed", testFeaturePython: "passed"},
+			expectedRuns:    2,
+		},
+		{
+			name:              "fail",
+			featureSetVersion: "v0.1.11",
+			runResult: func(options common.ContainerRunOptions) (common.ContainerRunResult, error) {
+				if strings.Contains(options.Command[2], "nodejs") {
+					return common.ContainerRunResult{ExitCode: 1, Output: "node: command not found"}, nil
+				}
+				return common.ContainerRunResult{Output: "ok"}, nil
+			},
+			expectedPassed:  false,
+			expectedResults: map[string]string{testFeatureTest: "skipped", testFeatureNode: "failure", testFeaturePython: "passed"},
+			expectedRuns:    2,
+		},
+		{
+			name:              "engine error",
+			featureSetVersion: "v0.1.11",
+			runResult: func(options common.ContainerRunOptions) (common.ContainerRunResult, error) {
+				return common.ContainerRunResult{}, errors.New("Unable to create container")
+			},
+			expectedPassed:  false,
+			expectedResults: map[string]string{testFeatureTest: "skipped", testFeatureNode: "error", testFeaturePython: "error"},
+			expectedRuns:    2,
+		},
+		{
+			name:              "version mismatch runs nothing",
+			featureSetVersion: "v0.2.0",
+			expectedPassed:    false,
+			expectedResults:   map[string]string{testFeatureTest: "skipped", testFeatureNode: "skipped", testFeaturePython: "skipped"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine, _ := loadTestImageInspect(t)
+			engine.RunResult = test.runResult
+			featuresPath := newTestFeatureSet(t, test.featureSetVersion)
+			junitPath := filepath.Join(t.TempDir(), "results.xml")
+
+			passed := RunFeatureTests(testImage, featuresPath, junitPath, FinalizeOptions{Engine: engine})
+			if passed != test.expectedPassed {
+				t.Errorf("Got passed %v, expected %v", passed, test.expectedPassed)
+			}
+			if len(engine.Runs) != test.expectedRuns {
+				t.Fatalf("Got %d container runs, expected %d", len(engine.Runs), test.expectedRuns)
+			}
+			for _, run := range engine.Runs {
+				if run.User != "cnb" || len(run.Files) != 1 || run.Files[strings.TrimSuffix(run.Command[2], " 2>&1")] == nil {
+					t.Errorf("Expected the test script to be copied in and run as cnb, got %+v", run)
+				}
+			}
+
+			reportBytes, err := os.ReadFile(junitPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var report junitTestSuites
+			if err := xml.Unmarshal(reportBytes, &report); err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Suites) != 1 {
+				t.Fatalf("Got %d test suites, expected 1", len(report.Suites))
+			}
+			suite := report.Suites[0]
+			results := make(map[string]string)
+			for _, testCase := range suite.TestCases {
+				results[testCase.Name] = junitResult(testCase)
+			}
+			if !reflect.DeepEqual(results, test.expectedResults) {
+				t.Errorf("Got results %v, expected %v", results, test.expectedResults)
+			}
+			if suite.Name != testImage || suite.Tests != len(test.expectedResults) || suite.Failures != countResults(results, "failure") || suite.Errors != countResults(results, "error") || suite.Skipped != countResults(results, "skipped") {
+				t.Errorf("Suite counts do not match the test cases: %+v", suite)
+			}
+		})
+	}
+}
+
+func TestRunFeatureTestsReport(t *testing.T) {
+	engine, _ := loadTestImageInspect(t)
+	engine.RunResult = func(options common.ContainerRunOptions) (common.ContainerRunResult, error) {
+		return common.ContainerRunResult{ExitCode: 2, Output: "python: command not found"}, nil
+	}
+	junitPath := filepath.Join(t.TempDir(), "results.xml")
+	RunFeatureTests(testImage, newTestFeatureSet(t, "v0.1.11"), junitPath, FinalizeOptions{Engine: engine})
+
+	report, err := os.ReadFile(junitPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		xml.Header + "<testsuites>",
+		`<testsuite name="test_image" tests="3" failures="2" errors="0" skipped="1"`,
+		`<testcase name="chuxel/devcontainer-features/python" classname="test_image"`,
+		`<failure message="Test script exited with code 2">python: command not found</failure>`,
+		`<skipped message="Feature has no test script"></skipped>`,
+	} {
+		if !strings.Contains(string(report), expected) {
+			t.Errorf("Expected report to contain %q, got:\n%s", expected, report)
+		}
+	}
+}
+
+func junitResult(testCase junitTestCase) string {
+	switch {
+	case testCase.Skipped != nil:
+		return "skipped"
+	case testCase.Error != nil:
+		return "error"
+	case testCase.Failure != nil:
+		return "failure"
+	}
+	return "passed"
+}
+
+func countResults(results map[string]string, result string) int {
+	count := 0
+	for _, value := range results {
+		if value == result {
+			count++
+		}
+	}
+	return count
+}
@@ -3,67 +3,164 @@ package finalize
 import (
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/buildpacks/libcnb"
 	"github.com/buildpacks/lifecycle/platform"
 	"github.com/chuxel/devpacker-features/devpacker/common"
+	"github.com/google/go-containerregistry/pkg/authn"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
-const labelMetadataTemplate = "{\"layers\": {{ index .Config.Labels \"" + platform.LayerMetadataLabel + "\" }} , \"buildmode\": \"{{ index .Config.Labels \"" + common.BuildModeMetadataId + "\" }}\" , \"done\": \"{{ index .Config.Labels \"" + common.PostProcessingDoneMetadataId + "\" }}\" , \"entrypoint\": {{ json .Config.Entrypoint }} }"
-
 type LabelBuldpackLayer struct {
 	Data map[string]json.RawMessage
 }
 
-type DockerImageMetadata struct {
-	BuildMode     string                        `json:"buildmode"`
-	AlreadyDone   string                        `json:"done"`
-	LayerMetadata platform.LayersMetadataCompat `json:"layers"`
-	Entrypoint    []string                      `json:"entrypoint"`
-}
-
 type PostProcessingConfig struct {
-	Image                string
+	Image                string // Resulting image
+	SourceImage          string // Image being finalized
 	ApplicationFolder    string
 	BuildMode            string
-	AlreadyDone          string
+	AlreadyDone          map[string]PostProcessingState // Features that have already been post processed
 	LayerFeatureMetadata map[string]common.LayerFeatureMetadata
-	Entrypoint           []string
+	LayerDiffIds         map[string]string            // Feature id to the diffID of its layer
+	LayerOrder           []string                     // Feature ids in the order their layers appear in the image
+	LayerTypes           map[string]libcnb.LayerTypes // Feature id to the build, cache and launch types of its layer
+	ImageConfig          common.ImageConfig           // Config of the image being finalized
+	Options              FinalizeOptions
+}
+
+type FinalizeOptions struct {
+	BuildModeOverride   string                 // Override container image build mode: production | devcontainer
+	UpdateLock          bool                   // Replace devcontainer-lock.json rather than merging into it
+	SettingsArrayMerge  string                 // How arrays in VS Code settings are merged: replace | union | append
+	LegacyVSCode        bool                   // Output top level extensions and settings instead of customizations.vscode
+	OutputMode          string                 // How config for features in the image is output: merge | feature
+	DevContainerBuild   bool                   // Run "devcontainer build" on the generated config to add any remaining features
+	DevContainerCliPath string                 // Path to the devcontainer CLI, defaults to "devcontainer"
+	Runner              common.CommandRunner   // Runs external commands, defaults to common.ExecRunner
+	EngineName          string                 // Container engine to use if Engine is nil: docker | podman | nerdctl | buildah, detected if empty
+	DockerHost          string                 // Docker compatible API host, defaults to DOCKER_HOST or the engine default
+	Engine              common.ContainerEngine // Container engine to use, created from EngineName if nil
+	OutputImage         string                 // Where to write the finalized image, defaults to replacing the image being finalized
+	Publish             bool                   // Image references without a transport prefix are in a registry rather than the local container engine
+	Keychain            authn.Keychain         // Registry credentials, defaults to the docker config keychain
 }
 
+// Engines that support RUN --mount avoid adding a layer with a copy of post-processing.sh
+const postProcessingRunPlaceholder = "#{POST_PROCESSING_RUN}"
+const postProcessingRunWithCopy = `COPY post-processing.sh /tmp/devpacker/post-processing.sh
+RUN bash /tmp/devpacker/post-processing.sh ${POST_PROCESSING_REQUIRED} && rm -rf /tmp/devpacker`
+const postProcessingRunWithMount = `RUN --mount=type=bind,source=.,target=/tmp/devpacker bash /tmp/devpacker/post-processing.sh ${POST_PROCESSING_REQUIRED}`
+
 //go:embed assets/post-processing.sh
 var postProcessingScript []byte
 
 //go:embed assets/post-processing.Dockerfile
 var postProcessingDockerfile []byte
 
-func FinalizeImage(imageToFinalize string, buildModeOverride string, applicationFolder string) {
+// Returns the assets embedded in the finalize package by name
+func EmbeddedAssets() map[string][]byte {
+	return map[string][]byte{
+		"post-processing.sh":         postProcessingScript,
+		"post-processing.Dockerfile": postProcessingDockerfile,
+	}
+}
+
+func FinalizeImage(imageToFinalize string, applicationFolder string, options FinalizeOptions) {
 	log.Println("Image to finalize:", imageToFinalize)
 	log.Println("Application folder:", applicationFolder)
+	if options.OutputMode == "" {
+		options.OutputMode = OutputModeMerge
+	} else if options.OutputMode != OutputModeMerge && options.OutputMode != OutputModeFeature {
+		log.Fatal("Invalid output mode: ", options.OutputMode)
+	}
+
+	if options.Keychain == nil {
+		options.Keychain = authn.DefaultKeychain
+	}
+
+	// Images in a registry, OCI layout, or tarball are post processed without a container engine, which is only
+	// needed to run feature configure scripts
+	defaultTransport := TransportDaemon
+	if options.Publish {
+		defaultTransport = TransportRegistry
+	}
+	imageRef := ParseImageReference(imageToFinalize, defaultTransport)
+	outputImageRef := imageRef
+	if options.OutputImage != "" {
+		outputImageRef = ParseImageReference(options.OutputImage, defaultTransport)
+		log.Println("Output image:", outputImageRef.String())
+	}
+	if imageRef.IsDaemon() != outputImageRef.IsDaemon() {
+		log.Fatal("The image to finalize and the output image must either both be in the local container engine or both be elsewhere. Use --publish to finalize and publish images in a registry.")
+	}
+	var image v1.Image
+	var imageInspect common.ImageInspect
+	var err error
+	if imageRef.IsDaemon() {
+		if options.Engine == nil {
+			if options.Engine, err = common.NewContainerEngine(options.EngineName, options.DockerHost, options.Runner); err != nil {
+				log.Fatal("Failed to connect to container engine: ", err)
+			}
+		}
+		log.Println("Container engine:", options.Engine.Name())
+		imageInspect, err = options.Engine.ImageInspect(imageRef.Reference)
+	} else {
+		if options.DevContainerBuild {
+			log.Fatal("Using the devcontainer CLI requires an image in the local container engine.")
+		}
+		if image, err = loadImage(imageRef, options.Keychain); err == nil {
+			imageInspect, err = inspectImage(image)
+		}
+	}
+	if err != nil {
+		log.Fatal("Failed to inspect image ", imageToFinalize, ": ", err)
+	}
 
 	// Get needed metadata from image label
-	postProcessingConfig := newPostProcessingConfig(imageToFinalize, buildModeOverride, applicationFolder)
+	postProcessingConfig := newPostProcessingConfig(imageRef.ImageName(), imageInspect, applicationFolder, options)
+	postProcessingConfig.Image = outputImageRef.ImageName()
 	log.Println("Image build mode:", postProcessingConfig.BuildMode)
 
 	// Execute post processing where required
-	log.Println("Starting post processing. Already complete for: ", postProcessingConfig.AlreadyDone)
-	executePostProcessing(postProcessingConfig)
+	log.Println("Starting post processing. Already complete for:", strings.Join(postProcessingStateIds(postProcessingConfig.AlreadyDone), " "))
+	if imageRef.IsDaemon() {
+		executePostProcessing(postProcessingConfig)
+	} else {
+		if image, err = executeDaemonlessPostProcessing(postProcessingConfig, image); err != nil {
+			log.Fatal("Failed to post process image: ", err)
+		}
+		log.Println("Writing post processed image to", outputImageRef.String())
+		if err = saveImage(outputImageRef, image, options.Keychain); err != nil {
+			log.Fatal("Failed to write post processed image: ", err)
+		}
+	}
 
 	// Create devcontainer.json and finalizer feature
-	createDevContainerJson(postProcessingConfig)
+	devContainerJsonPath := createDevContainerJson(postProcessingConfig)
 
-	/* TODO: Chain call to devcontainer CLI when it works without pulling an image
-	log.Println("Calling devcontainer CLI to add remaining container features to image.")
-	devContainerImageBuild(imageToFinalize, targetDevContainerJsonPath, devContainerJsonPath)
-	*/
+	// Record resolved feature option values
+	updateLockFile(postProcessingConfig, devContainerJsonPath)
+
+	if options.DevContainerBuild {
+		log.Println("Calling devcontainer CLI to add remaining container features to image.")
+		if err := devContainerImageBuild(postProcessingConfig, devContainerJsonPath); err != nil {
+			log.Fatal("Failed to build using devcontainer CLI: ", err)
+		}
+	}
 }
 
-func createDevContainerJson(postProcessingConfig PostProcessingConfig) {
+// Creates a devcontainer.json.devpack file, returns the path to the devcontainer.json it is based on
+func createDevContainerJson(postProcessingConfig PostProcessingConfig) string {
 	// Get devcontainer.json as a map so we don't change any fields unexpectedly
 	devContainerJsonMap := make(map[string]json.RawMessage)
 	featureOptionSelections := make(map[string]interface{})
@@ -92,37 +189,20 @@ func createDevContainerJson(postProcessingConfig PostProcessingConfig) {
 	}
 
 	// Determine and create target folder paths
-	targetFolder := postProcessingConfig.ApplicationFolder
 	if devContainerJsonPath == "" {
-		targetFolder = filepath.Join(postProcessingConfig.ApplicationFolder, ".devcontainer")
-		devContainerJsonPath = filepath.Join(targetFolder, "devcontainer.json")
-		if err := os.MkdirAll(targetFolder, 0755); err != nil {
-			log.Fatal("Failed to create target folder: ", err)
-		}
-	} else {
-		//targetFolder = filepath.Dir(devContainerJsonPath)
+		devContainerJsonPath = filepath.Join(postProcessingConfig.ApplicationFolder, ".devcontainer", "devcontainer.json")
 	}
-
-	// TODO: Use a feature instead of devcontainer.json merge once you can reference a local feature
-	devContainerJsonMap = mergeFeatureConfigToDevContainerJson(postProcessingConfig, devContainerJsonMap)
-
-	/* TODO: Use a feature instead of devcontainer.json merge once you can reference a local feature
-
-	// Generate union of config for steps that have already been added to the image, output generated feature to target folder
-	finalizeFeaturesJson := FeaturesJson{[]FeatureConfig{generateFinalizeFeatureConfig(layerFeatureMetadataMap)}}
-	finalizeFeaturesJsonBytes, err := json.MarshalIndent(&finalizeFeaturesJson, "", "\t")
-	if err != nil {
-		log.Fatal("Failed to marshal finalizeFeaturesJson to json.RawMessage: ", err)
+	targetFolder := filepath.Dir(devContainerJsonPath)
+	if err := os.MkdirAll(targetFolder, 0755); err != nil {
+		log.Fatal("Failed to create target folder: ", err)
 	}
-	finalizeFeatureTargetFolder := filepath.Join(targetFolder, "devpack-config")
-	if err := os.MkdirAll(finalizeFeatureTargetFolder, 0755); err != nil {
-		log.Fatal("Failed to create finalizer feature target folder: ", err)
+
+	// Either reference a generated local feature with the config for features already in the image, or merge it in
+	if postProcessingConfig.Options.OutputMode == OutputModeFeature {
+		featureOptionSelections[createFinalizeFeature(postProcessingConfig, devContainerJsonPath)] = map[string]interface{}{}
+	} else {
+		devContainerJsonMap = mergeFeatureConfigToDevContainerJson(postProcessingConfig, devContainerJsonMap)
 	}
-	log.Println("Writing out updated related finalize feature to:", finalizeFeatureTargetFolder)
-	WriteFile(filepath.Join(finalizeFeatureTargetFolder, "devcontainer-features.json"), finalizeFeaturesJsonBytes)
-	WriteFile(filepath.Join(finalizeFeatureTargetFolder, "install.sh"), []byte("exit 0"))
-	featureOptionSelections["./devpack-config#finalize"] = "latest"
-	*/
 
 	// Convert feature map back into a RawMessage, and add it back into the devcontainer json object
 	featureRawMessage, err := json.Marshal(featureOptionSelections)
@@ -130,10 +210,14 @@ func createDevContainerJson(postProcessingConfig PostProcessingConfig) {
 		log.Fatal("Failed to marshal devContainerJsonFeatureMap to json.RawMessage: ", err)
 	}
 	devContainerJsonMap["features"] = featureRawMessage
-	devContainerJsonMap["image"] = common.ToJsonRawMessage(postProcessingConfig.Image)
+	if isDockerComposeConfig(devContainerJsonMap) {
+		devContainerJsonMap = addDockerComposeOverride(postProcessingConfig, devContainerJsonMap, targetFolder)
+	} else {
+		devContainerJsonMap["image"] = common.ToJsonRawMessage(postProcessingConfig.Image)
+	}
 	devContainerJsonMap["userEnvProbe"] = common.ToJsonRawMessage("loginInteractiveShell")
-	delete(devContainerJsonMap, "build")
-	delete(devContainerJsonMap, "dockerComposeFile")
+	devContainerJsonMap = addUserProperties(postProcessingConfig, devContainerJsonMap)
+	devContainerJsonMap = replaceBuildProperty(devContainerJsonMap)
 
 	// Encode json content and write it to a file
 	updatedDevContainerJsonBytes, err := json.MarshalIndent(devContainerJsonMap, "", "\t")
@@ -145,12 +229,71 @@ func createDevContainerJson(postProcessingConfig PostProcessingConfig) {
 	if err := common.WriteFile(targetDevContainerJsonPath, updatedDevContainerJsonBytes); err != nil {
 		log.Fatal("Failed to write updated devcontainer.json file: ", err)
 	}
+	return devContainerJsonPath
 }
 
-func generateFinalizeFeatureConfig(postProcessingConfig PostProcessingConfig) common.FeatureConfig {
-	finalizeFeatureConfig := common.FeatureConfig{Id: "finalize"}
-	// Merge in remaining config from features already in the image
-	for _, layerFeatureMetadata := range postProcessingConfig.LayerFeatureMetadata {
+// The image replaces any Dockerfile in the build property, but the build args the image was built with are kept.
+// Tools only build a Dockerfile if build.dockerfile is set, so this does not change how the image is used.
+func replaceBuildProperty(devContainerJsonMap map[string]json.RawMessage) map[string]json.RawMessage {
+	var build common.DevContainerJsonBuild
+	if devContainerJsonMap["build"] != nil {
+		if err := json.Unmarshal(devContainerJsonMap["build"], &build); err != nil {
+			log.Fatal("Failed to unmarshal build from devcontainer.json: ", err)
+		}
+	}
+	delete(devContainerJsonMap, "build")
+	if len(build.Args) > 0 {
+		devContainerJsonMap["build"] = common.ToJsonRawMessage(common.DevContainerJsonBuild{Args: build.Args})
+	}
+	return devContainerJsonMap
+}
+
+// Records the requested and resolved option values for each feature in the image in the lock file next to devcontainer.json
+// Writes the lock file next to devcontainer.json. Skipped in production mode or if the application has no
+// devcontainer.json, so no lock file ends up in a repository that does not use one.
+func updateLockFile(postProcessingConfig PostProcessingConfig, devContainerJsonPath string) {
+	if postProcessingConfig.BuildMode != "devcontainer" {
+		log.Println("Skipping lock file since build mode is", postProcessingConfig.BuildMode)
+		return
+	}
+	if _, err := os.Stat(devContainerJsonPath); err != nil {
+		log.Println("Skipping lock file since there is no devcontainer.json at", devContainerJsonPath)
+		return
+	}
+	lockFilePath := common.LockFilePath(devContainerJsonPath)
+	lock := common.DevContainerLock{Features: make(map[string]common.FeatureLock)}
+	if !postProcessingConfig.Options.UpdateLock {
+		lock.LoadFile(lockFilePath)
+	}
+	for featureId, layerFeatureMetadata := range postProcessingConfig.LayerFeatureMetadata {
+		featureLock := common.FeatureLock{
+			Version:  layerFeatureMetadata.Version,
+			Options:  make(map[string]string),
+			Resolved: make(map[string]string),
+		}
+		for optionId, selection := range layerFeatureMetadata.OptionSelections {
+			if !layerFeatureMetadata.Config.Options[optionId].Secret {
+				featureLock.Options[optionId] = selection
+			}
+		}
+		for optionId, value := range layerFeatureMetadata.ResolvedOptions {
+			featureLock.Resolved[optionId] = value
+		}
+		lock.Features[featureId] = featureLock
+	}
+	log.Println("Writing out lock file:", lockFilePath)
+	if err := lock.Save(lockFilePath); err != nil {
+		log.Fatal("Failed to write lock file: ", err)
+	}
+}
+
+func generateFinalizeFeatureConfig(postProcessingConfig PostProcessingConfig, settingsMerger *settingsMerger) common.FeatureConfig {
+	finalizeFeatureConfig := common.FeatureConfig{Id: FinalizeFeatureId}
+	var extensions []string
+	settings := make(map[string]interface{})
+	// Merge in remaining config from features already in the image in layer order, so features installed later win
+	for _, featureId := range postProcessingConfig.LayerOrder {
+		layerFeatureMetadata := postProcessingConfig.LayerFeatureMetadata[featureId]
 		// Merge flags
 		finalizeFeatureConfig.Privileged = finalizeFeatureConfig.Privileged || layerFeatureMetadata.Config.Privileged
 		finalizeFeatureConfig.Init = finalizeFeatureConfig.Init || layerFeatureMetadata.Config.Init
@@ -158,36 +301,96 @@ func generateFinalizeFeatureConfig(postProcessingConfig PostProcessingConfig) co
 		// Merge string arrays
 		finalizeFeatureConfig.CapAdd = common.SliceUnion(finalizeFeatureConfig.CapAdd, layerFeatureMetadata.Config.CapAdd)
 		finalizeFeatureConfig.SecurityOpt = common.SliceUnion(finalizeFeatureConfig.SecurityOpt, layerFeatureMetadata.Config.SecurityOpt)
-		finalizeFeatureConfig.Extensions = common.SliceUnion(finalizeFeatureConfig.Extensions, layerFeatureMetadata.Config.Extensions)
+		extensions = common.SliceUnion(extensions, layerFeatureMetadata.Config.VSCodeExtensions())
 
 		// Merge VS Code settings
-		if finalizeFeatureConfig.Settings == nil {
-			finalizeFeatureConfig.Settings = make(map[string]interface{})
+		settingsMerger.mergeFeatureSettings(settings, layerFeatureMetadata.Config.VSCodeSettings(), featureId)
+		// Merge mount points, first feature to use a target wins
+		var skippedMounts []common.FeatureMount
+		finalizeFeatureConfig.Mounts, skippedMounts = common.AddMountsIfUniqueTarget(finalizeFeatureConfig.Mounts, layerFeatureMetadata.Config.Mounts...)
+		for _, skippedMount := range skippedMounts {
+			log.Printf("Skipping mount \"%s\" from %s. Another feature already mounts to %s.", skippedMount, featureId, skippedMount.Target)
 		}
-		for key, value := range layerFeatureMetadata.Config.Settings {
-			finalizeFeatureConfig.Settings[key] = value
-		}
-		// Merge mount points
-		for _, newMount := range layerFeatureMetadata.Config.Mounts {
-			shouldAdd := true
-			for _, mount := range finalizeFeatureConfig.Mounts {
-				if mount.Source == newMount.Source && mount.Target == newMount.Target && mount.Type == newMount.Type {
-					shouldAdd = false
-					break
-				}
-			}
-			if shouldAdd {
-				layerFeatureMetadata.Config.Mounts = append(layerFeatureMetadata.Config.Mounts, newMount)
+
+		// Merge containerEnv
+		for varName, varValue := range layerFeatureMetadata.Config.ContainerEnv {
+			if finalizeFeatureConfig.ContainerEnv == nil {
+				finalizeFeatureConfig.ContainerEnv = make(map[string]string)
 			}
+			finalizeFeatureConfig.ContainerEnv[varName] = varValue
 		}
 	}
-	// Add required version option (not used)
-	finalizeFeatureConfig.Options = map[string]common.FeatureOption{
-		"version": {Type: "string", Enum: []string{"latest"}, Default: "latest", Description: "Not used."},
+	finalizeFeatureConfig.SetVSCodeCustomizations(extensions, settings, postProcessingConfig.Options.LegacyVSCode)
+
+	// Lifecycle hooks run one after another in layer order rather than in parallel
+	for _, hook := range common.LifecycleHooks {
+		if commands := featureLifecycleCommands(postProcessingConfig, hook); !commands.IsEmpty() {
+			finalizeFeatureConfig.SetLifecycleCommand(hook, commands.Sequential())
+		}
 	}
 	return finalizeFeatureConfig
 }
 
+func sortedFeatureIds(postProcessingConfig PostProcessingConfig) []string {
+	featureIds := make([]string, 0, len(postProcessingConfig.LayerFeatureMetadata))
+	for featureId := range postProcessingConfig.LayerFeatureMetadata {
+		featureIds = append(featureIds, featureId)
+	}
+	sort.Strings(featureIds)
+	return featureIds
+}
+
+// Sorts feature ids by the position of their layer in the image. Features whose layer cannot be found go last.
+func featureIdsInLayerOrder(postProcessingConfig PostProcessingConfig, imageLayers []string) []string {
+	layerPositions := make(map[string]int)
+	for position, diffId := range imageLayers {
+		layerPositions[diffId] = position
+	}
+	featureIds := sortedFeatureIds(postProcessingConfig)
+	sort.SliceStable(featureIds, func(i, j int) bool {
+		positionI, foundI := layerPositions[postProcessingConfig.LayerDiffIds[featureIds[i]]]
+		positionJ, foundJ := layerPositions[postProcessingConfig.LayerDiffIds[featureIds[j]]]
+		if foundI != foundJ {
+			return foundI
+		}
+		return positionI < positionJ
+	})
+	return featureIds
+}
+
+// Returns the sorted ids of features that are new or whose layer changed since it was post processed, and the
+// updated post processing state. Logs the features that changed.
+func featuresToPostProcess(postProcessingConfig PostProcessingConfig) ([]string, map[string]PostProcessingState) {
+	featuresToProcess, changedFeatures, state := comparePostProcessingState(postProcessingConfig)
+	for _, featureId := range changedFeatures {
+		log.Println("Feature", featureId, "changed since it was post processed. Processing it again.")
+	}
+	return featuresToProcess, state
+}
+
+// Compares feature layers with the state recorded when they were post processed. Returns the sorted ids of features
+// that need post processing, the ids of those that were post processed before but changed since, and the updated
+// state. State is only kept for features in the image so it does not grow over time.
+func comparePostProcessingState(postProcessingConfig PostProcessingConfig) ([]string, []string, map[string]PostProcessingState) {
+	var featuresToProcess []string
+	var changedFeatures []string
+	state := make(map[string]PostProcessingState)
+	for _, featureId := range sortedFeatureIds(postProcessingConfig) {
+		currentState := newPostProcessingState(postProcessingConfig, featureId)
+		if previousState, processed := postProcessingConfig.AlreadyDone[featureId]; processed {
+			if previousState.Matches(currentState) {
+				// Record the full state for features that were only in the legacy done label
+				state[featureId] = currentState
+				continue
+			}
+			changedFeatures = append(changedFeatures, featureId)
+		}
+		featuresToProcess = append(featuresToProcess, featureId)
+		state[featureId] = currentState
+	}
+	return featuresToProcess, changedFeatures, state
+}
+
 func executePostProcessing(postProcessingConfig PostProcessingConfig) {
 	var err error
 	tempDir := filepath.Join(os.TempDir(), strconv.FormatInt(rand.Int63(), 36))
@@ -201,31 +404,34 @@ func executePostProcessing(postProcessingConfig PostProcessingConfig) {
 	}
 
 	// Append any needed post-processing steps to dockerfile
-	postProcessingDockerfileModified := postProcessingDockerfile
-	postProcessingRequired := ""
-	postProcessingChecker := " " + postProcessingConfig.AlreadyDone + " "
-	for featureId, layerFeatureMetadata := range postProcessingConfig.LayerFeatureMetadata {
-		postProcessingFeatureString := " " + featureId + " "
-		if !strings.Contains(postProcessingChecker, postProcessingFeatureString) {
-			postProcessingRequired += featureId + " "
-			postProcessingConfig.AlreadyDone += featureId + " "
-			// Apply post processing for containerEnv
-			for varName, varValue := range layerFeatureMetadata.Config.ContainerEnv {
-				envVarSnippet := "\nENV " + varName + "=" + varValue
-				postProcessingDockerfileModified = append(postProcessingDockerfileModified, []byte(envVarSnippet)...)
-			}
+	postProcessingRun := postProcessingRunWithCopy
+	if postProcessingConfig.Options.Engine.SupportsBuildMounts() {
+		postProcessingRun = postProcessingRunWithMount
+	}
+	postProcessingDockerfileModified := []byte(strings.Replace(string(postProcessingDockerfile), postProcessingRunPlaceholder, postProcessingRun, 1))
+	featuresToProcess, postProcessingState := featuresToPostProcess(postProcessingConfig)
+	postProcessingRequired := strings.Join(featuresToProcess, " ")
+	for _, featureId := range featuresToProcess {
+		// Apply post processing for containerEnv
+		containerEnv := postProcessingConfig.LayerFeatureMetadata[featureId].Config.ContainerEnv
+		for _, varName := range sortedKeys(containerEnv) {
+			envVarSnippet := "\nENV " + varName + "=" + dockerfileQuote(containerEnv[varName])
+			postProcessingDockerfileModified = append(postProcessingDockerfileModified, []byte(envVarSnippet)...)
 		}
 	}
-	postProcessingConfig.AlreadyDone = strings.TrimSpace(postProcessingConfig.AlreadyDone)
 
-	// Append update entrypoint in Dockerfile if required
-	if !common.SliceContainsString(postProcessingConfig.Entrypoint, common.CommonEntrypointDBootstrapPath) {
-		postProcessingDockerfileModified = append(postProcessingDockerfileModified, []byte("\n\nENTRYPOINT [\""+common.CommonEntrypointDBootstrapPath+"\"")...)
-		for _, argument := range postProcessingConfig.Entrypoint {
-			argument = strings.ReplaceAll(argument, "\"", "\\\"")
-			postProcessingDockerfileModified = append(postProcessingDockerfileModified, []byte(",\""+argument+"\"")...)
+	// Restore the original user since post processing runs as root. Setting ENTRYPOINT resets CMD, so restore it too.
+	imageConfig := postProcessingConfig.ImageConfig
+	originalUser := imageConfig.User
+	if originalUser == "" {
+		originalUser = "root"
+	}
+	postProcessingDockerfileModified = append(postProcessingDockerfileModified, []byte("\n\nUSER "+originalUser)...)
+	if entrypoint := wrapEntrypoint(imageConfig.Entrypoint); !reflect.DeepEqual(entrypoint, imageConfig.Entrypoint) {
+		postProcessingDockerfileModified = append(postProcessingDockerfileModified, []byte("\nENTRYPOINT "+dockerfileJsonArray(entrypoint))...)
+		if len(imageConfig.Cmd) > 0 {
+			postProcessingDockerfileModified = append(postProcessingDockerfileModified, []byte("\nCMD "+dockerfileJsonArray(imageConfig.Cmd))...)
 		}
-		postProcessingDockerfileModified = append(postProcessingDockerfileModified, []byte("]")...)
 	}
 
 	dockerFilePath := filepath.Join(tempDir, "Dockerfile")
@@ -233,102 +439,111 @@ func executePostProcessing(postProcessingConfig PostProcessingConfig) {
 		log.Fatal("Failed to write Dockerfile: ", err)
 	}
 
-	common.DockerCli(tempDir, false, "build",
-		"--no-cache",
-		"--build-arg", "IMAGE_NAME="+postProcessingConfig.Image,
-		"--build-arg", "POST_PROCESSING_REQUIRED="+postProcessingRequired,
-		"--build-arg", "POST_PROCESSING_DONE="+postProcessingConfig.AlreadyDone,
-		"-t", postProcessingConfig.Image,
-		"-f", dockerFilePath, ".")
+	err = buildPostProcessedImage(postProcessingConfig, featuresToProcess, common.ImageBuildOptions{
+		ContextDir: tempDir,
+		Dockerfile: filepath.Base(dockerFilePath),
+		NoCache:    true,
+		Tag:        "devpacker-post-processing:" + filepath.Base(tempDir),
+		BuildArgs: map[string]string{
+			"IMAGE_NAME":               postProcessingConfig.SourceImage,
+			"POST_PROCESSING_REQUIRED": postProcessingRequired,
+			"POST_PROCESSING_DONE":     strings.Join(postProcessingStateIds(postProcessingState), " "),
+			"POST_PROCESSING_STATE":    postProcessingStateLabel(postProcessingState),
+			"DEVCONTAINER_METADATA":    devContainerMetadataLabel(postProcessingConfig),
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	if err = os.RemoveAll(tempDir); err != nil {
 		log.Fatal("Failed to remove temp directory: ", err)
 	}
 }
 
-// Inspect the specified image and create a new instance of PostProcessingConfig
-func newPostProcessingConfig(imageToFinalize string, buildModeOverride string, applicationFolder string) PostProcessingConfig {
-	// Use docker inspect to get metadata
-	var dockerImageMetadata DockerImageMetadata
-	inspectJsonBytes := common.DockerCli("", true, "image", "inspect", imageToFinalize, "-f", labelMetadataTemplate)
-	if len(inspectJsonBytes) > 0 && string(inspectJsonBytes) != "" {
-		if err := json.Unmarshal(inspectJsonBytes, &dockerImageMetadata); err != nil {
+// Builds the post processed image under the temporary tag in buildOptions and only tags it as the resulting image
+// once its config is verified, so a failed build or verification never leaves a broken image under the user's tag
+func buildPostProcessedImage(postProcessingConfig PostProcessingConfig, featuresToProcess []string, buildOptions common.ImageBuildOptions) error {
+	engine := postProcessingConfig.Options.Engine
+	if err := engine.ImageBuild(buildOptions); err != nil {
+		return errors.New("Failed to build post processed image: " + err.Error())
+	}
+	defer func() {
+		if err := engine.ImageRemove(buildOptions.Tag); err != nil {
+			log.Println("Warning: Unable to remove", buildOptions.Tag+":", err)
+		}
+	}()
+	resultInspect, err := engine.ImageInspect(buildOptions.Tag)
+	if err != nil {
+		return errors.New("Failed to inspect post processed image: " + err.Error())
+	}
+	if err := verifyPostProcessedImage(postProcessingConfig, featuresToProcess, resultInspect.Config); err != nil {
+		return err
+	}
+	if err := engine.ImageTag(buildOptions.Tag, postProcessingConfig.Image); err != nil {
+		return errors.New("Failed to tag post processed image as " + postProcessingConfig.Image + ": " + err.Error())
+	}
+	return nil
+}
+
+// Create a new instance of PostProcessingConfig from metadata in the image's labels
+func newPostProcessingConfig(imageToFinalize string, imageInspect common.ImageInspect, applicationFolder string, options FinalizeOptions) PostProcessingConfig {
+	labels := imageInspect.Config.Labels
+	var layersMetadata platform.LayersMetadataCompat
+	if layersMetadataJson := labels[platform.LayerMetadataLabel]; layersMetadataJson != "" {
+		if err := json.Unmarshal([]byte(layersMetadataJson), &layersMetadata); err != nil {
 			log.Println("Unable to process feature metadata in image. Assuming no post processing is required.")
 		}
 	}
 
 	postProcessingConfig := PostProcessingConfig{
 		Image:             imageToFinalize,
-		BuildMode:         dockerImageMetadata.BuildMode,
-		AlreadyDone:       dockerImageMetadata.AlreadyDone,
+		SourceImage:       imageToFinalize,
+		BuildMode:         labels[common.BuildModeMetadataId],
+		AlreadyDone:       loadPostProcessingState(labels),
 		ApplicationFolder: applicationFolder,
-		Entrypoint:        dockerImageMetadata.Entrypoint,
+		ImageConfig:       imageInspect.Config,
+		Options:           options,
 	}
 
 	// Set build mode
-	if buildModeOverride != "" {
-		postProcessingConfig.BuildMode = buildModeOverride
-	} else if dockerImageMetadata.BuildMode == "" {
+	if options.BuildModeOverride != "" {
+		postProcessingConfig.BuildMode = options.BuildModeOverride
+	} else if postProcessingConfig.BuildMode == "" {
 		// If no override, and we didn't get a value off of the image, then use the default
 		postProcessingConfig.BuildMode = common.DefaultContainerImageBuildMode
 	}
 
 	// Convert feature metadata to map of LayerFeatureMetadata structs
 	postProcessingConfig.LayerFeatureMetadata = make(map[string]common.LayerFeatureMetadata)
-	if dockerImageMetadata.LayerMetadata.Buildpacks != nil {
-		for _, buildpackMetadata := range dockerImageMetadata.LayerMetadata.Buildpacks {
+	postProcessingConfig.LayerDiffIds = make(map[string]string)
+	postProcessingConfig.LayerTypes = make(map[string]libcnb.LayerTypes)
+	if layersMetadata.Buildpacks != nil {
+		for _, buildpackMetadata := range layersMetadata.Buildpacks {
 			for _, buildpackLayerMetadata := range buildpackMetadata.Layers {
 				if buildpackLayerMetadata.Data != nil {
 					// Cast so we can use it
 					data := buildpackLayerMetadata.Data.(map[string]interface{})
 					if _, hasKey := data[common.FeatureLayerMetadataId]; hasKey {
 						// Convert interface to struct
-						featureMetadata := common.LayerFeatureMetadata{}
-						featureMetadata.SetProperties(data[common.FeatureLayerMetadataId].(map[string]interface{}))
+						featureMetadata, err := common.DecodeLayerFeatureMetadata(data[common.FeatureLayerMetadataId])
+						if err != nil {
+							log.Fatal("Failed to read feature metadata in image: ", err)
+						}
 						postProcessingConfig.LayerFeatureMetadata[featureMetadata.Id] = featureMetadata
+						postProcessingConfig.LayerDiffIds[featureMetadata.Id] = buildpackLayerMetadata.SHA
+						postProcessingConfig.LayerTypes[featureMetadata.Id] = libcnb.LayerTypes{
+							Build:  buildpackLayerMetadata.Build,
+							Launch: buildpackLayerMetadata.Launch,
+							Cache:  buildpackLayerMetadata.Cache,
+						}
 					}
 
 				}
 			}
 		}
 	}
+	postProcessingConfig.LayerOrder = featureIdsInLayerOrder(postProcessingConfig, imageInspect.RootFS.Layers)
 
 	return postProcessingConfig
 }
-
-/* TODO: Uncomment once you can use the devcontainer CI without pulling an image
-
-func devContainerImageBuild(imageToFinalize string, tempDevContainerJsonPath string, originalDevContainerJsonPath string) {
-	workingDir := filepath.Dir(tempDevContainerJsonPath)
-
-	// Rename files so temp devcontainer.json is used
-	if err := os.Rename(originalDevContainerJsonPath, originalDevContainerJsonPath+".orig"); err != nil {
-		log.Fatal(err)
-	}
-	if err := os.Rename(tempDevContainerJsonPath, originalDevContainerJsonPath); err != nil {
-		log.Fatal(err)
-	}
-
-	// Invoke dev container CLI
-	dockerCommand := exec.Command("devcontainer", "build", "--image-name", imageToFinalize)
-	dockerCommand.Env = os.Environ()
-	writer := log.Writer()
-	dockerCommand.Stdout = writer
-	dockerCommand.Stderr = writer
-	dockerCommand.Dir = workingDir
-	commandErr := dockerCommand.Run()
-
-	// Rename files back
-	if err := os.Rename(originalDevContainerJsonPath, tempDevContainerJsonPath); err != nil {
-		log.Fatal(err)
-	}
-	if err := os.Rename(originalDevContainerJsonPath+".orig", originalDevContainerJsonPath); err != nil {
-		log.Fatal(err)
-	}
-
-	// Report command error if there was one
-	if commandErr != nil || dockerCommand.ProcessState.ExitCode() != 0 {
-		log.Fatal("Failed to build using devcontainer CLI: " + commandErr.Error())
-	}
-}
-*/
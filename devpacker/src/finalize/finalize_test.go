@@ -0,0 +1,273 @@
+package finalize
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/buildpacks/libcnb"
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+const (
+	testImage         = "test_image"
+	testFeaturePython = "chuxel/devcontainer-features/python"
+	testFeatureNode   = "chuxel/devcontainer-features/nodejs"
+	testFeatureTest   = "chuxel/devcontainer-features/buildpack-test"
+)
+
+// Returns the recorded "docker image inspect" output of an image built with three features, with its labels copied
+// so tests can change them
+func loadTestImageInspect(t *testing.T) (*common.ReplayEngine, common.ImageInspect) {
+	t.Helper()
+	engine, err := common.NewReplayEngineFromFile(filepath.Join("testdata", "devpack-image-inspect.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageInspect, err := engine.ImageInspect(testImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := make(map[string]string)
+	for label, value := range imageInspect.Config.Labels {
+		labels[label] = value
+	}
+	imageInspect.Config.Labels = labels
+	return engine, imageInspect
+}
+
+func TestNewPostProcessingConfig(t *testing.T) {
+	engine, imageInspect := loadTestImageInspect(t)
+	postProcessingConfig := newPostProcessingConfig(testImage, imageInspect, "/workspace", FinalizeOptions{Engine: engine})
+
+	if postProcessingConfig.BuildMode != "devcontainer" {
+		t.Errorf("Got build mode %q, expected devcontainer", postProcessingConfig.BuildMode)
+	}
+	if postProcessingConfig.ImageConfig.User != "cnb" {
+		t.Errorf("Got user %q, expected cnb", postProcessingConfig.ImageConfig.User)
+	}
+	expectedOrder := []string{testFeatureTest, testFeatureNode, testFeaturePython}
+	if !reflect.DeepEqual(postProcessingConfig.LayerOrder, expectedOrder) {
+		t.Errorf("Got layer order %v, expected %v", postProcessingConfig.LayerOrder, expectedOrder)
+	}
+	expectedDiffIds := map[string]string{testFeatureTest: "sha256:1c1c", testFeatureNode: "sha256:2b2b", testFeaturePython: "sha256:3a3a"}
+	if !reflect.DeepEqual(postProcessingConfig.LayerDiffIds, expectedDiffIds) {
+		t.Errorf("Got layer diff ids %v, expected %v", postProcessingConfig.LayerDiffIds, expectedDiffIds)
+	}
+	if layerTypes := postProcessingConfig.LayerTypes[testFeatureNode]; layerTypes != (libcnb.LayerTypes{Build: true, Launch: true, Cache: true}) {
+		t.Errorf("Got layer types %+v for %s", layerTypes, testFeatureNode)
+	}
+
+	python := postProcessingConfig.LayerFeatureMetadata[testFeaturePython]
+	node := postProcessingConfig.LayerFeatureMetadata[testFeatureNode]
+	if python.Version != "v0.1.11" || python.OptionSelections["version"] != "3.10" || python.ResolvedOptions["version"] != "3.10.4" {
+		t.Errorf("Unexpected python metadata %+v", python)
+	}
+	if optionsDigest(python) != python.OptionsDigest || optionsDigest(node) == "" {
+		t.Errorf("Expected the salted options digest to be used when the layer has one")
+	}
+	if python.Config.ContainerEnv["PYTHON_PATH"] != "/layers/chuxel_devcontainer-features/python/bin" {
+		t.Errorf("Unexpected python containerEnv %v", python.Config.ContainerEnv)
+	}
+	if expected := []common.FeatureMount{{Source: "node-cache", Target: "/home/cnb/.npm", Type: "volume"}}; !reflect.DeepEqual(node.Config.Mounts, expected) {
+		t.Errorf("Got nodejs mounts %+v, expected %+v", node.Config.Mounts, expected)
+	}
+	if !postProcessingConfig.LayerFeatureMetadata[testFeatureTest].Config.Privileged {
+		t.Errorf("Expected %s to be privileged", testFeatureTest)
+	}
+
+	expectedDone := map[string]PostProcessingState{testFeatureNode: {Id: testFeatureNode, Legacy: true}}
+	if !reflect.DeepEqual(postProcessingConfig.AlreadyDone, expectedDone) {
+		t.Errorf("Got already done %+v, expected %+v", postProcessingConfig.AlreadyDone, expectedDone)
+	}
+}
+
+func TestNewPostProcessingConfigBuildMode(t *testing.T) {
+	engine, imageInspect := loadTestImageInspect(t)
+	postProcessingConfig := newPostProcessingConfig(testImage, imageInspect, "", FinalizeOptions{Engine: engine, BuildModeOverride: "production"})
+	if postProcessingConfig.BuildMode != "production" {
+		t.Errorf("Got build mode %q, expected the override", postProcessingConfig.BuildMode)
+	}
+
+	delete(imageInspect.Config.Labels, common.BuildModeMetadataId)
+	postProcessingConfig = newPostProcessingConfig(testImage, imageInspect, "", FinalizeOptions{Engine: engine})
+	if postProcessingConfig.BuildMode != common.DefaultContainerImageBuildMode {
+		t.Errorf("Got build mode %q, expected the default", postProcessingConfig.BuildMode)
+	}
+}
+
+func TestFeaturesToPostProcess(t *testing.T) {
+	engine, imageInspect := loadTestImageInspect(t)
+	finalized := newPostProcessingConfig(testImage, imageInspect, "", FinalizeOptions{Engine: engine})
+	finalizedState := make(map[string]PostProcessingState)
+	for _, featureId := range finalized.LayerOrder {
+		finalizedState[featureId] = newPostProcessingState(finalized, featureId)
+	}
+	changedState := make(map[string]PostProcessingState)
+	for featureId, featureState := range finalizedState {
+		changedState[featureId] = featureState
+	}
+	changedPython := changedState[testFeaturePython]
+	changedPython.LayerDiffId = "sha256:0000"
+	changedState[testFeaturePython] = changedPython
+	changedOptionsState := make(map[string]PostProcessingState)
+	for featureId, featureState := range finalizedState {
+		changedOptionsState[featureId] = featureState
+	}
+	changedOptionsPython := changedOptionsState[testFeaturePython]
+	changedOptionsPython.OptionsDigest = "sha256:0f0f:0000"
+	changedOptionsState[testFeaturePython] = changedOptionsPython
+	removedFeatureState := map[string]PostProcessingState{"chuxel/devcontainer-features/removed": {Id: "chuxel/devcontainer-features/removed"}}
+	for featureId, featureState := range finalizedState {
+		removedFeatureState[featureId] = featureState
+	}
+
+	tests := []struct {
+		name            string
+		labels          map[string]string
+		expected        []string
+		expectedChanged []string
+	}{
+		{
+			name:     "legacy done label",
+			expected: []string{testFeatureTest, testFeaturePython},
+		},
+		{
+			name:     "not post processed",
+			labels:   map[string]string{common.PostProcessingDoneMetadataId: ""},
+			expected: []string{testFeatureTest, testFeatureNode, testFeaturePython},
+		},
+		{
+			name:   "state label matches",
+			labels: map[string]string{common.PostProcessingStateMetadataId: postProcessingStateLabel(finalizedState)},
+		},
+		{
+			name:            "layer changed since post processing",
+			labels:          map[string]string{common.PostProcessingStateMetadataId: postProcessingStateLabel(changedState)},
+			expected:        []string{testFeaturePython},
+			expectedChanged: []string{testFeaturePython},
+		},
+		{
+			name:            "options changed since post processing",
+			labels:          map[string]string{common.PostProcessingStateMetadataId: postProcessingStateLabel(changedOptionsState)},
+			expected:        []string{testFeaturePython},
+			expectedChanged: []string{testFeaturePython},
+		},
+		{
+			name:   "state for features no longer in the image is dropped",
+			labels: map[string]string{common.PostProcessingStateMetadataId: postProcessingStateLabel(removedFeatureState)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, imageInspect := loadTestImageInspect(t)
+			for label, value := range test.labels {
+				imageInspect.Config.Labels[label] = value
+			}
+			postProcessingConfig := newPostProcessingConfig(testImage, imageInspect, "", FinalizeOptions{Engine: engine})
+			featuresToProcess, changedFeatures, state := comparePostProcessingState(postProcessingConfig)
+			if !reflect.DeepEqual(featuresToProcess, test.expected) {
+				t.Errorf("Got features to process %v, expected %v", featuresToProcess, test.expected)
+			}
+			if !reflect.DeepEqual(changedFeatures, test.expectedChanged) {
+				t.Errorf("Got changed features %v, expected %v", changedFeatures, test.expectedChanged)
+			}
+			if !reflect.DeepEqual(state, finalizedState) {
+				t.Errorf("Got state %+v, expected %+v", state, finalizedState)
+			}
+		})
+	}
+}
+
+func TestUpdateLockFile(t *testing.T) {
+	tests := []struct {
+		name                string
+		buildMode           string
+		hasDevContainerJson bool
+		expectLockFile      bool
+	}{
+		{name: "devcontainer mode with devcontainer.json", buildMode: "devcontainer", hasDevContainerJson: true, expectLockFile: true},
+		{name: "devcontainer mode without devcontainer.json", buildMode: "devcontainer"},
+		{name: "production mode", buildMode: "production", hasDevContainerJson: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine, imageInspect := loadTestImageInspect(t)
+			postProcessingConfig := newPostProcessingConfig(testImage, imageInspect, t.TempDir(), FinalizeOptions{Engine: engine})
+			postProcessingConfig.BuildMode = test.buildMode
+			devContainerJsonPath := filepath.Join(postProcessingConfig.ApplicationFolder, ".devcontainer", "devcontainer.json")
+			if test.hasDevContainerJson {
+				os.MkdirAll(filepath.Dir(devContainerJsonPath), 0755)
+				os.WriteFile(devContainerJsonPath, []byte("{}"), 0644)
+			}
+
+			updateLockFile(postProcessingConfig, devContainerJsonPath)
+			lock := common.DevContainerLock{}
+			if hasLockFile := lock.LoadFile(common.LockFilePath(devContainerJsonPath)); hasLockFile != test.expectLockFile {
+				t.Fatalf("Got lock file %v, expected %v", hasLockFile, test.expectLockFile)
+			}
+			if !test.expectLockFile {
+				return
+			}
+			expected := common.FeatureLock{Version: "v0.1.11", Options: map[string]string{"version": "3.10"}, Resolved: map[string]string{"version": "3.10.4"}}
+			if !reflect.DeepEqual(lock.Features[testFeaturePython], expected) {
+				t.Errorf("Got lock %+v, expected %+v", lock.Features[testFeaturePython], expected)
+			}
+		})
+	}
+}
+
+func TestBuildPostProcessedImage(t *testing.T) {
+	const buildTag = "devpacker-post-processing:test"
+	tests := []struct {
+		name        string
+		changeUser  bool
+		expectError bool
+	}{
+		{name: "verified image is tagged"},
+		{name: "unexpected changes leave the tag alone", changeUser: true, expectError: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine, imageInspect := loadTestImageInspect(t)
+			postProcessingConfig := newPostProcessingConfig(testImage, imageInspect, "", FinalizeOptions{Engine: engine})
+			postProcessingConfig.Image = testImage + ":latest"
+			engine.BuildResult = func(options common.ImageBuildOptions) (common.ImageInspect, error) {
+				result := imageInspect
+				result.Id = "sha256:built"
+				result.Config.Entrypoint = wrapEntrypoint(imageInspect.Config.Entrypoint)
+				result.Config.Labels = make(map[string]string)
+				for label, value := range imageInspect.Config.Labels {
+					result.Config.Labels[label] = value
+				}
+				for _, label := range postProcessingLabels {
+					result.Config.Labels[label] = "processed"
+				}
+				if test.changeUser {
+					result.Config.User = "root"
+				}
+				return result, nil
+			}
+
+			err := buildPostProcessedImage(postProcessingConfig, nil, common.ImageBuildOptions{Tag: buildTag})
+			if (err != nil) != test.expectError {
+				t.Fatalf("Got error %v, expected an error to be %v", err, test.expectError)
+			}
+			tagged, err := engine.ImageInspect(postProcessingConfig.Image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectedId := "sha256:built"
+			if test.expectError {
+				expectedId = imageInspect.Id
+			}
+			if tagged.Id != expectedId {
+				t.Errorf("Got %s tagged as %s, expected %s", tagged.Id, postProcessingConfig.Image, expectedId)
+			}
+			if !reflect.DeepEqual(engine.Removed, []string{buildTag}) {
+				t.Errorf("Expected the build tag to be removed, got %v", engine.Removed)
+			}
+		})
+	}
+}
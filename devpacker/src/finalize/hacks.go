@@ -8,11 +8,78 @@ import (
 )
 
 /**
-  Work around the fact that local file features are not yet implemented by mapping into devcontainer.json
-  and there are properties in features.json missing from devcontainer.json
+  Used by the "merge" output mode for tools that cannot reference a local feature. Maps the config from
+  features in the image into devcontainer.json, including properties in features.json missing from devcontainer.json
 **/
 func mergeFeatureConfigToDevContainerJson(postProcessingConfig PostProcessingConfig, devContainerJsonMap map[string]json.RawMessage) map[string]json.RawMessage {
-	finalizeFeatureConfig := generateFinalizeFeatureConfig(postProcessingConfig)
+	settingsMerger := newSettingsMerger(postProcessingConfig.Options.SettingsArrayMerge)
+	finalizeFeatureConfig := generateFinalizeFeatureConfig(postProcessingConfig, settingsMerger)
+	// runArgs and mounts are not used with Docker Compose, so these go in the compose override file instead
+	if !isDockerComposeConfig(devContainerJsonMap) {
+		devContainerJsonMap = mergeRunArgs(devContainerJsonMap, finalizeFeatureConfig)
+	}
+
+	if !postProcessingConfig.Options.LegacyVSCode {
+		devContainerJsonMap = mergeVSCodeCustomizations(devContainerJsonMap, finalizeFeatureConfig, settingsMerger)
+	} else {
+		devContainerJsonMap = mergeLegacyVSCodeProperties(devContainerJsonMap, finalizeFeatureConfig, settingsMerger)
+	}
+	devContainerJsonMap = mergeLifecycleCommands(devContainerJsonMap, finalizeFeatureConfig)
+	if len(finalizeFeatureConfig.Mounts) > 0 && !isDockerComposeConfig(devContainerJsonMap) {
+		devContainerJsonMap["mounts"] = common.ToJsonRawMessage(mergeMounts(devContainerJsonMap["mounts"], finalizeFeatureConfig))
+	}
+	return devContainerJsonMap
+}
+
+// Adds feature VS Code extensions and settings to the deprecated top level properties in devcontainer.json. Values
+// the user already has in either those properties or customizations.vscode win over feature values.
+func mergeLegacyVSCodeProperties(devContainerJsonMap map[string]json.RawMessage, finalizeFeatureConfig common.FeatureConfig, settingsMerger *settingsMerger) map[string]json.RawMessage {
+	userConfig := common.FeatureConfig{Customizations: &common.FeatureCustomizations{VSCode: &common.VSCodeCustomizations{}}}
+	if devContainerJsonMap["customizations"] != nil {
+		var customizations map[string]json.RawMessage
+		if err := json.Unmarshal(devContainerJsonMap["customizations"], &customizations); err != nil {
+			log.Fatal("Failed to unmarshal customizations from devcontainer.json: ", err)
+		}
+		if customizations["vscode"] != nil {
+			if err := json.Unmarshal(customizations["vscode"], userConfig.Customizations.VSCode); err != nil {
+				log.Fatal("Failed to unmarshal customizations.vscode from devcontainer.json: ", err)
+			}
+		}
+	}
+	if devContainerJsonMap["extensions"] != nil {
+		if err := json.Unmarshal(devContainerJsonMap["extensions"], &userConfig.Extensions); err != nil {
+			log.Fatal("Failed to unmarshal extensions from devcontainer.json: ", err)
+		}
+	}
+	if devContainerJsonMap["settings"] != nil {
+		if err := json.Unmarshal(devContainerJsonMap["settings"], &userConfig.Settings); err != nil {
+			log.Fatal("Failed to unmarshal settings from devcontainer.json: ", err)
+		}
+	}
+
+	// Skip extensions already in customizations.vscode so they are not listed twice
+	userExtensions := userConfig.VSCodeExtensions()
+	extensions := userConfig.Extensions
+	for _, extension := range finalizeFeatureConfig.Extensions {
+		if !common.SliceContainsString(userExtensions, extension) {
+			extensions = common.SliceUnion(extensions, []string{extension})
+		}
+	}
+	if len(extensions) > 0 {
+		devContainerJsonMap["extensions"] = common.ToJsonRawMessage(extensions)
+	}
+	if len(finalizeFeatureConfig.Settings) > 0 {
+		// Feature settings are the base, user settings always win
+		settings := finalizeFeatureConfig.Settings
+		settingsMerger.mergeUserSettings(settings, userConfig.VSCodeSettings())
+		settingsMerger.logProvenance()
+		devContainerJsonMap["settings"] = common.ToJsonRawMessage(settings)
+	}
+	return devContainerJsonMap
+}
+
+// Adds runArgs for feature privileged, init, capAdd, and securityOpt properties to devcontainer.json
+func mergeRunArgs(devContainerJsonMap map[string]json.RawMessage, finalizeFeatureConfig common.FeatureConfig) map[string]json.RawMessage {
 	var runArgs []string
 	if devContainerJsonMap["runArgs"] != nil {
 		if err := json.Unmarshal(devContainerJsonMap["runArgs"], &runArgs); err != nil {
@@ -36,38 +103,88 @@ func mergeFeatureConfigToDevContainerJson(postProcessingConfig PostProcessingCon
 		}
 	}
 	devContainerJsonMap["runArgs"] = common.ToJsonRawMessage(runArgs)
+	return devContainerJsonMap
+}
 
-	if finalizeFeatureConfig.Extensions != nil {
-		var extensions []string
-		if devContainerJsonMap["extensions"] != nil {
-			if err := json.Unmarshal(devContainerJsonMap["extensions"], &extensions); err != nil {
-				log.Fatal("Failed to unmarshal extensions from devcontainer.json: ", err)
-			}
+// Merges feature extensions and settings into customizations.vscode in devcontainer.json, keeping anything else
+// in the customizations block. Legacy top level extensions and settings from devcontainer.json are moved there too.
+func mergeVSCodeCustomizations(devContainerJsonMap map[string]json.RawMessage, finalizeFeatureConfig common.FeatureConfig, settingsMerger *settingsMerger) map[string]json.RawMessage {
+	customizations := make(map[string]json.RawMessage)
+	if devContainerJsonMap["customizations"] != nil {
+		if err := json.Unmarshal(devContainerJsonMap["customizations"], &customizations); err != nil {
+			log.Fatal("Failed to unmarshal customizations from devcontainer.json: ", err)
 		}
-		extensions = common.SliceUnion(extensions, finalizeFeatureConfig.Extensions)
-		devContainerJsonMap["extensions"] = common.ToJsonRawMessage(extensions)
 	}
-	if finalizeFeatureConfig.Settings != nil {
-		var settings map[string]interface{}
-		if devContainerJsonMap["settings"] != nil {
-			if err := json.Unmarshal(devContainerJsonMap["settings"], &settings); err != nil {
-				log.Fatal("Failed to unmarshal extensions from devcontainer.json: ", err)
-			}
+	var userVSCode common.VSCodeCustomizations
+	userConfig := common.FeatureConfig{Customizations: &common.FeatureCustomizations{VSCode: &userVSCode}}
+	vsCodeCustomizations := make(map[string]json.RawMessage)
+	if customizations["vscode"] != nil {
+		if err := json.Unmarshal(customizations["vscode"], &vsCodeCustomizations); err != nil {
+			log.Fatal("Failed to unmarshal customizations.vscode from devcontainer.json: ", err)
+		}
+		if err := json.Unmarshal(customizations["vscode"], &userVSCode); err != nil {
+			log.Fatal("Failed to unmarshal customizations.vscode from devcontainer.json: ", err)
 		}
-		//TODO: Settings merge
-		devContainerJsonMap["settings"] = common.ToJsonRawMessage(settings)
 	}
-	if finalizeFeatureConfig.Mounts != nil {
-		var mounts []string
-		if devContainerJsonMap["mounts"] != nil {
-			if err := json.Unmarshal(devContainerJsonMap["mounts"], &mounts); err != nil {
-				log.Fatal("Failed to unmarshal mounts from devcontainer.json: ", err)
-			}
+	for _, property := range []string{"extensions", "settings"} {
+		if devContainerJsonMap[property] == nil {
+			continue
+		}
+		log.Printf("Moving deprecated %s property in devcontainer.json to customizations.vscode.%s.", property, property)
+		var err error
+		if property == "extensions" {
+			err = json.Unmarshal(devContainerJsonMap[property], &userConfig.Extensions)
+		} else {
+			err = json.Unmarshal(devContainerJsonMap[property], &userConfig.Settings)
 		}
-		for _, mount := range finalizeFeatureConfig.Mounts {
-			mounts = common.AddToSliceIfUnique(runArgs, "source="+mount.Source+",target="+mount.Target+",type="+mount.Type)
+		if err != nil {
+			log.Fatal("Failed to unmarshal ", property, " from devcontainer.json: ", err)
 		}
-		devContainerJsonMap["mounts"] = common.ToJsonRawMessage(mounts)
+		delete(devContainerJsonMap, property)
+	}
+
+	extensions := common.SliceUnion(userConfig.VSCodeExtensions(), finalizeFeatureConfig.VSCodeExtensions())
+	if len(extensions) > 0 {
+		vsCodeCustomizations["extensions"] = common.ToJsonRawMessage(extensions)
+	}
+	// Feature settings are the base, user settings always win
+	settings := finalizeFeatureConfig.VSCodeSettings()
+	settingsMerger.mergeUserSettings(settings, userConfig.VSCodeSettings())
+	settingsMerger.logProvenance()
+	if len(settings) > 0 {
+		vsCodeCustomizations["settings"] = common.ToJsonRawMessage(settings)
+	}
+	if len(vsCodeCustomizations) > 0 {
+		customizations["vscode"] = common.ToJsonRawMessage(vsCodeCustomizations)
+		devContainerJsonMap["customizations"] = common.ToJsonRawMessage(customizations)
 	}
 	return devContainerJsonMap
 }
+
+// Merges feature mounts into the mounts from devcontainer.json. Mounts in devcontainer.json win if there is more
+// than one mount for the same target. Any ${containerEnv:NAME} references to feature containerEnv values are resolved.
+func mergeMounts(devContainerJsonMounts json.RawMessage, finalizeFeatureConfig common.FeatureConfig) []string {
+	var mounts []common.FeatureMount
+	if devContainerJsonMounts != nil {
+		if err := json.Unmarshal(devContainerJsonMounts, &mounts); err != nil {
+			log.Fatal("Failed to unmarshal mounts from devcontainer.json: ", err)
+		}
+	}
+	variables := make(map[string]string)
+	for varName, varValue := range finalizeFeatureConfig.ContainerEnv {
+		variables["containerEnv:"+varName] = varValue
+	}
+	for _, featureMount := range finalizeFeatureConfig.Mounts {
+		var skippedMounts []common.FeatureMount
+		mounts, skippedMounts = common.AddMountsIfUniqueTarget(mounts, featureMount.SubstituteVariables(variables))
+		for _, skippedMount := range skippedMounts {
+			log.Printf("Skipping feature mount \"%s\" since devcontainer.json already mounts to %s.", skippedMount, skippedMount.Target)
+		}
+	}
+	// Use the string form for compatibility with tools that do not support the object form
+	mountStrings := make([]string, 0, len(mounts))
+	for _, mount := range mounts {
+		mountStrings = append(mountStrings, mount.String())
+	}
+	return mountStrings
+}
@@ -0,0 +1,60 @@
+package finalize
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+func TestMergeMounts(t *testing.T) {
+	tests := []struct {
+		name               string
+		devContainerMounts string
+		featureConfig      common.FeatureConfig
+		expected           []string
+	}{
+		{
+			name:          "feature mounts only",
+			featureConfig: common.FeatureConfig{Mounts: []common.FeatureMount{{Source: "vol", Target: "/data", Type: "volume"}}},
+			expected:      []string{"source=vol,target=/data,type=volume"},
+		},
+		{
+			name:               "string and object forms in devcontainer.json",
+			devContainerMounts: `["source=/host,target=/src,type=bind", {"source": "cache", "target": "/cache", "type": "volume"}]`,
+			featureConfig:      common.FeatureConfig{Mounts: []common.FeatureMount{{Source: "vol", Target: "/data", Type: "volume"}}},
+			expected:           []string{"source=/host,target=/src,type=bind", "source=cache,target=/cache,type=volume", "source=vol,target=/data,type=volume"},
+		},
+		{
+			name:               "devcontainer.json wins for the same target",
+			devContainerMounts: `["source=mine,target=/data,type=volume"]`,
+			featureConfig:      common.FeatureConfig{Mounts: []common.FeatureMount{{Source: "feature", Target: "/data", Type: "volume"}}},
+			expected:           []string{"source=mine,target=/data,type=volume"},
+		},
+		{
+			name: "containerEnv references are resolved",
+			featureConfig: common.FeatureConfig{
+				ContainerEnv: map[string]string{"CACHE_DIR": "/cache"},
+				Mounts:       []common.FeatureMount{{Source: "pip", Target: "${containerEnv:CACHE_DIR}/pip", Type: "volume"}},
+			},
+			expected: []string{"source=pip,target=/cache/pip,type=volume"},
+		},
+		{
+			name:               "extra properties are kept",
+			devContainerMounts: `["source=vol,target=/data,type=volume,volume-nocopy"]`,
+			expected:           []string{"source=vol,target=/data,type=volume,volume-nocopy"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var devContainerMounts json.RawMessage
+			if test.devContainerMounts != "" {
+				devContainerMounts = json.RawMessage(test.devContainerMounts)
+			}
+			if got := mergeMounts(devContainerMounts, test.featureConfig); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("Got %v, expected %v", got, test.expected)
+			}
+		})
+	}
+}
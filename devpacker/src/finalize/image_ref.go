@@ -0,0 +1,221 @@
+package finalize
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// Image reference transports, using the same prefixes as skopeo
+const (
+	TransportDaemon   = "docker-daemon"  // Image in the local container engine, the default
+	TransportRegistry = "docker"         // docker://<registry reference>
+	TransportOci      = "oci"            // oci:<layout folder>[:<tag>]
+	TransportTarball  = "docker-archive" // docker-archive:<tar file>[:<reference>]
+)
+
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// Where an image lives and how to get to it
+type ImageReference struct {
+	Transport string
+	Path      string // Layout folder or tarball path
+	Reference string // Image reference, or tag in an OCI layout
+}
+
+// Parses references like "docker://ghcr.io/org/image:tag", "oci:./layout:tag", "docker-archive:./image.tar".
+// References without a transport prefix use defaultTransport, which is TransportDaemon or TransportRegistry.
+func ParseImageReference(image string, defaultTransport string) ImageReference {
+	if strings.HasPrefix(image, TransportRegistry+"://") {
+		return ImageReference{Transport: TransportRegistry, Reference: strings.TrimPrefix(image, TransportRegistry+"://")}
+	}
+	for _, transport := range []string{TransportOci, TransportTarball, TransportDaemon} {
+		if !strings.HasPrefix(image, transport+":") {
+			continue
+		}
+		remainder := strings.TrimPrefix(image, transport+":")
+		if transport == TransportDaemon {
+			return ImageReference{Transport: transport, Reference: remainder}
+		}
+		imageRef := ImageReference{Transport: transport, Path: remainder}
+		if index := strings.Index(remainder, ":"); index > -1 {
+			imageRef.Path = remainder[:index]
+			imageRef.Reference = remainder[index+1:]
+		}
+		return imageRef
+	}
+	if defaultTransport == "" {
+		defaultTransport = TransportDaemon
+	}
+	return ImageReference{Transport: defaultTransport, Reference: image}
+}
+
+// True if the image is in the local container engine rather than being read and written directly
+func (imageRef ImageReference) IsDaemon() bool {
+	return imageRef.Transport == TransportDaemon
+}
+
+// Name to use for the image in devcontainer.json
+func (imageRef ImageReference) ImageName() string {
+	if imageRef.Reference == "" {
+		return imageRef.Path
+	}
+	return imageRef.Reference
+}
+
+func (imageRef ImageReference) String() string {
+	switch imageRef.Transport {
+	case TransportDaemon:
+		return imageRef.Reference
+	case TransportRegistry:
+		return TransportRegistry + "://" + imageRef.Reference
+	}
+	if imageRef.Reference == "" {
+		return imageRef.Transport + ":" + imageRef.Path
+	}
+	return imageRef.Transport + ":" + imageRef.Path + ":" + imageRef.Reference
+}
+
+// Loads an image from a registry, OCI layout, or tarball. Registry credentials come from the keychain.
+func loadImage(imageRef ImageReference, keychain authn.Keychain) (v1.Image, error) {
+	switch imageRef.Transport {
+	case TransportRegistry:
+		ref, err := name.ParseReference(imageRef.Reference)
+		if err != nil {
+			return nil, err
+		}
+		return remote.Image(ref, remote.WithAuthFromKeychain(keychain))
+	case TransportOci:
+		return loadOciLayoutImage(imageRef)
+	case TransportTarball:
+		var tag *name.Tag
+		if imageRef.Reference != "" {
+			parsedTag, err := name.NewTag(imageRef.Reference)
+			if err != nil {
+				return nil, err
+			}
+			tag = &parsedTag
+		}
+		return tarball.ImageFromPath(imageRef.Path, tag)
+	}
+	return nil, errors.New("Images in the local container engine cannot be loaded directly: " + imageRef.String())
+}
+
+func loadOciLayoutImage(imageRef ImageReference) (v1.Image, error) {
+	index, err := layout.ImageIndexFromPath(imageRef.Path)
+	if err != nil {
+		return nil, err
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	// Use the image with a matching ref name, or the only image if no tag was specified
+	var matches []v1.Descriptor
+	for _, descriptor := range indexManifest.Manifests {
+		if imageRef.Reference == "" || descriptor.Annotations[ociRefNameAnnotation] == imageRef.Reference {
+			matches = append(matches, descriptor)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, common.ImageNotFoundError{Image: imageRef.String()}
+	}
+	if len(matches) > 1 {
+		return nil, errors.New("OCI layout " + imageRef.Path + " contains more than one image. Specify a tag using oci:<path>:<tag>")
+	}
+	return index.Image(matches[0].Digest)
+}
+
+// Writes an image to a registry, OCI layout, or tarball. Registry credentials come from the keychain.
+func saveImage(imageRef ImageReference, image v1.Image, keychain authn.Keychain) error {
+	switch imageRef.Transport {
+	case TransportRegistry:
+		ref, err := name.ParseReference(imageRef.Reference)
+		if err != nil {
+			return err
+		}
+		return remote.Write(ref, image, remote.WithAuthFromKeychain(keychain))
+	case TransportOci:
+		return saveOciLayoutImage(imageRef, image)
+	case TransportTarball:
+		return saveTarballImage(imageRef, image)
+	}
+	return errors.New("Images in the local container engine cannot be written directly: " + imageRef.String())
+}
+
+func saveOciLayoutImage(imageRef ImageReference, image v1.Image) error {
+	layoutPath, err := layout.FromPath(imageRef.Path)
+	if err != nil {
+		if layoutPath, err = layout.Write(imageRef.Path, empty.Index); err != nil {
+			return err
+		}
+	}
+	if imageRef.Reference == "" {
+		// Replace the only image in the layout, which is what loadOciLayoutImage read
+		return layoutPath.ReplaceImage(image, func(v1.Descriptor) bool { return true })
+	}
+	return layoutPath.ReplaceImage(image, match.Name(imageRef.Reference), layout.WithAnnotations(map[string]string{ociRefNameAnnotation: imageRef.Reference}))
+}
+
+// Tarball images are read lazily, so write to a temp file and then replace the original
+func saveTarballImage(imageRef ImageReference, image v1.Image) error {
+	reference := imageRef.Reference
+	if reference == "" {
+		reference = "devpacker/finalized:latest"
+	}
+	ref, err := name.ParseReference(reference)
+	if err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(imageRef.Path), filepath.Base(imageRef.Path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tempFile.Close()
+	if err := tarball.WriteToFile(tempFile.Name(), ref, image); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	return os.Rename(tempFile.Name(), imageRef.Path)
+}
+
+// Converts an image's config into the same format the container engine returns from inspect
+func inspectImage(image v1.Image) (common.ImageInspect, error) {
+	var inspect common.ImageInspect
+	configFile, err := image.ConfigFile()
+	if err != nil {
+		return inspect, err
+	}
+	configDigest, err := image.ConfigName()
+	if err != nil {
+		return inspect, err
+	}
+	inspect.Id = configDigest.String()
+	inspect.Config = common.ImageConfig{
+		User:       configFile.Config.User,
+		Env:        configFile.Config.Env,
+		Entrypoint: configFile.Config.Entrypoint,
+		Cmd:        configFile.Config.Cmd,
+		WorkingDir: configFile.Config.WorkingDir,
+		Labels:     configFile.Config.Labels,
+	}
+	if len(configFile.Config.ExposedPorts) > 0 {
+		inspect.Config.ExposedPorts = configFile.Config.ExposedPorts
+	}
+	inspect.RootFS.Type = configFile.RootFS.Type
+	for _, diffId := range configFile.RootFS.DiffIDs {
+		inspect.RootFS.Layers = append(inspect.RootFS.Layers, diffId.String())
+	}
+	return inspect, nil
+}
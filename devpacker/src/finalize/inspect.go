@@ -0,0 +1,213 @@
+package finalize
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// What devpacker knows about an image built with a Devpack
+type ImageInfo struct {
+	Image                 string             `json:"image"`
+	BuildMode             string             `json:"buildMode"`
+	PostProcessed         []string           `json:"postProcessed"`         // Features already post processed
+	PostProcessingPending []string           `json:"postProcessingPending"` // Features finalize still needs to process
+	Features              []ImageFeatureInfo `json:"features"`
+}
+
+// A feature layer in an image
+type ImageFeatureInfo struct {
+	Id              string            `json:"id"`
+	Version         string            `json:"version,omitempty"`
+	LayerDiffId     string            `json:"layerDiffId,omitempty"`
+	LayerTypes      []string          `json:"layerTypes"`
+	Options         map[string]string `json:"options,omitempty"`
+	ResolvedOptions map[string]string `json:"resolvedOptions,omitempty"`
+	ContainerEnv    map[string]string `json:"containerEnv,omitempty"`
+	Privileged      bool              `json:"privileged,omitempty"`
+	Init            bool              `json:"init,omitempty"`
+	CapAdd          []string          `json:"capAdd,omitempty"`
+	SecurityOpt     []string          `json:"securityOpt,omitempty"`
+	Mounts          []string          `json:"mounts,omitempty"`
+}
+
+// Reads feature metadata from an image. If inspectJsonPath is set, the image config comes from the saved output
+// of "docker inspect" in that file instead, and image can be empty if the file only has one image.
+func InspectImage(image string, inspectJsonPath string, options FinalizeOptions) ImageInfo {
+	var imageInspect common.ImageInspect
+	var err error
+	if inspectJsonPath != "" {
+		imageInspect, err = inspectFromFile(image, inspectJsonPath)
+	} else {
+		imageInspect, err = inspectImageReference(image, options)
+	}
+	if err != nil {
+		log.Fatal("Failed to inspect image ", image, ": ", err)
+	}
+	if image == "" {
+		image = imageInspect.Id
+		if len(imageInspect.RepoTags) > 0 {
+			image = imageInspect.RepoTags[0]
+		}
+	}
+
+	postProcessingConfig := newPostProcessingConfig(image, imageInspect, "", options)
+	featuresToProcess, _, _ := comparePostProcessingState(postProcessingConfig)
+	info := ImageInfo{
+		Image:                 image,
+		BuildMode:             postProcessingConfig.BuildMode,
+		PostProcessed:         postProcessingStateIds(postProcessingConfig.AlreadyDone),
+		PostProcessingPending: featuresToProcess,
+		Features:              []ImageFeatureInfo{},
+	}
+	if info.PostProcessingPending == nil {
+		info.PostProcessingPending = []string{}
+	}
+	for _, featureId := range postProcessingConfig.LayerOrder {
+		layerFeatureMetadata := postProcessingConfig.LayerFeatureMetadata[featureId]
+		featureConfig := layerFeatureMetadata.Config
+		featureInfo := ImageFeatureInfo{
+			Id:              featureId,
+			Version:         layerFeatureMetadata.Version,
+			LayerDiffId:     postProcessingConfig.LayerDiffIds[featureId],
+			LayerTypes:      []string{},
+			Options:         layerFeatureMetadata.OptionSelections,
+			ResolvedOptions: layerFeatureMetadata.ResolvedOptions,
+			ContainerEnv:    featureConfig.ContainerEnv,
+			Privileged:      featureConfig.Privileged,
+			Init:            featureConfig.Init,
+			CapAdd:          featureConfig.CapAdd,
+			SecurityOpt:     featureConfig.SecurityOpt,
+		}
+		layerTypes := postProcessingConfig.LayerTypes[featureId]
+		for layerType, isType := range map[string]bool{"build": layerTypes.Build, "cache": layerTypes.Cache, "launch": layerTypes.Launch} {
+			if isType {
+				featureInfo.LayerTypes = append(featureInfo.LayerTypes, layerType)
+			}
+		}
+		sort.Strings(featureInfo.LayerTypes)
+		for _, mount := range featureConfig.Mounts {
+			featureInfo.Mounts = append(featureInfo.Mounts, mount.String())
+		}
+		info.Features = append(info.Features, featureInfo)
+	}
+	return info
+}
+
+func inspectImageReference(image string, options FinalizeOptions) (common.ImageInspect, error) {
+	defaultTransport := TransportDaemon
+	if options.Publish {
+		defaultTransport = TransportRegistry
+	}
+	imageRef := ParseImageReference(image, defaultTransport)
+	if !imageRef.IsDaemon() {
+		if options.Keychain == nil {
+			options.Keychain = authn.DefaultKeychain
+		}
+		loadedImage, err := loadImage(imageRef, options.Keychain)
+		if err != nil {
+			return common.ImageInspect{}, err
+		}
+		return inspectImage(loadedImage)
+	}
+	if options.Engine == nil {
+		engine, err := common.NewContainerEngine(options.EngineName, options.DockerHost, options.Runner)
+		if err != nil {
+			return common.ImageInspect{}, err
+		}
+		options.Engine = engine
+	}
+	return options.Engine.ImageInspect(imageRef.Reference)
+}
+
+func inspectFromFile(image string, inspectJsonPath string) (common.ImageInspect, error) {
+	engine, err := common.NewReplayEngineFromFile(inspectJsonPath)
+	if err != nil {
+		return common.ImageInspect{}, err
+	}
+	if image != "" {
+		return engine.ImageInspect(image)
+	}
+	// Images are in the map more than once, by ID and tags
+	imagesById := make(map[string]common.ImageInspect)
+	for _, imageInspect := range engine.Images {
+		imagesById[imageInspect.Id] = imageInspect
+	}
+	if len(imagesById) != 1 {
+		return common.ImageInspect{}, fmt.Errorf("%s has %d images. Specify which one to use", inspectJsonPath, len(imagesById))
+	}
+	for _, imageInspect := range imagesById {
+		return imageInspect, nil
+	}
+	return common.ImageInspect{}, nil
+}
+
+func (info ImageInfo) WriteJson(writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(info)
+}
+
+func (info ImageInfo) WriteText(writer io.Writer) {
+	fmt.Fprintln(writer, "Image:", info.Image)
+	fmt.Fprintln(writer, "Build mode:", info.BuildMode)
+	fmt.Fprintln(writer, "Post processed:", joinOrNone(info.PostProcessed))
+	fmt.Fprintln(writer, "Post processing pending:", joinOrNone(info.PostProcessingPending))
+	if len(info.Features) == 0 {
+		fmt.Fprintln(writer, "\nNo features found in image.")
+		return
+	}
+	for _, feature := range info.Features {
+		fmt.Fprintf(writer, "\n%s", feature.Id)
+		if feature.Version != "" {
+			fmt.Fprintf(writer, " %s", feature.Version)
+		}
+		fmt.Fprintln(writer)
+		fmt.Fprintf(writer, "  Layer:            %s %s\n", strings.Join(feature.LayerTypes, ", "), feature.LayerDiffId)
+		writeTextMap(writer, "Options:", feature.Options)
+		writeTextMap(writer, "Resolved options:", feature.ResolvedOptions)
+		writeTextMap(writer, "containerEnv:", feature.ContainerEnv)
+		var privileges []string
+		if feature.Privileged {
+			privileges = append(privileges, "privileged")
+		}
+		if feature.Init {
+			privileges = append(privileges, "init")
+		}
+		for _, capability := range feature.CapAdd {
+			privileges = append(privileges, "cap-add="+capability)
+		}
+		for _, opt := range feature.SecurityOpt {
+			privileges = append(privileges, "security-opt="+opt)
+		}
+		if len(privileges) > 0 {
+			fmt.Fprintf(writer, "  %-17s %s\n", "Privileges:", strings.Join(privileges, ", "))
+		}
+		for _, mount := range feature.Mounts {
+			fmt.Fprintf(writer, "  %-17s %s\n", "Mount:", mount)
+		}
+	}
+}
+
+func writeTextMap(writer io.Writer, label string, values map[string]string) {
+	if len(values) == 0 {
+		return
+	}
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(writer, "  %-17s %s=%s\n", label, key, values[key])
+		label = ""
+	}
+}
+
+func joinOrNone(values []string) string {
+	if len(values) == 0 {
+		return "(none)"
+	}
+	return strings.Join(values, " ")
+}
@@ -0,0 +1,61 @@
+package finalize
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+func TestInspectImageFromFile(t *testing.T) {
+	_, imageInspect := loadTestImageInspect(t)
+	postProcessingConfig := newPostProcessingConfig(testImage, imageInspect, "", FinalizeOptions{})
+	state := make(map[string]PostProcessingState)
+	for _, featureId := range postProcessingConfig.LayerOrder {
+		state[featureId] = newPostProcessingState(postProcessingConfig, featureId)
+	}
+	pythonState := state[testFeaturePython]
+	pythonState.LayerDiffId = "sha256:0000"
+	state[testFeaturePython] = pythonState
+	imageInspect.Config.Labels[common.PostProcessingStateMetadataId] = postProcessingStateLabel(state)
+	inspectJsonPath := filepath.Join(t.TempDir(), "inspect.json")
+	inspectJson, err := json.Marshal([]common.ImageInspect{imageInspect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(inspectJsonPath, inspectJson, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var logBuffer bytes.Buffer
+	log.SetOutput(&logBuffer)
+	defer log.SetOutput(os.Stderr)
+	info := InspectImage("", inspectJsonPath, FinalizeOptions{})
+
+	// Inspecting should report what finalize would do without logging as if it were doing it
+	if strings.Contains(logBuffer.String(), "Processing it again") {
+		t.Errorf("Expected no post processing messages, got:\n%s", logBuffer.String())
+	}
+	if info.Image != "test_image:latest" || info.BuildMode != "devcontainer" {
+		t.Errorf("Unexpected image info %+v", info)
+	}
+	if !reflect.DeepEqual(info.PostProcessingPending, []string{testFeaturePython}) {
+		t.Errorf("Got pending %v, expected %s", info.PostProcessingPending, testFeaturePython)
+	}
+	var featureIds []string
+	for _, feature := range info.Features {
+		featureIds = append(featureIds, feature.Id)
+	}
+	if !reflect.DeepEqual(featureIds, []string{testFeatureTest, testFeatureNode, testFeaturePython}) {
+		t.Errorf("Got features %v in layer order", featureIds)
+	}
+	if node := info.Features[1]; !reflect.DeepEqual(node.LayerTypes, []string{"build", "cache", "launch"}) || !reflect.DeepEqual(node.Mounts, []string{"source=node-cache,target=/home/cnb/.npm,type=volume"}) {
+		t.Errorf("Unexpected nodejs info %+v", node)
+	}
+}
@@ -0,0 +1,60 @@
+package finalize
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+// Name used for a string or array form lifecycle command from devcontainer.json when merging it
+const userLifecycleCommandName = "devcontainer.json"
+
+// Returns the commands features in the image have for a lifecycle hook, keyed by feature id in layer order,
+// which is the order the features were installed in
+func featureLifecycleCommands(postProcessingConfig PostProcessingConfig, hook string) *common.LifecycleCommands {
+	commands := common.NewLifecycleCommands()
+	for _, featureId := range postProcessingConfig.LayerOrder {
+		featureConfig := postProcessingConfig.LayerFeatureMetadata[featureId].Config
+		commands.Add(featureId, featureConfig.LifecycleCommand(hook))
+	}
+	return commands
+}
+
+// Merges feature lifecycle commands into devcontainer.json as a single command that runs the feature commands
+// first and then the command already in devcontainer.json. Object form entries from devcontainer.json run one
+// after another in name order rather than in parallel.
+func mergeLifecycleCommands(devContainerJsonMap map[string]json.RawMessage, finalizeFeatureConfig common.FeatureConfig) map[string]json.RawMessage {
+	for _, hook := range common.LifecycleHooks {
+		// Feature commands are already a single sequential command
+		featureCommand, hasCommand := finalizeFeatureConfig.LifecycleCommand(hook).(string)
+		if !hasCommand || featureCommand == "" {
+			continue
+		}
+		userCommands := common.NewLifecycleCommands()
+		if devContainerJsonMap[hook] != nil {
+			var userCommand interface{}
+			if err := json.Unmarshal(devContainerJsonMap[hook], &userCommand); err != nil {
+				log.Fatal("Failed to unmarshal ", hook, " from devcontainer.json: ", err)
+			}
+			if objectCommands, isObject := userCommand.(map[string]interface{}); isObject {
+				names := make([]string, 0, len(objectCommands))
+				for name := range objectCommands {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					userCommands.Add(name, objectCommands[name])
+				}
+			} else {
+				userCommands.Add(userLifecycleCommandName, userCommand)
+			}
+		}
+		if !userCommands.IsEmpty() {
+			featureCommand += " && " + userCommands.Sequential()
+		}
+		devContainerJsonMap[hook] = common.ToJsonRawMessage(featureCommand)
+	}
+	return devContainerJsonMap
+}
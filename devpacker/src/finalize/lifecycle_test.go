@@ -0,0 +1,84 @@
+package finalize
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+func TestFeatureLifecycleCommands(t *testing.T) {
+	engine, imageInspect := loadTestImageInspect(t)
+	postProcessingConfig := newPostProcessingConfig(testImage, imageInspect, "", FinalizeOptions{Engine: engine})
+	for featureId, command := range map[string]interface{}{
+		testFeaturePython: "pip install -r requirements.txt",
+		testFeatureNode:   []interface{}{"npm", "install"},
+		testFeatureTest:   map[string]interface{}{"check": "true"},
+	} {
+		layerFeatureMetadata := postProcessingConfig.LayerFeatureMetadata[featureId]
+		layerFeatureMetadata.Config.PostCreateCommand = command
+		postProcessingConfig.LayerFeatureMetadata[featureId] = layerFeatureMetadata
+	}
+
+	// Layer order, not sorted ids
+	expected := `( true ) && ( 'npm' 'install' ) && ( pip install -r requirements.txt )`
+	finalizeFeatureConfig := generateFinalizeFeatureConfig(postProcessingConfig, newSettingsMerger(""))
+	if command := finalizeFeatureConfig.PostCreateCommand; command != expected {
+		t.Errorf("Got postCreateCommand %v, expected %q", command, expected)
+	}
+	if finalizeFeatureConfig.OnCreateCommand != nil {
+		t.Errorf("Expected no onCreateCommand, got %v", finalizeFeatureConfig.OnCreateCommand)
+	}
+}
+
+func TestMergeLifecycleCommands(t *testing.T) {
+	featureCommand := `( pip install -r requirements.txt )`
+	tests := []struct {
+		name        string
+		userCommand string
+		expected    string
+	}{
+		{
+			name:     "no user command",
+			expected: featureCommand,
+		},
+		{
+			name:        "string",
+			userCommand: `"npm test"`,
+			expected:    featureCommand + ` && ( npm test )`,
+		},
+		{
+			name:        "array",
+			userCommand: `["npm", "test"]`,
+			expected:    featureCommand + ` && ( 'npm' 'test' )`,
+		},
+		{
+			name:        "object runs in name order",
+			userCommand: `{"test": "npm test", "install": ["npm", "install"]}`,
+			expected:    featureCommand + ` && ( 'npm' 'install' ) && ( npm test )`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			finalizeFeatureConfig := common.FeatureConfig{Id: FinalizeFeatureId}
+			finalizeFeatureConfig.PostCreateCommand = featureCommand
+			devContainerJsonMap := map[string]json.RawMessage{}
+			if test.userCommand != "" {
+				devContainerJsonMap["postCreateCommand"] = json.RawMessage(test.userCommand)
+			}
+			devContainerJsonMap["postStartCommand"] = json.RawMessage(`"npm start"`)
+
+			devContainerJsonMap = mergeLifecycleCommands(devContainerJsonMap, finalizeFeatureConfig)
+			var command interface{}
+			if err := json.Unmarshal(devContainerJsonMap["postCreateCommand"], &command); err != nil {
+				t.Fatal(err)
+			}
+			if command != test.expected {
+				t.Errorf("Got %v, expected %q", command, test.expected)
+			}
+			if string(devContainerJsonMap["postStartCommand"]) != `"npm start"` {
+				t.Errorf("Expected hooks without feature commands to be left alone, got %s", devContainerJsonMap["postStartCommand"])
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package finalize
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+// Image label from the dev container spec that lets the image be used as-is with "image" in devcontainer.json
+const DevContainerMetadataLabel = "devcontainer.metadata"
+
+// Entry in the devcontainer.metadata label for a feature layer
+type devContainerMetadataEntry struct {
+	Id             string                        `json:"id"`
+	Init           bool                          `json:"init,omitempty"`
+	Privileged     bool                          `json:"privileged,omitempty"`
+	CapAdd         []string                      `json:"capAdd,omitempty"`
+	SecurityOpt    []string                      `json:"securityOpt,omitempty"`
+	Entrypoint     string                        `json:"entrypoint,omitempty"`
+	Mounts         []string                      `json:"mounts,omitempty"`
+	Customizations *common.FeatureCustomizations `json:"customizations,omitempty"`
+}
+
+// Returns the devcontainer.metadata label value: the entries already in the image's label, such as those from a
+// base image, followed by one entry per feature layer in layer order. Entries for the image's features from an
+// earlier finalize are replaced. containerEnv is left out since it is already set in the image, and lifecycle hooks
+// are left out since they are already in the generated config, so tools would run them twice.
+func devContainerMetadataLabel(postProcessingConfig PostProcessingConfig) string {
+	entries := existingDevContainerMetadata(postProcessingConfig)
+	for _, featureId := range postProcessingConfig.LayerOrder {
+		layerFeatureMetadata := postProcessingConfig.LayerFeatureMetadata[featureId]
+		featureConfig := layerFeatureMetadata.Config
+		entry := devContainerMetadataEntry{
+			Id:          featureId,
+			Init:        featureConfig.Init,
+			Privileged:  featureConfig.Privileged,
+			CapAdd:      featureConfig.CapAdd,
+			SecurityOpt: featureConfig.SecurityOpt,
+			Entrypoint:  featureConfig.Entrypoint,
+		}
+		if layerFeatureMetadata.Version != "" {
+			entry.Id += ":" + layerFeatureMetadata.Version
+		}
+		variables := make(map[string]string)
+		for varName, varValue := range featureConfig.ContainerEnv {
+			variables["containerEnv:"+varName] = varValue
+		}
+		for _, mount := range featureConfig.Mounts {
+			entry.Mounts = append(entry.Mounts, mount.SubstituteVariables(variables).String())
+		}
+		vsCodeConfig := common.FeatureConfig{}
+		vsCodeConfig.SetVSCodeCustomizations(featureConfig.VSCodeExtensions(), featureConfig.VSCodeSettings(), false)
+		entry.Customizations = vsCodeConfig.Customizations
+		entries = append(entries, common.ToJsonRawMessage(entry))
+	}
+	labelBytes, err := json.Marshal(entries)
+	if err != nil {
+		log.Fatal("Failed to marshal devcontainer.metadata label: ", err)
+	}
+	return string(labelBytes)
+}
+
+// Returns the entries in the image's devcontainer.metadata label other than those for its features. The label can
+// be an array or a single object.
+func existingDevContainerMetadata(postProcessingConfig PostProcessingConfig) []json.RawMessage {
+	entries := []json.RawMessage{}
+	label := strings.TrimSpace(postProcessingConfig.ImageConfig.Labels[DevContainerMetadataLabel])
+	if label == "" {
+		return entries
+	}
+	var existingEntries []json.RawMessage
+	if strings.HasPrefix(label, "{") {
+		existingEntries = []json.RawMessage{json.RawMessage(label)}
+	} else if err := json.Unmarshal([]byte(label), &existingEntries); err != nil {
+		log.Println("Warning: Replacing", DevContainerMetadataLabel, "label in the image since it could not be read:", err)
+		return entries
+	}
+	for _, existingEntry := range existingEntries {
+		var entryId struct {
+			Id string `json:"id"`
+		}
+		json.Unmarshal(existingEntry, &entryId)
+		featureId := entryId.Id
+		if index := strings.LastIndex(featureId, ":"); index > strings.LastIndex(featureId, "/") {
+			featureId = featureId[:index]
+		}
+		if _, isImageFeature := postProcessingConfig.LayerFeatureMetadata[featureId]; !isImageFeature {
+			entries = append(entries, existingEntry)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,83 @@
+package finalize
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDevContainerMetadataLabel(t *testing.T) {
+	baseEntry := `{"id":"base-image","remoteUser":"vscode","containerEnv":{"BASE":"true"}}`
+	tests := []struct {
+		name            string
+		existingLabel   string
+		expectedEntries []string
+	}{
+		{
+			name:            "no existing label",
+			expectedEntries: []string{testFeatureTest + ":v0.1.11", testFeatureNode + ":v0.1.11", testFeaturePython + ":v0.1.11"},
+		},
+		{
+			name:            "appends to existing array",
+			existingLabel:   "[" + baseEntry + "]",
+			expectedEntries: []string{"base-image", testFeatureTest + ":v0.1.11", testFeatureNode + ":v0.1.11", testFeaturePython + ":v0.1.11"},
+		},
+		{
+			name:            "appends to existing object",
+			existingLabel:   baseEntry,
+			expectedEntries: []string{"base-image", testFeatureTest + ":v0.1.11", testFeatureNode + ":v0.1.11", testFeaturePython + ":v0.1.11"},
+		},
+		{
+			name:            "replaces entries from an earlier finalize",
+			existingLabel:   `[` + baseEntry + `,{"id":"` + testFeaturePython + `:v0.1.10"},{"id":"` + testFeatureNode + `"}]`,
+			expectedEntries: []string{"base-image", testFeatureTest + ":v0.1.11", testFeatureNode + ":v0.1.11", testFeaturePython + ":v0.1.11"},
+		},
+		{
+			name:            "replaces unreadable label",
+			existingLabel:   "[not json",
+			expectedEntries: []string{testFeatureTest + ":v0.1.11", testFeatureNode + ":v0.1.11", testFeaturePython + ":v0.1.11"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine, imageInspect := loadTestImageInspect(t)
+			if test.existingLabel != "" {
+				imageInspect.Config.Labels[DevContainerMetadataLabel] = test.existingLabel
+			}
+			postProcessingConfig := newPostProcessingConfig(testImage, imageInspect, "", FinalizeOptions{Engine: engine})
+
+			var entries []map[string]interface{}
+			if err := json.Unmarshal([]byte(devContainerMetadataLabel(postProcessingConfig)), &entries); err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, entry := range entries {
+				ids = append(ids, entry["id"].(string))
+			}
+			if !reflect.DeepEqual(ids, test.expectedEntries) {
+				t.Fatalf("Got entries %v, expected %v", ids, test.expectedEntries)
+			}
+
+			entriesById := make(map[string]map[string]interface{})
+			for _, entry := range entries {
+				entriesById[entry["id"].(string)] = entry
+			}
+			if base, hasBase := entriesById["base-image"]; hasBase && (base["remoteUser"] != "vscode" || base["containerEnv"] == nil) {
+				t.Errorf("Expected the existing entry to be kept as-is, got %v", base)
+			}
+			python := entriesById[testFeaturePython+":v0.1.11"]
+			if _, hasContainerEnv := python["containerEnv"]; hasContainerEnv {
+				t.Errorf("Expected containerEnv to be left out since it is in the image, got %v", python)
+			}
+			if python["customizations"] == nil {
+				t.Errorf("Expected VS Code customizations for %s, got %v", testFeaturePython, python)
+			}
+			if mounts := entriesById[testFeatureNode+":v0.1.11"]["mounts"]; !reflect.DeepEqual(mounts, []interface{}{"source=node-cache,target=/home/cnb/.npm,type=volume"}) {
+				t.Errorf("Got mounts %v for %s", mounts, testFeatureNode)
+			}
+			if test := entriesById[testFeatureTest+":v0.1.11"]; test["privileged"] != true || !reflect.DeepEqual(test["capAdd"], []interface{}{"SYS_PTRACE"}) {
+				t.Errorf("Got %v for %s", test, testFeatureTest)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package finalize
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Creates an image with one feature layer like pack would, with the lifecycle metadata label pointing at it
+func newTestFeatureImage(t *testing.T) v1.Image {
+	t.Helper()
+	featurePaths := newFeatureLayerPaths(defaultLayersDir, testFeaturePython)
+	layer := newLayerWriter()
+	layer.addDir(featurePaths.LayerPath, 0755)
+	layer.addFile(path.Join(featurePaths.LayerPath, "env", "PYTHON_HOME.default"), 0644, []byte(featurePaths.LayerPath))
+	layer.addFile(featurePaths.EnvFilePath(), 0644, []byte("_BUILD_ARG_PYTHON_VERSION=3.10\n"))
+	layer.addFile(path.Join(featurePaths.EntrypointD, "start.sh"), 0644, []byte("#!/bin/bash\necho started\n"))
+	featureLayer, err := layer.layer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffId, err := featureLayer.DiffID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := mutate.AppendLayers(empty.Image, featureLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layersMetadata, err := json.Marshal(map[string]interface{}{
+		"buildpacks": []interface{}{map[string]interface{}{
+			"key": "chuxel/devcontainer-features",
+			"layers": map[string]interface{}{"python": map[string]interface{}{
+				"sha":    diffId.String(),
+				"launch": true,
+				"data": map[string]interface{}{common.FeatureLayerMetadataId: common.LayerFeatureMetadata{
+					SchemaVersion:    common.LayerFeatureMetadataSchemaVersion,
+					Id:               testFeaturePython,
+					Version:          "v0.1.11",
+					Config:           common.FeatureConfig{Id: "python", ContainerEnv: map[string]string{"PYTHONPATH": "${PATH}:/opt/python"}},
+					OptionSelections: map[string]string{"version": "3.10"},
+				}},
+			}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err = mutate.Config(image, v1.Config{
+		User:       "cnb",
+		Env:        []string{"PATH=/cnb/process:/usr/bin:/bin", "CNB_USER_ID=1000"},
+		Entrypoint: []string{"/cnb/process/web"},
+		WorkingDir: "/workspace",
+		Labels: map[string]string{
+			"io.buildpacks.lifecycle.metadata": string(layersMetadata),
+			common.BuildModeMetadataId:         "devcontainer",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+func TestFinalizeImagePublish(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer server.Close()
+	registryHost := strings.TrimPrefix(server.URL, "http://")
+	sourceImage := registryHost + "/devpack/app:latest"
+	outputImage := registryHost + "/devpack/app:finalized"
+
+	sourceRef, err := name.ParseReference(sourceImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(sourceRef, newTestFeatureImage(t)); err != nil {
+		t.Fatal(err)
+	}
+	sourceDigest, err := remote.Head(sourceRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appFolder := t.TempDir()
+	FinalizeImage(sourceImage, appFolder, FinalizeOptions{Publish: true, OutputImage: outputImage, Keychain: authn.NewMultiKeychain()})
+
+	// The source image is left alone
+	if afterDigest, err := remote.Head(sourceRef); err != nil || afterDigest.Digest != sourceDigest.Digest {
+		t.Errorf("Source image changed from %s to %v (%v)", sourceDigest.Digest, afterDigest, err)
+	}
+
+	outputRef, err := name.ParseReference(outputImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finalized, err := remote.Image(outputRef)
+	if err != nil {
+		t.Fatal("Finalized image was not published: ", err)
+	}
+	inspect, err := inspectImage(finalized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := inspect.Config
+	if config.User != "cnb" || config.WorkingDir != "/workspace" {
+		t.Errorf("Expected user and working directory to be kept, got %+v", config)
+	}
+	if expected := []string{common.CommonEntrypointDBootstrapPath, "/cnb/process/web"}; strings.Join(config.Entrypoint, " ") != strings.Join(expected, " ") {
+		t.Errorf("Got entrypoint %v, expected %v", config.Entrypoint, expected)
+	}
+	if value := envVarValue(config.Env, "PYTHONPATH"); value != "/cnb/process:/usr/bin:/bin:/opt/python" {
+		t.Errorf("Got PYTHONPATH %q, expected containerEnv to be applied", value)
+	}
+	state := loadPostProcessingState(config.Labels)
+	if featureState, processed := state[testFeaturePython]; !processed || featureState.Legacy || featureState.LayerDiffId == "" {
+		t.Errorf("Got post processing state %+v", state)
+	}
+	if config.Labels[common.PostProcessingDoneMetadataId] != testFeaturePython {
+		t.Errorf("Got done label %q", config.Labels[common.PostProcessingDoneMetadataId])
+	}
+	if len(inspect.RootFS.Layers) != 2 {
+		t.Errorf("Expected the feature layer and a post processing layer, got %v", inspect.RootFS.Layers)
+	}
+
+	featurePaths := newFeatureLayerPaths(defaultLayersDir, testFeaturePython)
+	entrypointPath := path.Join(featurePaths.EntrypointD, "start.sh")
+	files, err := readImageFiles(finalized, func(filePath string) bool {
+		return strings.HasPrefix(filePath, commonEntrypointD) || strings.HasPrefix(filePath, featurePaths.LayerPath)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file, exists := files[entrypointPath]; !exists || file.Header.Mode&0111 != 0111 {
+		t.Errorf("Expected %s to be executable", entrypointPath)
+	}
+	if symlink := files[path.Join(commonEntrypointD, "layer-"+featurePaths.BuildpackFolder+"-python-start.sh")]; symlink.Header == nil || symlink.Header.Linkname != entrypointPath {
+		t.Errorf("Expected a symlink to %s in %s", entrypointPath, commonEntrypointD)
+	}
+	if _, exists := files[featurePaths.EnvFilePath()]; exists {
+		t.Errorf("Expected %s to be removed", featurePaths.EnvFilePath())
+	}
+
+	// devcontainer.json points at the published image
+	devContainerJson, err := os.ReadFile(filepath.Join(appFolder, ".devcontainer", "devcontainer.json.devpack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var devContainerJsonMap map[string]interface{}
+	if err := json.Unmarshal(devContainerJson, &devContainerJsonMap); err != nil {
+		t.Fatal(err)
+	}
+	if devContainerJsonMap["image"] != outputImage {
+		t.Errorf("Got image %v in devcontainer.json, expected %s", devContainerJsonMap["image"], outputImage)
+	}
+}
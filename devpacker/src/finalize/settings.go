@@ -0,0 +1,155 @@
+package finalize
+
+import (
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Ways arrays can be combined when the same setting is set in more than one place
+const (
+	ArrayMergeReplace = "replace" // The higher priority array replaces the other (default)
+	ArrayMergeUnion   = "union"   // Items from both arrays with duplicates removed
+	ArrayMergeAppend  = "append"  // Items from the higher priority array are added to the end of the other
+)
+
+const settingPathSeparator = " > "
+
+// Deep merges VS Code settings while tracking which feature set each value
+type settingsMerger struct {
+	arrayMerge string
+	provenance map[string]string
+}
+
+func newSettingsMerger(arrayMerge string) *settingsMerger {
+	if arrayMerge == "" {
+		arrayMerge = ArrayMergeReplace
+	}
+	if arrayMerge != ArrayMergeReplace && arrayMerge != ArrayMergeUnion && arrayMerge != ArrayMergeAppend {
+		log.Fatal("Invalid settings array merge mode: ", arrayMerge)
+	}
+	return &settingsMerger{arrayMerge: arrayMerge, provenance: make(map[string]string)}
+}
+
+// Merges settings from a feature into the target. Features merged later win over those merged earlier.
+func (sm *settingsMerger) mergeFeatureSettings(target map[string]interface{}, featureSettings map[string]interface{}, featureId string) {
+	sm.merge(target, featureSettings, featureId, "")
+}
+
+// Merges user settings into the target. User values always win over feature values.
+func (sm *settingsMerger) mergeUserSettings(target map[string]interface{}, userSettings map[string]interface{}) {
+	sm.merge(target, userSettings, "", "")
+}
+
+func (sm *settingsMerger) merge(target map[string]interface{}, source map[string]interface{}, sourceId string, parentPath string) {
+	for key, sourceValue := range source {
+		path := key
+		if parentPath != "" {
+			path = parentPath + settingPathSeparator + key
+		}
+		targetValue, exists := target[key]
+		if !exists {
+			target[key] = copySettingValue(sourceValue)
+			sm.setValueProvenance(path, sourceValue, sourceId)
+			continue
+		}
+		targetMap, targetIsMap := targetValue.(map[string]interface{})
+		sourceMap, sourceIsMap := sourceValue.(map[string]interface{})
+		if targetIsMap && sourceIsMap {
+			sm.merge(targetMap, sourceMap, sourceId, path)
+			continue
+		}
+		targetArray, targetIsArray := targetValue.([]interface{})
+		sourceArray, sourceIsArray := sourceValue.([]interface{})
+		if targetIsArray && sourceIsArray && sm.arrayMerge != ArrayMergeReplace {
+			target[key] = sm.mergeArrays(targetArray, sourceArray)
+			// Both sources contributed, so keep track of the feature unless this is a user value
+			if sourceId != "" {
+				sm.setProvenance(path, sm.provenance[path]+", "+sourceId)
+			}
+			continue
+		}
+		target[key] = copySettingValue(sourceValue)
+		sm.setValueProvenance(path, sourceValue, sourceId)
+	}
+}
+
+func (sm *settingsMerger) mergeArrays(target []interface{}, source []interface{}) []interface{} {
+	merged := append([]interface{}{}, target...)
+	for _, sourceItem := range source {
+		if sm.arrayMerge == ArrayMergeUnion && arrayContains(merged, sourceItem) {
+			continue
+		}
+		merged = append(merged, copySettingValue(sourceItem))
+	}
+	return merged
+}
+
+// Records the feature that set a setting path, or clears it (and anything below it) if set by the user
+func (sm *settingsMerger) setProvenance(path string, sourceId string) {
+	for existingPath := range sm.provenance {
+		if existingPath == path || strings.HasPrefix(existingPath, path+settingPathSeparator) {
+			delete(sm.provenance, existingPath)
+		}
+	}
+	if sourceId != "" {
+		sm.provenance[path] = strings.TrimPrefix(sourceId, ", ")
+	}
+}
+
+// Records provenance for each leaf setting in a value so user values set later can override part of an object
+func (sm *settingsMerger) setValueProvenance(path string, value interface{}, sourceId string) {
+	sm.setProvenance(path, "")
+	if valueMap, isMap := value.(map[string]interface{}); isMap && len(valueMap) > 0 {
+		for key, item := range valueMap {
+			sm.setValueProvenance(path+settingPathSeparator+key, item, sourceId)
+		}
+		return
+	}
+	sm.setProvenance(path, sourceId)
+}
+
+func (sm *settingsMerger) logProvenance() {
+	if len(sm.provenance) == 0 {
+		return
+	}
+	paths := make([]string, 0, len(sm.provenance))
+	for path := range sm.provenance {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	log.Println("Settings added by features:")
+	for _, path := range paths {
+		log.Printf("- %s: %s", path, sm.provenance[path])
+	}
+}
+
+// Deep copies maps and arrays so merging never modifies the settings of a feature
+func copySettingValue(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{})
+		for key, item := range typedValue {
+			copied[key] = copySettingValue(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, 0, len(typedValue))
+		for _, item := range typedValue {
+			copied = append(copied, copySettingValue(item))
+		}
+		return copied
+	default:
+		return value
+	}
+}
+
+func arrayContains(array []interface{}, item interface{}) bool {
+	for _, arrayItem := range array {
+		if reflect.DeepEqual(arrayItem, item) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package finalize
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+func TestSettingsMerger(t *testing.T) {
+	featureA := `{"editor.rulers": [80], "python.linting": {"enabled": true, "pylint": {"args": ["--a"]}}, "files.exclude": {"**/.git": true}}`
+	featureB := `{"editor.rulers": [80, 120], "python.linting": {"pylint": {"args": ["--b"]}, "flake8": true}, "terminal.shell": "bash"}`
+	tests := []struct {
+		name               string
+		arrayMerge         string
+		userSettings       string
+		expectedSettings   string
+		expectedProvenance map[string]string
+	}{
+		{
+			name:             "replace",
+			expectedSettings: `{"editor.rulers": [80, 120], "python.linting": {"enabled": true, "pylint": {"args": ["--b"]}, "flake8": true}, "files.exclude": {"**/.git": true}, "terminal.shell": "bash"}`,
+			expectedProvenance: map[string]string{
+				"editor.rulers":                  "b",
+				"python.linting > enabled":       "a",
+				"python.linting > pylint > args": "b",
+				"python.linting > flake8":        "b",
+				"files.exclude > **/.git":        "a",
+				"terminal.shell":                 "b",
+			},
+		},
+		{
+			name:             "union",
+			arrayMerge:       ArrayMergeUnion,
+			expectedSettings: `{"editor.rulers": [80, 120], "python.linting": {"enabled": true, "pylint": {"args": ["--a", "--b"]}, "flake8": true}, "files.exclude": {"**/.git": true}, "terminal.shell": "bash"}`,
+			expectedProvenance: map[string]string{
+				"editor.rulers":                  "a, b",
+				"python.linting > enabled":       "a",
+				"python.linting > pylint > args": "a, b",
+				"python.linting > flake8":        "b",
+				"files.exclude > **/.git":        "a",
+				"terminal.shell":                 "b",
+			},
+		},
+		{
+			name:             "append",
+			arrayMerge:       ArrayMergeAppend,
+			expectedSettings: `{"editor.rulers": [80, 80, 120], "python.linting": {"enabled": true, "pylint": {"args": ["--a", "--b"]}, "flake8": true}, "files.exclude": {"**/.git": true}, "terminal.shell": "bash"}`,
+			expectedProvenance: map[string]string{
+				"editor.rulers":                  "a, b",
+				"python.linting > enabled":       "a",
+				"python.linting > pylint > args": "a, b",
+				"python.linting > flake8":        "b",
+				"files.exclude > **/.git":        "a",
+				"terminal.shell":                 "b",
+			},
+		},
+		{
+			name:             "user values win",
+			arrayMerge:       ArrayMergeUnion,
+			userSettings:     `{"editor.rulers": [100], "python.linting": {"pylint": false}, "files.exclude": {"**/node_modules": true}}`,
+			expectedSettings: `{"editor.rulers": [80, 120, 100], "python.linting": {"enabled": true, "pylint": false, "flake8": true}, "files.exclude": {"**/.git": true, "**/node_modules": true}, "terminal.shell": "bash"}`,
+			expectedProvenance: map[string]string{
+				"editor.rulers":            "a, b",
+				"python.linting > enabled": "a",
+				"python.linting > flake8":  "b",
+				"files.exclude > **/.git":  "a",
+				"terminal.shell":           "b",
+			},
+		},
+		{
+			name:             "user values replace arrays",
+			userSettings:     `{"editor.rulers": [100], "python.linting": "off"}`,
+			expectedSettings: `{"editor.rulers": [100], "python.linting": "off", "files.exclude": {"**/.git": true}, "terminal.shell": "bash"}`,
+			expectedProvenance: map[string]string{
+				"files.exclude > **/.git": "a",
+				"terminal.shell":          "b",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merger := newSettingsMerger(test.arrayMerge)
+			settings := make(map[string]interface{})
+			merger.mergeFeatureSettings(settings, unmarshalSettings(t, featureA), "a")
+			merger.mergeFeatureSettings(settings, unmarshalSettings(t, featureB), "b")
+			if test.userSettings != "" {
+				merger.mergeUserSettings(settings, unmarshalSettings(t, test.userSettings))
+			}
+			if expected := unmarshalSettings(t, test.expectedSettings); !reflect.DeepEqual(settings, expected) {
+				t.Errorf("Got settings %v, expected %v", settings, expected)
+			}
+			if !reflect.DeepEqual(merger.provenance, test.expectedProvenance) {
+				t.Errorf("Got provenance %v, expected %v", merger.provenance, test.expectedProvenance)
+			}
+		})
+	}
+}
+
+func TestSettingsMergerDoesNotModifySources(t *testing.T) {
+	featureSettings := unmarshalSettings(t, `{"nested": {"array": [1]}}`)
+	merger := newSettingsMerger(ArrayMergeAppend)
+	settings := make(map[string]interface{})
+	merger.mergeFeatureSettings(settings, featureSettings, "a")
+	merger.mergeFeatureSettings(settings, unmarshalSettings(t, `{"nested": {"array": [2], "added": true}}`), "b")
+	if expected := unmarshalSettings(t, `{"nested": {"array": [1]}}`); !reflect.DeepEqual(featureSettings, expected) {
+		t.Errorf("Merging changed the feature settings to %v", featureSettings)
+	}
+}
+
+// Features installed later win over those installed earlier, regardless of their ids
+func TestGenerateFinalizeFeatureConfigSettingsLayerOrder(t *testing.T) {
+	engine, imageInspect := loadTestImageInspect(t)
+	postProcessingConfig := newPostProcessingConfig(testImage, imageInspect, "", FinalizeOptions{Engine: engine})
+	// Layer order is buildpack-test, nodejs, python
+	for featureId, value := range map[string]string{testFeatureTest: "test", testFeatureNode: "nodejs", testFeaturePython: "python"} {
+		layerFeatureMetadata := postProcessingConfig.LayerFeatureMetadata[featureId]
+		layerFeatureMetadata.Config.Settings = map[string]interface{}{"shared": value}
+		postProcessingConfig.LayerFeatureMetadata[featureId] = layerFeatureMetadata
+	}
+	finalizeFeatureConfig := generateFinalizeFeatureConfig(postProcessingConfig, newSettingsMerger(""))
+	if settings := finalizeFeatureConfig.VSCodeSettings(); settings["shared"] != "python" {
+		t.Errorf("Got %v, expected the value from the last feature layer", settings["shared"])
+	}
+
+	postProcessingConfig.LayerOrder = []string{testFeaturePython, testFeatureTest, testFeatureNode}
+	finalizeFeatureConfig = generateFinalizeFeatureConfig(postProcessingConfig, newSettingsMerger(""))
+	if settings := finalizeFeatureConfig.VSCodeSettings(); settings["shared"] != "nodejs" {
+		t.Errorf("Got %v, expected the value from the last feature layer", settings["shared"])
+	}
+}
+
+func TestMergeLegacyVSCodeProperties(t *testing.T) {
+	finalizeFeatureConfig := common.FeatureConfig{Id: FinalizeFeatureId}
+	finalizeFeatureConfig.SetVSCodeCustomizations(
+		[]string{"ms-python.python", "dbaeumer.vscode-eslint"},
+		map[string]interface{}{"python.pythonPath": "/feature/python", "editor.tabSize": 4.0, "terminal.shell": "bash"},
+		true)
+	devContainerJsonMap := map[string]json.RawMessage{
+		"settings":       json.RawMessage(`{"editor.tabSize": 2}`),
+		"customizations": json.RawMessage(`{"vscode": {"extensions": ["ms-python.python"], "settings": {"python.pythonPath": "/user/python"}}}`),
+	}
+
+	devContainerJsonMap = mergeLegacyVSCodeProperties(devContainerJsonMap, finalizeFeatureConfig, newSettingsMerger(""))
+	var extensions []string
+	if err := json.Unmarshal(devContainerJsonMap["extensions"], &extensions); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(extensions, []string{"dbaeumer.vscode-eslint"}) {
+		t.Errorf("Got extensions %v, expected those already in customizations.vscode to be skipped", extensions)
+	}
+	var settings map[string]interface{}
+	if err := json.Unmarshal(devContainerJsonMap["settings"], &settings); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"python.pythonPath": "/user/python", "editor.tabSize": 2.0, "terminal.shell": "bash"}
+	if !reflect.DeepEqual(settings, expected) {
+		t.Errorf("Got settings %v, expected %v", settings, expected)
+	}
+	if string(devContainerJsonMap["customizations"]) != `{"vscode": {"extensions": ["ms-python.python"], "settings": {"python.pythonPath": "/user/python"}}}` {
+		t.Errorf("Expected customizations to be left alone, got %s", devContainerJsonMap["customizations"])
+	}
+}
+
+func unmarshalSettings(t *testing.T, settingsJson string) map[string]interface{} {
+	t.Helper()
+	var settings map[string]interface{}
+	if err := json.Unmarshal([]byte(settingsJson), &settings); err != nil {
+		t.Fatal(err)
+	}
+	return settings
+}
@@ -0,0 +1,88 @@
+package finalize
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+// What a feature layer looked like when it was post processed, stored in the image's state label
+type PostProcessingState struct {
+	Id            string `json:"id"`
+	Version       string `json:"version,omitempty"`
+	OptionsDigest string `json:"optionsDigest,omitempty"`
+	LayerDiffId   string `json:"layerDiffId,omitempty"`
+	Legacy        bool   `json:"-"` // Only the id is known since it came from the legacy done label
+}
+
+func newPostProcessingState(postProcessingConfig PostProcessingConfig, featureId string) PostProcessingState {
+	layerFeatureMetadata := postProcessingConfig.LayerFeatureMetadata[featureId]
+	return PostProcessingState{
+		Id:            featureId,
+		Version:       layerFeatureMetadata.Version,
+		OptionsDigest: optionsDigest(layerFeatureMetadata),
+		LayerDiffId:   postProcessingConfig.LayerDiffIds[featureId],
+	}
+}
+
+// True if the feature layer has not changed. State from the legacy done label only has the id, so it always matches.
+func (state PostProcessingState) Matches(currentState PostProcessingState) bool {
+	if state.Legacy {
+		return state.Id == currentState.Id
+	}
+	return state == currentState
+}
+
+// Digest of the option selections and resolved option values for a feature layer. Layers from older versions of
+// devpacker do not have the salted digest of the real values, so the stored selections are used, which have secret
+// values redacted.
+func optionsDigest(layerFeatureMetadata common.LayerFeatureMetadata) string {
+	if layerFeatureMetadata.OptionsDigest != "" {
+		return layerFeatureMetadata.OptionsDigest
+	}
+	return common.OptionsDigest(layerFeatureMetadata.OptionSelections, layerFeatureMetadata.ResolvedOptions)
+}
+
+// Reads the post processing state label, falling back to the legacy done label for images finalized by older versions
+func loadPostProcessingState(labels map[string]string) map[string]PostProcessingState {
+	state := make(map[string]PostProcessingState)
+	if stateJson := labels[common.PostProcessingStateMetadataId]; stateJson != "" {
+		var states []PostProcessingState
+		if err := json.Unmarshal([]byte(stateJson), &states); err == nil {
+			for _, featureState := range states {
+				state[featureState.Id] = featureState
+			}
+			return state
+		}
+		log.Println("Unable to read post processing state label. Falling back to", common.PostProcessingDoneMetadataId)
+	}
+	for _, featureId := range strings.Fields(labels[common.PostProcessingDoneMetadataId]) {
+		state[featureId] = PostProcessingState{Id: featureId, Legacy: true}
+	}
+	return state
+}
+
+// Returns the post processing state label value, an array sorted by feature id
+func postProcessingStateLabel(state map[string]PostProcessingState) string {
+	states := []PostProcessingState{}
+	for _, featureId := range postProcessingStateIds(state) {
+		states = append(states, state[featureId])
+	}
+	labelBytes, err := json.Marshal(states)
+	if err != nil {
+		log.Fatal("Failed to marshal post processing state label: ", err)
+	}
+	return string(labelBytes)
+}
+
+func postProcessingStateIds(state map[string]PostProcessingState) []string {
+	featureIds := make([]string, 0, len(state))
+	for featureId := range state {
+		featureIds = append(featureIds, featureId)
+	}
+	sort.Strings(featureIds)
+	return featureIds
+}
@@ -0,0 +1,84 @@
+package finalize
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+// User an image runs as. Uid and Gid are -1 when they cannot be determined from the image config.
+type imageUser struct {
+	Name string
+	Uid  int
+	Gid  int
+}
+
+// Determines the image's user from USER in its config. USER can be a name or UID with an optional group. Stack
+// images also set CNB_USER_ID and CNB_GROUP_ID, which are used when USER is a name.
+func newImageUser(postProcessingConfig PostProcessingConfig) imageUser {
+	imageConfig := postProcessingConfig.ImageConfig
+	user := imageUser{Name: imageConfig.User, Uid: -1, Gid: -1}
+	group := ""
+	if index := strings.Index(user.Name, ":"); index > -1 {
+		group = user.Name[index+1:]
+		user.Name = user.Name[:index]
+	}
+	if user.Name == "" {
+		user.Name = "root"
+	}
+	if uid, err := strconv.Atoi(user.Name); err == nil {
+		user.Uid = uid
+	} else if user.Name == "root" {
+		user.Uid = 0
+	} else if uid, err := strconv.Atoi(envVarValue(imageConfig.Env, "CNB_USER_ID")); err == nil {
+		user.Uid = uid
+	}
+	if gid, err := strconv.Atoi(group); err == nil {
+		user.Gid = gid
+	} else if user.Uid == 0 {
+		user.Gid = 0
+	} else if gid, err := strconv.Atoi(envVarValue(imageConfig.Env, "CNB_GROUP_ID")); err == nil {
+		user.Gid = gid
+	}
+	return user
+}
+
+// Sets remoteUser, containerUser, and updateRemoteUserUID in devcontainer.json to match the image unless they
+// are already set, and warns if the image user's UID does not match the current user's. containerUser is not
+// set for Docker Compose, where the user for the service comes from the compose files.
+func addUserProperties(postProcessingConfig PostProcessingConfig, devContainerJsonMap map[string]json.RawMessage) map[string]json.RawMessage {
+	user := newImageUser(postProcessingConfig)
+	log.Printf("Image user: %s (UID %d, GID %d)", user.Name, user.Uid, user.Gid)
+	properties := []string{"containerUser", "remoteUser"}
+	if isDockerComposeConfig(devContainerJsonMap) {
+		properties = []string{"remoteUser"}
+	}
+	for _, property := range properties {
+		if devContainerJsonMap[property] == nil {
+			devContainerJsonMap[property] = common.ToJsonRawMessage(user.Name)
+		}
+	}
+	if user.Uid == 0 {
+		return devContainerJsonMap
+	}
+	if devContainerJsonMap["updateRemoteUserUID"] == nil {
+		devContainerJsonMap["updateRemoteUserUID"] = common.ToJsonRawMessage(true)
+	}
+	// os.Getuid returns -1 on Windows, where bind mounts do not use the host UID
+	if hostUid := os.Getuid(); hostUid > 0 && user.Uid > -1 && hostUid != user.Uid {
+		var updateRemoteUserUID bool
+		if err := json.Unmarshal(devContainerJsonMap["updateRemoteUserUID"], &updateRemoteUserUID); err != nil {
+			log.Fatal("Failed to unmarshal updateRemoteUserUID from devcontainer.json: ", err)
+		}
+		if updateRemoteUserUID {
+			log.Printf("Warning: Image user %s has UID %d, but your UID is %d. The UID will be updated when the dev container starts so files in the workspace have the right owner.", user.Name, user.Uid, hostUid)
+		} else {
+			log.Printf("Warning: Image user %s has UID %d, but your UID is %d and updateRemoteUserUID is false. Files in the workspace may have the wrong owner.", user.Name, user.Uid, hostUid)
+		}
+	}
+	return devContainerJsonMap
+}
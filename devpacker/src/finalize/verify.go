@@ -0,0 +1,139 @@
+package finalize
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+// Labels post processing is expected to change
+var postProcessingLabels = []string{common.PostProcessingDoneMetadataId, common.PostProcessingStateMetadataId, DevContainerMetadataLabel}
+
+// Returns the entrypoint wrapped with the common entrypoint bootstrap script, unless it already is
+func wrapEntrypoint(entrypoint []string) []string {
+	if common.SliceContainsString(entrypoint, common.CommonEntrypointDBootstrapPath) {
+		return entrypoint
+	}
+	return append([]string{common.CommonEntrypointDBootstrapPath}, entrypoint...)
+}
+
+// Encodes a Dockerfile exec form argument list like ENTRYPOINT ["a", "b"]
+func dockerfileJsonArray(values []string) string {
+	var buffer strings.Builder
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if values == nil {
+		values = []string{}
+	}
+	if err := encoder.Encode(values); err != nil {
+		log.Fatal("Failed to encode Dockerfile instruction: ", err)
+	}
+	return strings.TrimSpace(buffer.String())
+}
+
+// Quotes a value for a Dockerfile ENV instruction so spaces and quotes are kept. Variable references still expand.
+func dockerfileQuote(value string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(value) + "\""
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Checks that the post processed image config only differs from the original by the intended edits: the wrapped
+// entrypoint, containerEnv from the processed features, and post processing labels.
+func verifyPostProcessedImage(postProcessingConfig PostProcessingConfig, featuresProcessed []string, result common.ImageConfig) error {
+	original := postProcessingConfig.ImageConfig
+	var problems []string
+	if normalizeUser(result.User) != normalizeUser(original.User) {
+		problems = append(problems, "USER changed from \""+original.User+"\" to \""+result.User+"\"")
+	}
+	if result.WorkingDir != original.WorkingDir {
+		problems = append(problems, "WORKDIR changed from \""+original.WorkingDir+"\" to \""+result.WorkingDir+"\"")
+	}
+	if !stringSlicesEqual(result.Cmd, original.Cmd) {
+		problems = append(problems, "CMD changed from "+dockerfileJsonArray(original.Cmd)+" to "+dockerfileJsonArray(result.Cmd))
+	}
+	if expected := wrapEntrypoint(original.Entrypoint); !stringSlicesEqual(result.Entrypoint, expected) {
+		problems = append(problems, "ENTRYPOINT is "+dockerfileJsonArray(result.Entrypoint)+" instead of "+dockerfileJsonArray(expected))
+	}
+
+	// Env should be the original plus containerEnv from processed features
+	expectedEnv := append([]string{}, original.Env...)
+	for _, featureId := range featuresProcessed {
+		containerEnv := postProcessingConfig.LayerFeatureMetadata[featureId].Config.ContainerEnv
+		for _, varName := range sortedKeys(containerEnv) {
+			expectedEnv = setEnvVarValue(expectedEnv, varName, expandEnvVars(containerEnv[varName], expectedEnv))
+		}
+	}
+	resultEnv := make(map[string]string)
+	for _, envVar := range result.Env {
+		if index := strings.Index(envVar, "="); index > -1 {
+			resultEnv[envVar[:index]] = envVar[index+1:]
+		}
+	}
+	for _, envVar := range expectedEnv {
+		index := strings.Index(envVar, "=")
+		if index < 0 {
+			continue
+		}
+		if value, exists := resultEnv[envVar[:index]]; !exists || value != envVar[index+1:] {
+			problems = append(problems, "ENV "+envVar[:index]+" is \""+value+"\" instead of \""+envVar[index+1:]+"\"")
+		}
+	}
+
+	for label, value := range original.Labels {
+		if !common.SliceContainsString(postProcessingLabels, label) && result.Labels[label] != value {
+			problems = append(problems, "LABEL "+label+" changed")
+		}
+	}
+	for _, label := range postProcessingLabels {
+		if _, exists := result.Labels[label]; !exists {
+			problems = append(problems, "LABEL "+label+" is missing")
+		}
+	}
+	if !reflect.DeepEqual(portNames(result.ExposedPorts), portNames(original.ExposedPorts)) {
+		problems = append(problems, "EXPOSE changed")
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("Post processed image config has unexpected changes:\n- " + strings.Join(problems, "\n- "))
+	}
+	log.Println("Verified post processed image config.")
+	return nil
+}
+
+// An empty user and root are the same thing
+func normalizeUser(user string) string {
+	if user == "" || user == "0" {
+		return "root"
+	}
+	return user
+}
+
+func stringSlicesEqual(slice1 []string, slice2 []string) bool {
+	if len(slice1) == 0 && len(slice2) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(slice1, slice2)
+}
+
+func portNames(ports map[string]struct{}) []string {
+	names := []string{}
+	for port := range ports {
+		names = append(names, port)
+	}
+	sort.Strings(names)
+	return names
+}
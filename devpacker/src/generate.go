@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
 	"log"
 	"os"
@@ -78,17 +79,25 @@ func Generate(featuresPath string, outputPath string) {
 		buildpack.Stacks = append(buildpack.Stacks, libcnb.BuildpackStack{ID: stack})
 	}
 	var featureNameList []string
+	featureScripts := make(map[string][]string)
 	for _, feature := range featuresJson.Features {
 		featureNameList = append(featureNameList, feature.Id)
+		featureScripts[feature.Id] = feature.Scripts(outputPath)
 	}
 	buildpack.Metadata = make(map[string]interface{})
 	buildpack.Metadata[common.FeaturesetMetadataId] = devpackSettings
 	buildpack.Metadata[common.FeaturesMetadataId] = featureNameList
+	// Lets "devpacker list" describe a packaged Devpack from buildpack.toml alone
+	buildpack.Metadata[common.FeatureConfigsMetadataId] = featuresJson.Features
+	buildpack.Metadata[common.FeatureScriptsMetadataId] = featureScripts
 
 	// Write buildpack.toml - https://github.com/buildpacks/spec/blob/main/buildpack.md#buildpacktoml-toml
-	file, err := os.OpenFile(filepath.Join(outputPath, "buildpack.toml"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		log.Fatal(err)
+	// Encode first so an error does not leave a truncated buildpack.toml
+	var buildpackToml bytes.Buffer
+	if err := toml.NewEncoder(&buildpackToml).Encode(buildpack); err != nil {
+		log.Fatal("Failed to encode buildpack.toml: ", err)
+	}
+	if err := common.WriteFile(filepath.Join(outputPath, "buildpack.toml"), buildpackToml.Bytes()); err != nil {
+		log.Fatal("Failed to write buildpack.toml: ", err)
 	}
-	toml.NewEncoder(file).Encode(buildpack)
 }
@@ -4,6 +4,7 @@ require (
 	github.com/BurntSushi/toml v1.0.0
 	github.com/buildpacks/libcnb v1.25.4
 	github.com/buildpacks/lifecycle v0.13.3
+	github.com/google/go-containerregistry v0.8.0
 	github.com/joho/godotenv v1.4.0
 	github.com/tailscale/hujson v0.0.0-20211215203138-ffd971c5f362
 	gonum.org/v1/gonum v0.9.3
@@ -11,9 +12,20 @@ require (
 
 require (
 	github.com/buildpacks/imgutil v0.0.0-20211203200417-76206845baac // indirect
-	github.com/google/go-containerregistry v0.8.0 // indirect
+	github.com/containerd/stargz-snapshotter/estargz v0.10.1 // indirect
+	github.com/docker/cli v20.10.12+incompatible // indirect
+	github.com/docker/distribution v2.7.1+incompatible // indirect
+	github.com/docker/docker v20.10.12+incompatible // indirect
+	github.com/docker/docker-credential-helpers v0.6.4 // indirect
+	github.com/klauspost/compress v1.13.6 // indirect
+	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/onsi/gomega v1.17.0 // indirect
+	github.com/opencontainers/go-digest v1.0.0 // indirect
+	github.com/opencontainers/image-spec v1.0.2 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	github.com/sirupsen/logrus v1.8.1 // indirect
+	github.com/vbatts/tar-split v0.11.2 // indirect
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
 )
 
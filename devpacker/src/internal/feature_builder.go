@@ -2,6 +2,7 @@ package internal
 
 import (
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
@@ -12,6 +13,7 @@ import (
 	"github.com/chuxel/devpacker-features/devpacker/common"
 
 	"github.com/buildpacks/libcnb"
+	"github.com/joho/godotenv"
 )
 
 type FeatureBuilder struct {
@@ -30,6 +32,8 @@ type FeatureLayerContributor struct {
 	LayerTypes       libcnb.LayerTypes
 	Context          libcnb.BuildContext
 	OptionSelections map[string]string
+	// Selections before any values were pinned from devcontainer-lock.json
+	RequestedOptionSelections map[string]string
 }
 
 // Implementation of libcnb.Builder.Build
@@ -39,7 +43,6 @@ func (fb FeatureBuilder) Build(context libcnb.BuildContext) (libcnb.BuildResult,
 	log.Println("Application path:", context.Application.Path)
 	log.Println("Build mode:", buildMode)
 	log.Println("Number of plan entries:", len(context.Plan.Entries))
-	log.Println("Env:", os.Environ())
 
 	var result libcnb.BuildResult
 
@@ -49,11 +52,25 @@ func (fb FeatureBuilder) Build(context libcnb.BuildContext) (libcnb.BuildResult,
 	featuresJson := common.FeaturesJson{}
 	featuresJson.Load(context.Buildpack.Path)
 	log.Println("Number of features in Devpack:", len(featuresJson.Features))
+	common.AddFeatureSecrets(featuresJson.Features)
+	common.LogDebugEnvironment(os.Environ())
+
+	// Load devcontainer-lock.json so resolved option values can be pinned unless an update was requested
+	devContainerLock := common.DevContainerLock{}
+	if common.ShouldUpdateLock() {
+		log.Println("Ignoring any existing lock file since an update was requested.")
+		devContainerLock.Features = make(map[string]common.FeatureLock)
+	} else if lockFilePath := devContainerLock.Load(context.Application.Path); lockFilePath != "" {
+		log.Println("Pinning option selections from", lockFilePath)
+	}
 
 	// Process each feature if it is in the buildpack plan in the order they appear in features.json
 	for _, feature := range featuresJson.Features {
-		shouldAddLayer, layerContributor := createLayerContributorForFeature(feature, devpackSettings, context.Plan)
+		shouldAddLayer, layerContributor := createLayerContributorForFeature(feature, devpackSettings, context.Plan, devContainerLock)
 		if shouldAddLayer {
+			if feature.Deprecated {
+				log.Printf("Warning: Feature %s is deprecated.", layerContributor.FullFeatureId())
+			}
 			layerContributor.Context = context
 			result.Layers = append(result.Layers, layerContributor)
 		}
@@ -80,38 +97,102 @@ func (fb FeatureBuilder) Build(context libcnb.BuildContext) (libcnb.BuildResult,
 		Value: buildMode,
 	})
 
-	// If we're in devcontainer mode, delete the app folder contents so they are omitted in the output.
+	// If we're in devcontainer mode, prune the app folder contents so they are omitted in the output.
 	// This would not affect detection logic because any detect steps will have already run by this point.
 	if buildMode == "devcontainer" && os.Getenv(common.RemoveApplicationFolderOverrideEnvVarName) != "false" {
-		log.Println("(*) Removing contents at", context.Application.Path, "so they are not in the resulting output.")
-		entries, err := os.ReadDir(context.Application.Path)
+		pruneApplicationFolder(context.Application.Path)
+	} else {
+		log.Println("(*) Leaving application folder contents in place.")
+	}
+
+	return result, nil
+}
+
+// Removes everything in the application folder other than devcontainer.json and contents matching the include patterns
+// in BP_DCNB_APP_DIR_INCLUDE or customizations.devpack.appFolderInclude, unless they also match an exclude pattern.
+// Anything kept is staged in a private temp folder while the application folder is cleared out.
+func pruneApplicationFolder(applicationFolder string) {
+	log.Println("(*) Removing contents at", applicationFolder, "so they are not in the resulting output.")
+	var devContainerJson common.DevContainerJson
+	devContainerJsonRelativePath := ""
+	if devContainerJsonFullPath := devContainerJson.Load(applicationFolder); devContainerJsonFullPath != "" {
+		devContainerJsonRelativePath, _ = filepath.Rel(applicationFolder, devContainerJsonFullPath)
+	}
+	include := append(common.SplitList(os.Getenv(common.ApplicationFolderIncludeEnvVarName)), devContainerJson.Customizations.Devpack.AppFolderInclude...)
+	exclude := append(common.SplitList(os.Getenv(common.ApplicationFolderExcludeEnvVarName)), devContainerJson.Customizations.Devpack.AppFolderExclude...)
+	log.Println("Application folder include patterns:", include)
+	log.Println("Application folder exclude patterns:", exclude)
+
+	// Find everything that should be kept
+	var toKeep []string
+	err := filepath.WalkDir(applicationFolder, func(path string, entry fs.DirEntry, err error) error {
 		if err != nil {
-			log.Fatal("Failed to get directory contents in", context.Application.Path, "-", err)
+			return err
 		}
-		// Copy devcontainer.json so it can be used for subsequent processing
-		devContainerJsonFullPath := common.FindDevContainerJson(context.Application.Path)
-		if devContainerJsonFullPath != "" {
-			common.Cp(devContainerJsonFullPath, "/tmp/")
-			if filepath.Base(devContainerJsonFullPath) == "devcontainer.json" {
-				if os.Rename("/tmp/devcontainer.json", "/tmp/.devcontainer.json"); err != nil {
-					log.Fatal("Failed to rename devcontainer.json to .devcontainer.json: ", err)
-				}
-			}
+		if entry.IsDir() {
+			return nil
 		}
-		for _, entry := range entries {
-			if err := os.RemoveAll(filepath.Join(context.Application.Path, entry.Name())); err != nil {
-				log.Fatal("Failed to remove", entry.Name(), "-", err)
-			}
+		relativePath, err := filepath.Rel(applicationFolder, path)
+		if err != nil {
+			return err
 		}
-		// Copy devcontainer.json back
-		if devContainerJsonFullPath != "" {
-			common.Cp("/tmp/.devcontainer.json", context.Application.Path)
+		if relativePath == devContainerJsonRelativePath || (common.MatchesAnyGlob(include, relativePath) && !common.MatchesAnyGlob(exclude, relativePath)) {
+			toKeep = append(toKeep, relativePath)
 		}
-	} else {
-		log.Println("(*) Leaving application folder contents in place.")
+		return nil
+	})
+	if err != nil {
+		log.Fatal("Failed to get directory contents in ", applicationFolder, " - ", err)
 	}
 
-	return result, nil
+	// Stage kept contents in a private temp folder
+	stagingFolder, err := os.MkdirTemp("", "devpacker-app-")
+	if err != nil {
+		log.Fatal("Failed to create temp folder: ", err)
+	}
+	defer os.RemoveAll(stagingFolder)
+	for _, relativePath := range toKeep {
+		copyRelativePath(applicationFolder, stagingFolder, relativePath)
+	}
+
+	// Clear out the application folder and copy kept contents back
+	entries, err := os.ReadDir(applicationFolder)
+	if err != nil {
+		log.Fatal("Failed to get directory contents in ", applicationFolder, " - ", err)
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(applicationFolder, entry.Name())); err != nil {
+			log.Fatal("Failed to remove ", entry.Name(), " - ", err)
+		}
+	}
+	for _, relativePath := range toKeep {
+		copyRelativePath(stagingFolder, applicationFolder, relativePath)
+	}
+	log.Printf("(*) Kept %d file(s) in the application folder.", len(toKeep))
+}
+
+// Copies a file (or symlink) at the same relative path from one folder to another
+func copyRelativePath(fromFolder string, toFolder string, relativePath string) {
+	fromPath := filepath.Join(fromFolder, relativePath)
+	toParentFolder := filepath.Dir(filepath.Join(toFolder, relativePath))
+	if err := os.MkdirAll(toParentFolder, 0755); err != nil {
+		log.Fatal("Failed to create folder ", toParentFolder, ": ", err)
+	}
+	fileInfo, err := os.Lstat(fromPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fileInfo.Mode()&fs.ModeSymlink != 0 {
+		linkTarget, err := os.Readlink(fromPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.Symlink(linkTarget, filepath.Join(toFolder, relativePath)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	common.Cp(fromPath, toParentFolder)
 }
 
 func (fc FeatureLayerContributor) FullFeatureId() string {
@@ -138,10 +219,18 @@ func (fc FeatureLayerContributor) Contribute(layer libcnb.Layer) (libcnb.Layer,
 
 	// Always set targetPath to the layer path we were handed
 	fc.OptionSelections["targetPath"] = layer.Path
+	// Create a file the acquire script can use to report resolved option values
+	resolvedEnvFile, err := os.CreateTemp("", "devcontainer-features-resolved-*.env")
+	if err != nil {
+		log.Fatal("Failed to create temp file: ", err)
+	}
+	resolvedEnvFile.Close()
+	defer os.Remove(resolvedEnvFile.Name())
 	// Get build environment based on set options
 	env := fc.Feature.BuildEnvironment(fc.OptionSelections, map[string]string{
-		"PROFILE_D":    filepath.Join(layer.Path, "profile.d"),
-		"ENTRYPOINT_D": filepath.Join(layer.Path, common.DevContainerEntrypointD),
+		"PROFILE_D":                            filepath.Join(layer.Path, "profile.d"),
+		"ENTRYPOINT_D":                         filepath.Join(layer.Path, common.DevContainerEntrypointD),
+		common.ResolvedEnvFilePathVariableName: resolvedEnvFile.Name(),
 	})
 
 	// Run acquire script (if it exists)
@@ -166,9 +255,9 @@ func (fc FeatureLayerContributor) Contribute(layer libcnb.Layer) (libcnb.Layer,
 		// Copy configure script into layer if it exists
 		common.CpR(filepath.Join(fc.Context.Buildpack.Path, "features", fc.Feature.Id), featuresBase)
 		common.CpR(filepath.Join(fc.Context.Buildpack.Path, "common"), featureConfigBase)
-		// output an environment file that we can source later
+		// output an environment file that we can source later. Secrets are left out since the file is in the image.
 		envFileContents := ""
-		for _, line := range env {
+		for _, line := range common.OmitSecretEnv(env) {
 			envFileContents += line + "\n"
 		}
 		common.WriteFile(filepath.Join(featureConfigFolder, "devcontainer-features.env"), []byte(envFileContents))
@@ -180,12 +269,16 @@ func (fc FeatureLayerContributor) Contribute(layer libcnb.Layer) (libcnb.Layer,
 	}
 
 	// Add ID and option selections to layer metadata, add to LayerContributor
+	resolvedOptions := fc.resolvedOptions(resolvedEnvFile.Name())
 	layer.Metadata = make(map[string]interface{})
 	layer.Metadata[common.FeatureLayerMetadataId] = common.LayerFeatureMetadata{
+		SchemaVersion:    common.LayerFeatureMetadataSchemaVersion,
 		Id:               fc.FullFeatureId(),
 		Version:          fc.DevpackSettings.Version,
 		Config:           fc.Feature,
-		OptionSelections: fc.OptionSelections,
+		OptionSelections: fc.Feature.RedactOptionSelections(fc.RequestedOptionSelections),
+		ResolvedOptions:  resolvedOptions,
+		OptionsDigest:    common.SaltedOptionsDigest(fc.RequestedOptionSelections, resolvedOptions),
 	}
 
 	// TODO: Process containerEnv? Workaround: Do a build only layer with the vars, then post-process for run image by removing the env folder.
@@ -199,8 +292,31 @@ func (fc FeatureLayerContributor) Contribute(layer libcnb.Layer) (libcnb.Layer,
 	return layer, nil
 }
 
+// Returns the values options resolved to, starting with any pinned from the lock file and then applying
+// any values the acquire script reported in the resolved env file. Secret options are never included.
+func (fc FeatureLayerContributor) resolvedOptions(resolvedEnvFilePath string) map[string]string {
+	reportedValues, err := godotenv.Read(resolvedEnvFilePath)
+	if err != nil {
+		log.Fatal("Failed to read resolved option values for feature ", fc.FullFeatureId(), ": ", err)
+	}
+	resolvedOptions := make(map[string]string)
+	for optionId, option := range fc.Feature.Options {
+		if option.Secret {
+			continue
+		}
+		if selection, hasKey := fc.OptionSelections[optionId]; hasKey && selection != fc.RequestedOptionSelections[optionId] {
+			resolvedOptions[optionId] = selection
+		}
+		if value, hasKey := reportedValues[fc.Feature.OptionEnvVarName(common.OptionSelectionEnvVarPrefix, optionId)]; hasKey {
+			log.Printf("- Option %s resolved to %s", optionId, value)
+			resolvedOptions[optionId] = value
+		}
+	}
+	return resolvedOptions
+}
+
 // See if the build plan includes an entry for this feature. If so, return a LayerContributor for it
-func createLayerContributorForFeature(feature common.FeatureConfig, devpackSettings common.DevpackSettings, plan libcnb.BuildpackPlan) (bool, FeatureLayerContributor) {
+func createLayerContributorForFeature(feature common.FeatureConfig, devpackSettings common.DevpackSettings, plan libcnb.BuildpackPlan, devContainerLock common.DevContainerLock) (bool, FeatureLayerContributor) {
 	layerContributor := FeatureLayerContributor{Feature: feature, DevpackSettings: devpackSettings}
 	// See if detect said should provide this feature
 	for _, entry := range plan.Entries {
@@ -238,6 +354,15 @@ func createLayerContributorForFeature(feature common.FeatureConfig, devpackSetti
 				buildMode = common.GetContainerImageBuildMode()
 			}
 			optionSelections[common.BuildModeDevContainerJsonSetting] = fmt.Sprint(buildMode)
+			layerContributor.RequestedOptionSelections = make(map[string]string)
+			for optionId, selection := range optionSelections {
+				layerContributor.RequestedOptionSelections[optionId] = selection
+			}
+			// Pin any resolved values from the lock file
+			if featureLock, hasKey := devContainerLock.Features[fullFeatureId]; hasKey {
+				optionSelections = featureLock.PinOptionSelections(optionSelections)
+				log.Printf("- Pinned option selections for %s: %v", fullFeatureId, feature.RedactOptionSelections(optionSelections))
+			}
 			layerContributor.OptionSelections = optionSelections
 
 			return true, layerContributor
@@ -308,7 +433,9 @@ func (fc FeatureLayerContributor) executeFeatureScript(scriptName string, env []
 	command.Stderr = logWriter
 	command.Dir = fc.Context.Application.Path
 
-	if err := command.Run(); err != nil {
+	err := command.Run()
+	common.FlushLog()
+	if err != nil {
 		return false, err
 	}
 	exitCode := command.ProcessState.ExitCode()
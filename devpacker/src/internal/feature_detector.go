@@ -23,7 +23,6 @@ type FeatureDetector struct {
 func (fd FeatureDetector) Detect(context libcnb.DetectContext) (libcnb.DetectResult, error) {
 	log.Println("Devpack path:", context.Buildpack.Path)
 	log.Println("Application path:", context.Application.Path)
-	log.Println("Env:", os.Environ())
 
 	var result libcnb.DetectResult
 
@@ -33,6 +32,8 @@ func (fd FeatureDetector) Detect(context libcnb.DetectContext) (libcnb.DetectRes
 	featuresJson := common.FeaturesJson{}
 	featuresJson.Load(context.Buildpack.Path)
 	log.Println("Number of features in Devpack:", len(featuresJson.Features))
+	common.AddFeatureSecrets(featuresJson.Features)
+	common.LogDebugEnvironment(os.Environ())
 
 	// Load devcontainer.json if in devcontainer build mode
 	var devContainerJson common.DevContainerJson
@@ -109,7 +110,9 @@ func detectFeature(context libcnb.DetectContext, buildpackSettings common.Devpac
 	detectCommand.Env = env
 	detectCommand.Stdout = logWriter
 	detectCommand.Stderr = logWriter
-	if err := detectCommand.Run(); err != nil {
+	err = detectCommand.Run()
+	common.FlushLog()
+	if err != nil {
 		log.Fatal(err)
 	}
 
@@ -147,10 +150,9 @@ func detectOptionSelections(feature common.FeatureConfig, buildpackSettings comm
 				if reflect.TypeOf(jsonOptionSelections).String() == "string" {
 					optionSelections["version"] = jsonOptionSelections.(string)
 				} else {
-					// Use reflection to convert the from a map[string]interface{} to a map[string]string
-					mapRange := reflect.ValueOf(jsonOptionSelections).MapRange()
-					for mapRange.Next() {
-						optionSelections[mapRange.Key().String()] = mapRange.Value().Elem().String()
+					// Convert from a map[string]interface{} to a map[string]string, boolean options become "true" or "false"
+					for optionId, value := range jsonOptionSelections.(map[string]interface{}) {
+						optionSelections[optionId] = common.OptionValueString(value)
 					}
 				}
 				break
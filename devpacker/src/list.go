@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/BurntSushi/toml"
+	"github.com/chuxel/devpacker-features/devpacker/common"
+)
+
+// Output formats for the list command
+const (
+	ListFormatTable    = "table"
+	ListFormatJson     = "json"
+	ListFormatFeatures = "features" // A devcontainer.json "features" property
+)
+
+// Features in a feature set and the scripts each one implements
+type featureSet struct {
+	Settings common.DevpackSettings
+	Features []common.FeatureConfig
+	Scripts  map[string][]string
+}
+
+type featureListEntry struct {
+	Id          string                          `json:"id"`
+	FullId      string                          `json:"fullId"`
+	Name        string                          `json:"name,omitempty"`
+	Version     string                          `json:"version,omitempty"`
+	Description string                          `json:"description,omitempty"`
+	Deprecated  bool                            `json:"deprecated,omitempty"`
+	Options     map[string]common.FeatureOption `json:"options,omitempty"`
+	Scripts     []string                        `json:"scripts"`
+}
+
+type featureList struct {
+	Publisher  string             `json:"publisher"`
+	FeatureSet string             `json:"featureSet"`
+	Version    string             `json:"version,omitempty"`
+	Features   []featureListEntry `json:"features"`
+}
+
+// Lists the features in a feature set source folder, a generated Devpack folder, or a buildpack.toml file
+func List(path string, format string, writer io.Writer) {
+	set := loadFeatureSet(path)
+	switch format {
+	case ListFormatTable:
+		writeFeatureTable(set, writer)
+	case ListFormatJson:
+		writeJson(newFeatureList(set), writer)
+	case ListFormatFeatures:
+		writeJson(devContainerFeaturesSnippet(set), writer)
+	default:
+		log.Fatal("Invalid list format: ", format)
+	}
+}
+
+func loadFeatureSet(path string) featureSet {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !fileInfo.IsDir() {
+		return loadFeatureSetFromBuildpackToml(path)
+	}
+	if _, err := os.Stat(filepath.Join(path, "devcontainer-features.json")); err == nil {
+		set := featureSet{Scripts: make(map[string][]string)}
+		set.Settings.Load(path)
+		featuresJson := common.FeaturesJson{}
+		featuresJson.Load(path)
+		set.Features = featuresJson.Features
+		for _, feature := range set.Features {
+			set.Scripts[feature.Id] = feature.Scripts(path)
+		}
+		return set
+	}
+	if _, err := os.Stat(filepath.Join(path, "buildpack.toml")); err == nil {
+		return loadFeatureSetFromBuildpackToml(filepath.Join(path, "buildpack.toml"))
+	}
+	log.Fatal("No devcontainer-features.json or buildpack.toml found in ", path)
+	return featureSet{}
+}
+
+// Reads a feature set from the metadata "devpacker generate" adds to buildpack.toml
+func loadFeatureSetFromBuildpackToml(buildpackTomlPath string) featureSet {
+	var buildpackToml struct {
+		Metadata map[string]toml.Primitive `toml:"metadata"`
+	}
+	tomlMetadata, err := toml.DecodeFile(buildpackTomlPath, &buildpackToml)
+	if err != nil {
+		log.Fatal("Failed to read ", buildpackTomlPath, ": ", err)
+	}
+	decode := func(key string, value interface{}) bool {
+		primitive, hasKey := buildpackToml.Metadata[key]
+		if !hasKey {
+			return false
+		}
+		if err := tomlMetadata.PrimitiveDecode(primitive, value); err != nil {
+			log.Fatal("Failed to read ", key, " in ", buildpackTomlPath, ": ", err)
+		}
+		return true
+	}
+
+	set := featureSet{Scripts: make(map[string][]string)}
+	if !decode(common.FeaturesetMetadataId, &set.Settings) {
+		log.Fatal(buildpackTomlPath, " is not a Devpack buildpack.toml")
+	}
+	decode(common.FeatureScriptsMetadataId, &set.Scripts)
+	if !decode(common.FeatureConfigsMetadataId, &set.Features) {
+		// Devpacks generated by older versions of devpacker only have feature ids in buildpack.toml
+		log.Println("Warning:", buildpackTomlPath, "only has feature ids. Regenerate the Devpack for names and options.")
+		var featureIds []string
+		decode(common.FeaturesMetadataId, &featureIds)
+		for _, featureId := range featureIds {
+			set.Features = append(set.Features, common.FeatureConfig{Id: featureId})
+		}
+	}
+	if _, hasScripts := buildpackToml.Metadata[common.FeatureScriptsMetadataId]; !hasScripts {
+		// Look for scripts next to buildpack.toml instead
+		for _, feature := range set.Features {
+			set.Scripts[feature.Id] = feature.Scripts(filepath.Dir(buildpackTomlPath))
+		}
+	}
+	return set
+}
+
+func newFeatureList(set featureSet) featureList {
+	list := featureList{
+		Publisher:  set.Settings.Publisher,
+		FeatureSet: set.Settings.FeatureSet,
+		Version:    set.Settings.Version,
+		Features:   []featureListEntry{},
+	}
+	for _, feature := range set.Features {
+		scripts := set.Scripts[feature.Id]
+		if scripts == nil {
+			scripts = []string{}
+		}
+		list.Features = append(list.Features, featureListEntry{
+			Id:          feature.Id,
+			FullId:      feature.FullFeatureId(set.Settings, "/"),
+			Name:        feature.Name,
+			Version:     feature.Version,
+			Description: feature.Description,
+			Deprecated:  feature.Deprecated,
+			Options:     feature.Options,
+			Scripts:     scripts,
+		})
+	}
+	return list
+}
+
+// Returns a devcontainer.json "features" property that enables every feature with its default options
+func devContainerFeaturesSnippet(set featureSet) map[string]interface{} {
+	features := make(map[string]interface{})
+	for _, feature := range set.Features {
+		options := make(map[string]interface{})
+		for optionId, option := range feature.Options {
+			if option.Default != nil {
+				options[optionId] = option.Default
+			}
+		}
+		features[feature.FullFeatureId(set.Settings, "/")] = options
+	}
+	return map[string]interface{}{"features": features}
+}
+
+func writeFeatureTable(set featureSet, writer io.Writer) {
+	tableWriter := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tableWriter, "FEATURE\tNAME\tSCRIPTS\tOPTIONS")
+	for _, feature := range set.Features {
+		name := feature.Name
+		if feature.Deprecated {
+			name += " (deprecated)"
+		}
+		options := featureOptionSummaries(feature)
+		if len(options) == 0 {
+			options = []string{""}
+		}
+		fmt.Fprintf(tableWriter, "%s\t%s\t%s\t%s\n", feature.FullFeatureId(set.Settings, "/"), name, strings.Join(set.Scripts[feature.Id], ","), options[0])
+		for _, option := range options[1:] {
+			fmt.Fprintf(tableWriter, "\t\t\t%s\n", option)
+		}
+	}
+	if err := tableWriter.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Returns "id=default [enum values]" for each option, sorted by id
+func featureOptionSummaries(feature common.FeatureConfig) []string {
+	optionIds := make([]string, 0, len(feature.Options))
+	for optionId := range feature.Options {
+		optionIds = append(optionIds, optionId)
+	}
+	sort.Strings(optionIds)
+	summaries := []string{}
+	for _, optionId := range optionIds {
+		option := feature.Options[optionId]
+		summary := optionId
+		if option.Default != nil {
+			summary += "=" + common.OptionValueString(option.Default)
+		}
+		if len(option.Enum) > 0 {
+			summary += " [" + strings.Join(option.Enum, "|") + "]"
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
+
+func writeJson(value interface{}, writer io.Writer) {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "\t")
+	if err := encoder.Encode(value); err != nil {
+		log.Fatal("Failed to write JSON: ", err)
+	}
+}
@@ -8,44 +8,140 @@ import (
 	"strings"
 
 	"github.com/buildpacks/libcnb"
+	"github.com/chuxel/devpacker-features/devpacker/common"
 	"github.com/chuxel/devpacker-features/devpacker/finalize"
 	"github.com/chuxel/devpacker-features/devpacker/internal"
 )
 
+// Options for the list command, set by its flags
+type listOptions struct {
+	Format string
+}
+
+// Options for the inspect command, set by its flags
+type inspectOptions struct {
+	Json     bool
+	FromFile string
+	Finalize finalize.FinalizeOptions
+}
+
+// Options for the test command, set by its flags
+type testOptions struct {
+	JunitPath string // Where to write a JUnit XML report
+	Finalize  finalize.FinalizeOptions
+}
+
+var commands = []*command{
+	{
+		Name:        "generate",
+		Arguments:   "[features folder] [output folder]",
+		Description: "Generates a Devpack buildpack from a folder with devcontainer-features.json. The default command.\nThe features folder defaults to the current folder and the output folder to \"out\".",
+		Run:         executeGenerateCommand,
+	},
+	{
+		Name:        "build",
+		Arguments:   "<image> [pack CLI args]",
+		Description: "Builds an image using the pack CLI and then finalizes it.\nAny flags not listed below are passed to pack, so put the image name first.",
+		Flags:       addFinalizeFlags,
+		Run:         executePackBuildCommand,
+		PassThrough: true,
+	},
+	{
+		Name:        "finalize",
+		Arguments:   "<image> [application folder]",
+		Description: "Post processes features in an image built with a Devpack and generates devcontainer.json.devpack.",
+		Flags:       addFinalizeFlags,
+		Run:         executeFinalizeCommand,
+	},
+	{
+		Name:        "inspect",
+		Arguments:   "[image]",
+		Description: "Lists the features in an image built with a Devpack and whether they have been post processed.\nWith --from-file, reads saved \"docker inspect\" output instead, and the image is only needed if the file has more than one.",
+		Flags:       addInspectFlags,
+		Run:         executeInspectCommand,
+	},
+	{
+		Name:        "list",
+		Arguments:   "[features folder | buildpack.toml]",
+		Description: "Lists the features in a feature set, a generated Devpack folder, or a Devpack's buildpack.toml.\nThe path defaults to the current folder.",
+		Flags:       addListFlags,
+		Run:         executeListCommand,
+	},
+	{
+		Name:        "test",
+		Arguments:   "<image> [features folder]",
+		Description: "Runs the bin/test script of each feature in an image as the image's user.\nScripts come from the feature set in the features folder, which defaults to the current folder.",
+		ExitCodes:   []exitCode{{ExitSuccess, "All tests that ran passed"}, {ExitFailure, "A test failed or could not run, or no tests ran, see the log for details"}, {ExitUsage, "Invalid command, flags, or arguments"}},
+		Flags:       addTestFlags,
+		Run:         executeTestCommand,
+	},
+	{
+		Name:        "version",
+		Description: "Prints the devpacker version and the versions of its embedded assets.",
+		ExitCodes:   []exitCode{{ExitSuccess, "Success"}, {ExitUsage, "Invalid flags or arguments"}},
+		Run:         executeVersionCommand,
+	},
+	{
+		// Used by the Devpack's bin/detect and bin/build scripts
+		Name:    "_internal",
+		Hidden:  true,
+		RawArgs: true,
+		Run:     executeInternalCommand,
+	},
+}
+
 func main() {
-	// Define flags
-	var buildMode string
-	flag.StringVar(&buildMode, "mode", "", "Override container image build mode: production | devcontainer")
-	flag.Parse()
-	nonFlagArgs := flag.Args()
-
-	// First argument can be "generate", "finalize", "build", or "detect" - the latter two being internal only
-	// No arguments is assumed to be "generate" to avoid confusion about the internal commands
-	var commandName string
-	if len(nonFlagArgs) < 1 {
-		commandName = "generate"
-	} else {
-		commandName = nonFlagArgs[0]
-	}
+	common.InitLogging()
+	// No command is assumed to be "generate" to avoid confusion about the internal commands
+	os.Exit(runCli(commands, "generate", os.Args[1:]))
+}
 
-	switch commandName {
-	case "generate":
-		executeGenerateCommand(nonFlagArgs[1:])
-	case "finalize":
-		// Used to generate apply final build with the dev container CLI, output a devcontainer.json
-		executeFinalizeCommand(nonFlagArgs[1:], buildMode)
-	case "build":
-		// Runs pack build and does any needed pre and post processing
-		executePackBuildCommand(nonFlagArgs[1:], buildMode)
-	case "_internal":
-		// If doing a build or detect command, pass of processing to FeatureBuilder, FeatureDetector respectively
-		libcnb.Main(internal.FeatureDetector{}, internal.FeatureBuilder{}, libcnb.WithArguments(nonFlagArgs[1:]))
-	default:
-		fmt.Println("Invalid devpacker command:", nonFlagArgs[0])
-	}
+func addFinalizeFlags(flags *flag.FlagSet) interface{} {
+	options := &finalize.FinalizeOptions{}
+	flags.BoolVar(&options.UpdateLock, "update-lock", false, "Replace devcontainer-lock.json instead of merging into it")
+	flags.BoolVar(&options.DevContainerBuild, "devcontainer-build", false, "Run \"devcontainer build\" on the generated devcontainer.json to add any remaining features")
+	flags.StringVar(&options.DevContainerCliPath, "devcontainer-cli", finalize.DefaultDevContainerCliPath, "Path to the devcontainer CLI")
+	flags.StringVar(&options.OutputMode, "output", finalize.OutputModeMerge, "How config for features in the image is output: merge | feature")
+	flags.StringVar(&options.OutputImage, "output-image", "", "Where to write the finalized image, defaults to replacing the image")
+	flags.BoolVar(&options.Publish, "publish", false, "Read and write images without a transport prefix from a registry instead of the container engine")
+	addEngineFlags(flags, options)
+	flags.BoolVar(&options.LegacyVSCode, "legacy-vscode", false, "Output top level extensions and settings instead of customizations.vscode for older tools")
+	flags.StringVar(&options.SettingsArrayMerge, "settings-array-merge", finalize.ArrayMergeReplace, "How arrays in VS Code settings are merged: replace | union | append")
+	return options
 }
 
-func executeGenerateCommand(args []string) {
+func addEngineFlags(flags *flag.FlagSet, options *finalize.FinalizeOptions) {
+	flags.StringVar(&options.EngineName, "engine", "", "Container engine to use: docker | podman | nerdctl | buildah, detected if not set")
+	flags.StringVar(&options.DockerHost, "docker-host", "", "Docker compatible API host, defaults to DOCKER_HOST or the engine default")
+}
+
+func addListFlags(flags *flag.FlagSet) interface{} {
+	options := &listOptions{}
+	flags.StringVar(&options.Format, "format", ListFormatTable, "Output format: table | json | features (a devcontainer.json features property)")
+	return options
+}
+
+func addInspectFlags(flags *flag.FlagSet) interface{} {
+	options := &inspectOptions{}
+	flags.BoolVar(&options.Json, "json", false, "Output JSON instead of text")
+	flags.StringVar(&options.FromFile, "from-file", "", "Read the image from a file with saved \"docker inspect\" output instead of the container engine")
+	flags.BoolVar(&options.Finalize.Publish, "publish", false, "Read images without a transport prefix from a registry instead of the container engine")
+	addEngineFlags(flags, &options.Finalize)
+	return options
+}
+
+func addTestFlags(flags *flag.FlagSet) interface{} {
+	options := &testOptions{}
+	flags.StringVar(&options.JunitPath, "junit", "", "Write results to this file as JUnit XML")
+	addEngineFlags(flags, &options.Finalize)
+	return options
+}
+
+func executeGenerateCommand(commandOptions interface{}, args []string, passThroughArgs []string) int {
+	if len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "Too many arguments. Usage: devpacker generate [features folder] [output folder]")
+		return ExitUsage
+	}
 	featuresPath := "."
 	outputPath := "out"
 	if len(args) > 0 {
@@ -55,60 +151,130 @@ func executeGenerateCommand(args []string) {
 		outputPath = args[1]
 	}
 	Generate(featuresPath, outputPath)
+	return ExitSuccess
 }
 
-func executeFinalizeCommand(args []string, buildModeOverride string) {
-	var applicationFolder string
-	if len(args) < 1 {
-		fmt.Println("Missing required parameter. Usage: devpacker finalize <image ID> [application folder]")
-		os.Exit(1)
+func executeFinalizeCommand(commandOptions interface{}, args []string, passThroughArgs []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "Missing required parameter. Usage: devpacker finalize [flags] <image> [application folder]")
+		return ExitUsage
 	}
+	options := *commandOptions.(*finalize.FinalizeOptions)
+	options.BuildModeOverride = globals.BuildMode
+	applicationFolder := currentFolder()
 	if len(args) > 1 {
 		applicationFolder = args[1]
-	} else {
-		if cwd, err := os.Getwd(); err != nil {
-			log.Fatal("Unable got get current working directory.", err)
-		} else {
-			applicationFolder = cwd
-		}
 	}
-	imageToFinalize := args[0]
-	finalize.FinalizeImage(imageToFinalize, buildModeOverride, applicationFolder)
-}
-
-func executePackBuildCommand(args []string, buildModeOverride string) {
-	var applicationFolder string
-	var imageName string
-	var flagArgs []string
-	if len(args) < 1 {
-		fmt.Println("Missing required parameter. Usage: devpacker build <image ID> [pack CLI args]")
-		os.Exit(1)
-	}
-	for len(args) > 0 {
-		if strings.HasPrefix(args[0], "-") {
-			// Handle flags that have no value
-			if len(args) == 1 || strings.HasPrefix(args[1], "-") {
-				flagArgs = append(flagArgs, args[0])
-				args = args[1:]
-			} else {
-				// Update application folder if -p or --path flag found
-				if args[0] == "-p" || args[0] == "--path" {
-					applicationFolder = args[1]
-				}
-				flagArgs = append(flagArgs, args[0], args[1])
-				args = args[2:]
-			}
-		} else {
-			imageName = args[0]
-			args = args[1:]
+	finalize.FinalizeImage(args[0], applicationFolder, options)
+	return ExitSuccess
+}
+
+func executePackBuildCommand(commandOptions interface{}, args []string, passThroughArgs []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Missing required parameter. Usage: devpacker build [flags] <image> [pack CLI args]")
+		return ExitUsage
+	}
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "Unexpected arguments:", strings.Join(args, " ")+". Put the image name before pack CLI flags that take a value, e.g. devpacker build <image> --builder <builder>")
+		return ExitUsage
+	}
+	options := *commandOptions.(*finalize.FinalizeOptions)
+	options.BuildModeOverride = globals.BuildMode
+	packArgs := passThroughArgs
+	if options.Publish {
+		// Used by both pack and finalize
+		packArgs = append(packArgs, "--publish")
+	}
+	// Use the same application folder as pack if -p or --path is set
+	applicationFolder := ""
+	for i, arg := range packArgs {
+		if (arg == "-p" || arg == "--path") && i+1 < len(packArgs) {
+			applicationFolder = packArgs[i+1]
+		} else if strings.HasPrefix(arg, "--path=") {
+			applicationFolder = strings.TrimPrefix(arg, "--path=")
 		}
 	}
 	if applicationFolder == "" {
-		if cwd, err := os.Getwd(); err != nil {
-			log.Fatal("Unable got get current working directory.", err)
-		} else {
-			applicationFolder = cwd
+		applicationFolder = currentFolder()
+	}
+	PackBuild(args[0], applicationFolder, packArgs, options)
+	return ExitSuccess
+}
+
+func executeListCommand(commandOptions interface{}, args []string, passThroughArgs []string) int {
+	options := commandOptions.(*listOptions)
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "Too many arguments. Usage: devpacker list [flags] [features folder | buildpack.toml]")
+		return ExitUsage
+	}
+	if options.Format != ListFormatTable && options.Format != ListFormatJson && options.Format != ListFormatFeatures {
+		fmt.Fprintln(os.Stderr, "Invalid format:", options.Format)
+		return ExitUsage
+	}
+	path := "."
+	if len(args) > 0 {
+		path = args[0]
+	}
+	List(path, options.Format, os.Stdout)
+	return ExitSuccess
+}
+
+func executeInspectCommand(commandOptions interface{}, args []string, passThroughArgs []string) int {
+	options := commandOptions.(*inspectOptions)
+	if len(args) > 1 || (len(args) == 0 && options.FromFile == "") {
+		fmt.Fprintln(os.Stderr, "Missing required parameter. Usage: devpacker inspect [flags] [image]")
+		return ExitUsage
+	}
+	image := ""
+	if len(args) > 0 {
+		image = args[0]
+	}
+	info := finalize.InspectImage(image, options.FromFile, options.Finalize)
+	if options.Json {
+		if err := info.WriteJson(os.Stdout); err != nil {
+			log.Fatal("Failed to write JSON: ", err)
 		}
+	} else {
+		info.WriteText(os.Stdout)
+	}
+	return ExitSuccess
+}
+
+func executeTestCommand(commandOptions interface{}, args []string, passThroughArgs []string) int {
+	options := commandOptions.(*testOptions)
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "Missing required parameter. Usage: devpacker test [flags] <image> [features folder]")
+		return ExitUsage
+	}
+	featuresPath := currentFolder()
+	if len(args) > 1 {
+		featuresPath = args[1]
+	}
+	if !finalize.RunFeatureTests(args[0], featuresPath, options.JunitPath, options.Finalize) {
+		return ExitFailure
+	}
+	return ExitSuccess
+}
+
+func executeVersionCommand(commandOptions interface{}, args []string, passThroughArgs []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "Unexpected arguments. Usage: devpacker version")
+		return ExitUsage
+	}
+	printVersion(os.Stdout)
+	return ExitSuccess
+}
+
+func executeInternalCommand(commandOptions interface{}, args []string, passThroughArgs []string) int {
+	// If doing a build or detect command, pass of processing to FeatureBuilder, FeatureDetector respectively
+	libcnb.Main(internal.FeatureDetector{}, internal.FeatureBuilder{}, libcnb.WithArguments(args))
+	return ExitSuccess
+}
+
+func currentFolder() string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatal("Unable got get current working directory.", err)
 	}
-	PackBuild(imageName, buildModeOverride, applicationFolder, flagArgs)
+	return cwd
 }
@@ -1,26 +1,60 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 
+	"github.com/buildpacks/lifecycle/platform"
 	"github.com/chuxel/devpacker-features/devpacker/common"
 	"github.com/chuxel/devpacker-features/devpacker/finalize"
 )
 
-func PackBuild(imageName string, buildModeOverride string, applicationFolder string, packArgs []string) {
+// What pack and the lifecycle need from a run image: the stack id label, and the CNB user and group
+type stackConfig struct {
+	StackId string
+	UserId  string
+	GroupId string
+}
+
+func PackBuild(imageName string, applicationFolder string, packArgs []string, options finalize.FinalizeOptions) {
 	log.Println("Image name:", imageName)
 	log.Println("Application folder:", applicationFolder)
-	log.Println("Pack CLI arguments:", packArgs)
-	execPackBuild(imageName, buildModeOverride, applicationFolder, packArgs)
-	finalize.FinalizeImage(imageName, buildModeOverride, applicationFolder)
+	log.Println("Pack CLI arguments:", common.RedactArgs(packArgs))
+	if options.Engine == nil {
+		engine, err := common.NewContainerEngine(options.EngineName, options.DockerHost, options.Runner)
+		if err != nil {
+			log.Fatal("Failed to connect to container engine: ", err)
+		}
+		options.Engine = engine
+	}
+	log.Println("Container engine:", options.Engine.Name())
+	if runImage := buildDevContainerDockerfile(imageName, applicationFolder, packArgs, options); runImage != "" {
+		packArgs = append(packArgs, "--run-image", runImage)
+		// pack pulls the run image by default, but this one only exists locally
+		if packArgValue(packArgs, "--pull-policy") == "" {
+			packArgs = append(packArgs, "--pull-policy", "if-not-present")
+		}
+	}
+	execPackBuild(imageName, applicationFolder, packArgs, options)
+	finalize.FinalizeImage(imageName, applicationFolder, options)
 }
 
-func execPackBuild(imageName string, buildMode string, applicationFolder string, packArgs []string) {
+func execPackBuild(imageName string, applicationFolder string, packArgs []string, options finalize.FinalizeOptions) {
 	args := []string{"build", imageName}
-	if buildMode != "" {
-		packArgs = append(args, "-e", common.ContainerImageBuildModeEnvVarName+"="+buildMode)
+	if options.BuildModeOverride != "" {
+		args = append(args, "-e", common.ContainerImageBuildModeEnvVarName+"="+options.BuildModeOverride)
+	}
+	if options.UpdateLock {
+		args = append(args, "-e", common.UpdateLockEnvVarName+"=true")
+	}
+	// Point pack at the same engine used to finalize the image
+	if dockerHost := options.Engine.DockerApiHost(); dockerHost != "" {
+		args = append(args, "--docker-host", dockerHost)
 	}
 	args = append(args, packArgs...)
 	// Invoke dev container CLI
@@ -31,9 +65,201 @@ func execPackBuild(imageName string, buildMode string, applicationFolder string,
 	packCommand.Stderr = writer
 	packCommand.Dir = applicationFolder
 	commandErr := packCommand.Run()
+	common.FlushLog()
 
 	// Report command error if there was one
 	if commandErr != nil || packCommand.ProcessState.ExitCode() != 0 {
 		log.Fatal("Failed to build using pack CLI. " + commandErr.Error())
 	}
 }
+
+// Builds the Dockerfile from the build property in devcontainer.json, if there is one, so it can be used as the
+// run image that feature layers are added to. If the image is missing the stack label or CNB user, they are added
+// from the builder in a second build. Returns the tag of the built image or an empty string.
+//
+// Features are still installed using the builder's build image, so they need to work on the Dockerfile's OS.
+func buildDevContainerDockerfile(imageName string, applicationFolder string, packArgs []string, options finalize.FinalizeOptions) string {
+	devContainerJson := common.DevContainerJson{}
+	devContainerJsonPath := devContainerJson.Load(applicationFolder)
+	if devContainerJson.Build == nil || devContainerJson.Build.Dockerfile == "" {
+		return ""
+	}
+	if buildMode := packBuildMode(packArgs, options); buildMode != "devcontainer" {
+		log.Println("Skipping devcontainer.json Dockerfile since build mode is", buildMode+". Pass --mode devcontainer to use it.")
+		return ""
+	}
+	if packArgValue(packArgs, "--run-image") != "" {
+		log.Println("Skipping devcontainer.json Dockerfile since --run-image was specified.")
+		return ""
+	}
+	if options.Publish {
+		log.Fatal("Images built from the Dockerfile in devcontainer.json are only in the local container engine and cannot be used as a run image with --publish. Build and push it, then pass it to pack using --run-image.")
+	}
+
+	devContainerJsonFolder := filepath.Dir(devContainerJsonPath)
+	contextDir := filepath.Join(devContainerJsonFolder, devContainerJson.Build.Context)
+	dockerfile, err := dockerfileInContext(contextDir, filepath.Join(devContainerJsonFolder, devContainerJson.Build.Dockerfile))
+	if err != nil {
+		log.Fatal(err)
+	}
+	buildArgs := make(map[string]string)
+	for name, value := range devContainerJson.Build.Args {
+		buildArgs[name] = common.ResolveLocalEnv(value)
+	}
+	repository, tag := common.SplitImageTag(imageName)
+	runImage := repository + ":" + tag + "-devcontainer-base"
+	log.Println("Building", dockerfile, "from devcontainer.json as the run image:", runImage)
+	log.Println("Note: Features are installed using the builder's build image, so they need to support the Dockerfile's base image.")
+	err = options.Engine.ImageBuild(common.ImageBuildOptions{
+		ContextDir: contextDir,
+		Dockerfile: dockerfile,
+		BuildArgs:  buildArgs,
+		Target:     devContainerJson.Build.Target,
+		Tag:        runImage,
+	})
+	if err != nil {
+		log.Fatal("Failed to build Dockerfile from devcontainer.json: ", err)
+	}
+	if err := addStackConfig(runImage, packArgs, options.Engine); err != nil {
+		log.Fatal("Failed to use the image built from the Dockerfile in devcontainer.json as a run image: ", err)
+	}
+	return runImage
+}
+
+// Returns the path of the Dockerfile relative to the build context. The Dockerfile is sent to the container
+// engine with the context, so it has to be inside of it.
+func dockerfileInContext(contextDir string, dockerfilePath string) (string, error) {
+	dockerfile, err := filepath.Rel(contextDir, dockerfilePath)
+	if err != nil {
+		return "", errors.New("Failed to find Dockerfile in build context: " + err.Error())
+	}
+	if dockerfile == ".." || strings.HasPrefix(dockerfile, ".."+string(filepath.Separator)) {
+		return "", errors.New("The Dockerfile in devcontainer.json (" + dockerfilePath + ") must be inside the build context (" + contextDir + "). Update build.context to a folder that contains it.")
+	}
+	return dockerfile, nil
+}
+
+// Rebuilds the run image with the stack id label, CNB user and group, and non-root user pack and the lifecycle
+// expect if any are missing. Missing values come from the builder passed to pack using --builder.
+func addStackConfig(runImage string, packArgs []string, engine common.ContainerEngine) error {
+	runImageInspect, err := engine.ImageInspect(runImage)
+	if err != nil {
+		return err
+	}
+	runImageStack := newStackConfig(runImageInspect.Config)
+	if runImageStack.StackId != "" && runImageStack.UserId != "" && runImageStack.GroupId != "" {
+		return nil
+	}
+
+	builder := packArgValue(packArgs, "--builder", "-B")
+	if builder == "" {
+		return errors.New("It is missing the " + platform.StackIDLabel + " label or CNB_USER_ID and CNB_GROUP_ID. Base the Dockerfile on the builder's run image, or pass --builder so they can be copied from the builder.")
+	}
+	builderInspect, err := engine.ImageInspect(builder)
+	if err != nil {
+		return errors.New("Unable to inspect builder " + builder + " to get its stack. Pull it and try again: " + err.Error())
+	}
+	builderStack := newStackConfig(builderInspect.Config)
+	if runImageStack.StackId != "" && runImageStack.StackId != builderStack.StackId {
+		return errors.New("It is for stack " + runImageStack.StackId + ", but builder " + builder + " is for stack " + builderStack.StackId)
+	}
+	if builderStack.StackId == "" || builderStack.UserId == "" || builderStack.GroupId == "" {
+		return errors.New("Builder " + builder + " does not have a stack id, CNB_USER_ID, and CNB_GROUP_ID")
+	}
+
+	log.Println("Adding stack", builderStack.StackId, "and CNB user from", builder, "to", runImage)
+	contextDir, err := os.MkdirTemp("", "devpacker-run-image-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(contextDir)
+	// Keep any values from the Dockerfile and only run as the CNB user if the image would otherwise run as root
+	stack := runImageStack
+	if stack.StackId == "" {
+		stack.StackId = builderStack.StackId
+	}
+	if stack.UserId == "" || stack.GroupId == "" {
+		stack.UserId = builderStack.UserId
+		stack.GroupId = builderStack.GroupId
+	}
+	if err := common.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte(stackConfigDockerfile(runImage, stack, isRootUser(runImageInspect.Config.User)))); err != nil {
+		return err
+	}
+	return engine.ImageBuild(common.ImageBuildOptions{ContextDir: contextDir, Dockerfile: "Dockerfile", Tag: runImage})
+}
+
+// True if an image USER (user[:group]) is root
+func isRootUser(user string) bool {
+	if index := strings.Index(user, ":"); index > -1 {
+		user = user[:index]
+	}
+	return user == "" || user == "root" || user == "0"
+}
+
+func newStackConfig(imageConfig common.ImageConfig) stackConfig {
+	stack := stackConfig{StackId: imageConfig.Labels[platform.StackIDLabel]}
+	for _, envVar := range imageConfig.Env {
+		if strings.HasPrefix(envVar, "CNB_USER_ID=") {
+			stack.UserId = strings.TrimPrefix(envVar, "CNB_USER_ID=")
+		} else if strings.HasPrefix(envVar, "CNB_GROUP_ID=") {
+			stack.GroupId = strings.TrimPrefix(envVar, "CNB_GROUP_ID=")
+		}
+	}
+	return stack
+}
+
+func stackConfigDockerfile(baseImage string, stack stackConfig, setUser bool) string {
+	dockerfile := fmt.Sprintf("FROM %s\nLABEL %s=%q\nENV CNB_USER_ID=%q CNB_GROUP_ID=%q CNB_STACK_ID=%q\n", baseImage, platform.StackIDLabel, stack.StackId, stack.UserId, stack.GroupId, stack.StackId)
+	if setUser {
+		dockerfile += "USER " + stack.UserId + ":" + stack.GroupId + "\n"
+	}
+	return dockerfile
+}
+
+// Returns the build mode pack will build with: --mode, BP_DCNB_BUILD_MODE passed to pack using -e or --env, or the
+// mode in the builder's build mode file. Falls back to the default if the builder is not known or cannot be run.
+func packBuildMode(packArgs []string, options finalize.FinalizeOptions) string {
+	if options.BuildModeOverride != "" {
+		return options.BuildModeOverride
+	}
+	buildMode := ""
+	for _, envVar := range packArgValues(packArgs, "--env", "-e") {
+		if strings.HasPrefix(envVar, common.ContainerImageBuildModeEnvVarName+"=") {
+			buildMode = strings.TrimPrefix(envVar, common.ContainerImageBuildModeEnvVarName+"=")
+		}
+	}
+	if buildMode != "" {
+		return buildMode
+	}
+	if builder := packArgValue(packArgs, "--builder", "-B"); builder != "" {
+		result, err := options.Engine.ContainerRun(common.ContainerRunOptions{Image: builder, Command: []string{"cat", common.ContainerImageBuildMarkerPath}})
+		if err == nil && result.ExitCode == 0 && strings.TrimSpace(result.Output) != "" {
+			return strings.TrimSpace(result.Output)
+		}
+		log.Println("Unable to read the build mode from builder", builder+". Assuming", common.DefaultContainerImageBuildMode, "mode.")
+	}
+	return common.DefaultContainerImageBuildMode
+}
+
+// Returns the value of a pack flag in either "--flag value" or "--flag=value" form
+func packArgValue(packArgs []string, names ...string) string {
+	if values := packArgValues(packArgs, names...); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Returns the values of a pack flag that can be repeated, like --env
+func packArgValues(packArgs []string, names ...string) []string {
+	var values []string
+	for i, arg := range packArgs {
+		for _, name := range names {
+			if arg == name && i+1 < len(packArgs) {
+				values = append(values, packArgs[i+1])
+			} else if strings.HasPrefix(arg, name+"=") {
+				values = append(values, strings.TrimPrefix(arg, name+"="))
+			}
+		}
+	}
+	return values
+}
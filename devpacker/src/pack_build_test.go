@@ -0,0 +1,207 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chuxel/devpacker-features/devpacker/common"
+	"github.com/chuxel/devpacker-features/devpacker/finalize"
+)
+
+func TestDockerfileInContext(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "workspace", "app")
+	tests := []struct {
+		contextDir  string
+		dockerfile  string
+		expected    string
+		expectError bool
+	}{
+		{contextDir: filepath.Join(root, ".devcontainer"), dockerfile: filepath.Join(root, ".devcontainer", "Dockerfile"), expected: "Dockerfile"},
+		{contextDir: root, dockerfile: filepath.Join(root, ".devcontainer", "Dockerfile"), expected: filepath.Join(".devcontainer", "Dockerfile")},
+		{contextDir: filepath.Join(root, ".devcontainer"), dockerfile: filepath.Join(root, "Dockerfile"), expectError: true},
+		{contextDir: filepath.Join(root, "src"), dockerfile: filepath.Join(root, "..", "Dockerfile"), expectError: true},
+		{contextDir: root, dockerfile: filepath.Join(root, "..Dockerfile"), expected: "..Dockerfile"},
+	}
+	for _, test := range tests {
+		dockerfile, err := dockerfileInContext(test.contextDir, test.dockerfile)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("Expected an error for %s in %s, got %s", test.dockerfile, test.contextDir, dockerfile)
+			}
+			continue
+		}
+		if err != nil || dockerfile != test.expected {
+			t.Errorf("Got %q (%v), expected %q", dockerfile, err, test.expected)
+		}
+	}
+}
+
+func TestAddStackConfig(t *testing.T) {
+	const runImage = "app:latest-devcontainer-base"
+	const builder = "ghcr.io/chuxel/devcontainer-features/builder-devcontainer"
+	stackImage := func(image string, user string, stackId string, env ...string) common.ImageInspect {
+		labels := map[string]string{}
+		if stackId != "" {
+			labels["io.buildpacks.stack.id"] = stackId
+		}
+		return common.ImageInspect{Id: "sha256:" + image, RepoTags: []string{image}, Config: common.ImageConfig{User: user, Env: env, Labels: labels}}
+	}
+	builderImage := stackImage(builder, "cnb", "io.buildpacks.stacks.bionic", "CNB_USER_ID=1000", "CNB_GROUP_ID=1000")
+	tests := []struct {
+		name          string
+		runImage      common.ImageInspect
+		packArgs      []string
+		expectBuild   bool
+		errorContains string
+	}{
+		{
+			name:     "based on the run image",
+			runImage: stackImage(runImage, "1000:1000", "io.buildpacks.stacks.bionic", "CNB_USER_ID=1000", "CNB_GROUP_ID=1000"),
+		},
+		{
+			name:        "copied from the builder",
+			runImage:    stackImage(runImage, "", ""),
+			packArgs:    []string{"--builder", builder},
+			expectBuild: true,
+		},
+		{
+			name:        "builder flag with a value",
+			runImage:    stackImage(runImage, "vscode", "io.buildpacks.stacks.bionic"),
+			packArgs:    []string{"-e", "A=b", "--builder=" + builder},
+			expectBuild: true,
+		},
+		{
+			name:          "no builder",
+			runImage:      stackImage(runImage, "", ""),
+			errorContains: "--builder",
+		},
+		{
+			name:          "different stack",
+			runImage:      stackImage(runImage, "", "io.buildpacks.stacks.jammy"),
+			packArgs:      []string{"-B", builder},
+			errorContains: "io.buildpacks.stacks.jammy",
+		},
+		{
+			name:          "builder not pulled",
+			runImage:      stackImage(runImage, "", ""),
+			packArgs:      []string{"--builder", "missing-builder"},
+			errorContains: "Pull it",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine := common.NewReplayEngine(builderImage, test.runImage)
+			err := addStackConfig(runImage, test.packArgs, engine)
+			if test.errorContains != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errorContains) {
+					t.Errorf("Expected an error containing %q, got %v", test.errorContains, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.expectBuild != (len(engine.Builds) == 1) {
+				t.Fatalf("Got builds %+v", engine.Builds)
+			}
+			if test.expectBuild && (engine.Builds[0].Tag != runImage || engine.Builds[0].Dockerfile != "Dockerfile") {
+				t.Errorf("Got build %+v", engine.Builds[0])
+			}
+		})
+	}
+}
+
+func TestStackConfigDockerfile(t *testing.T) {
+	stack := stackConfig{StackId: "io.buildpacks.stacks.bionic", UserId: "1000", GroupId: "1001"}
+	expected := `FROM app:base
+LABEL io.buildpacks.stack.id="io.buildpacks.stacks.bionic"
+ENV CNB_USER_ID="1000" CNB_GROUP_ID="1001" CNB_STACK_ID="io.buildpacks.stacks.bionic"
+`
+	if dockerfile := stackConfigDockerfile("app:base", stack, false); dockerfile != expected {
+		t.Errorf("Got:\n%s\nExpected:\n%s", dockerfile, expected)
+	}
+	if dockerfile := stackConfigDockerfile("app:base", stack, true); dockerfile != expected+"USER 1000:1001\n" {
+		t.Errorf("Expected the user to be set, got:\n%s", dockerfile)
+	}
+	for user, expected := range map[string]bool{"": true, "root": true, "0:0": true, "cnb": false, "1000:1000": false} {
+		if isRootUser(user) != expected {
+			t.Errorf("Expected isRootUser(%q) to be %v", user, expected)
+		}
+	}
+}
+
+func TestPackBuildMode(t *testing.T) {
+	const builder = "ghcr.io/chuxel/devcontainer-features/builder-devcontainer"
+	builderMode := func(mode string) func(options common.ContainerRunOptions) (common.ContainerRunResult, error) {
+		return func(options common.ContainerRunOptions) (common.ContainerRunResult, error) {
+			if options.Image != builder || options.Command[len(options.Command)-1] != common.ContainerImageBuildMarkerPath {
+				t.Errorf("Unexpected run %+v", options)
+			}
+			return common.ContainerRunResult{Output: mode + "\n"}, nil
+		}
+	}
+	tests := []struct {
+		name      string
+		override  string
+		packArgs  []string
+		runResult func(options common.ContainerRunOptions) (common.ContainerRunResult, error)
+		expected  string
+	}{
+		{name: "default", expected: "production"},
+		{name: "override", override: "devcontainer", packArgs: []string{"-e", "BP_DCNB_BUILD_MODE=production"}, expected: "devcontainer"},
+		{name: "pack env", packArgs: []string{"-e", "A=b", "--env=BP_DCNB_BUILD_MODE=devcontainer"}, expected: "devcontainer"},
+		{name: "builder", packArgs: []string{"--builder", builder}, runResult: builderMode("devcontainer"), expected: "devcontainer"},
+		{name: "production builder", packArgs: []string{"-B", builder}, runResult: builderMode("production"), expected: "production"},
+		{name: "builder not pulled", packArgs: []string{"--builder", "missing-builder"}, expected: "production"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine := common.NewReplayEngine(common.ImageInspect{Id: "sha256:builder", RepoTags: []string{builder}})
+			engine.RunResult = test.runResult
+			options := finalize.FinalizeOptions{BuildModeOverride: test.override, Engine: engine}
+			if buildMode := packBuildMode(test.packArgs, options); buildMode != test.expected {
+				t.Errorf("Got build mode %q, expected %q", buildMode, test.expected)
+			}
+		})
+	}
+}
+
+func TestBuildDevContainerDockerfileSkipped(t *testing.T) {
+	applicationFolder := t.TempDir()
+	os.MkdirAll(filepath.Join(applicationFolder, ".devcontainer"), 0755)
+	os.WriteFile(filepath.Join(applicationFolder, ".devcontainer", "devcontainer.json"), []byte(`{"build": {"dockerfile": "Dockerfile"}}`), 0644)
+	os.WriteFile(filepath.Join(applicationFolder, ".devcontainer", "Dockerfile"), []byte("FROM ubuntu\n"), 0644)
+	tests := []struct {
+		name     string
+		override string
+		packArgs []string
+	}{
+		{name: "default production mode"},
+		{name: "production mode", override: "production"},
+		{name: "run image set", override: "devcontainer", packArgs: []string{"--run-image=my-run-image"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine := common.NewReplayEngine()
+			options := finalize.FinalizeOptions{BuildModeOverride: test.override, Engine: engine}
+			if runImage := buildDevContainerDockerfile("app", applicationFolder, test.packArgs, options); runImage != "" || len(engine.Builds) > 0 {
+				t.Errorf("Expected the Dockerfile to be skipped, got %q and builds %+v", runImage, engine.Builds)
+			}
+		})
+	}
+}
+
+func TestPackArgValue(t *testing.T) {
+	packArgs := []string{"--pull-policy=never", "-e", "A=b", "--env", "C=d", "--env=E=f", "--trust-builder"}
+	if value := packArgValue(packArgs, "--pull-policy"); value != "never" {
+		t.Errorf("Got pull policy %q", value)
+	}
+	if value := packArgValue(packArgs, "--run-image"); value != "" {
+		t.Errorf("Got run image %q", value)
+	}
+	if values := packArgValues(packArgs, "--env", "-e"); strings.Join(values, " ") != "A=b C=d E=f" {
+		t.Errorf("Got env %v", values)
+	}
+}
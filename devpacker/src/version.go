@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"sort"
+
+	"github.com/chuxel/devpacker-features/devpacker/finalize"
+)
+
+// Set at build time using -ldflags "-X main.Version=<version>"
+var Version = "dev"
+
+// Prints the devpacker version, how it was built, and the digests of embedded assets so it is clear which
+// versions of the bin/detect, bin/build, and post processing scripts a binary will use
+func printVersion(writer io.Writer) {
+	fmt.Fprintln(writer, "devpacker", Version)
+	fmt.Fprintf(writer, "Go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	if buildInfo, ok := debug.ReadBuildInfo(); ok && buildInfo.Main.Version != "" {
+		fmt.Fprintln(writer, "Module:", buildInfo.Main.Path, buildInfo.Main.Version)
+	}
+
+	assets := map[string][]byte{
+		"bin/detect": detectScriptPayload,
+		"bin/build":  buildScriptPayload,
+	}
+	for name, content := range finalize.EmbeddedAssets() {
+		assets[name] = content
+	}
+	names := make([]string, 0, len(assets))
+	for name := range assets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(writer, "Embedded assets:")
+	for _, name := range names {
+		digest := sha256.Sum256(assets[name])
+		fmt.Fprintf(writer, "  %-28s sha256:%s\n", name, hex.EncodeToString(digest[:])[:12])
+	}
+}